@@ -0,0 +1,319 @@
+package main
+
+import (
+	"authserver/config"
+	"authserver/store"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// command is a maintenance task run from the command line instead of starting the server,
+// for example `hmqauth bolt-backup -out users.bak`
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"bolt-compact": {
+		usage: "bolt-compact [-db file]\n\tcompacts the bolt database, hmqauth must not be running",
+		run:   compactBoltCommand,
+	},
+	"migration-status": {
+		usage: "migration-status\n\tlists the postgres schema migrations and whether they have been applied",
+		run:   migrationStatusCommand,
+	},
+	"copy-store": {
+		usage: "copy-store -from type -to type [-dry-run]\n\tcopies the users and groups, with their password hashes, from one storage type to another",
+		run:   copyStoreCommand,
+	},
+	"import-users": {
+		usage: "import-users -file file [-format csv|jsonl] [-atomic] [-update]\n\tadds the users in a CSV or JSON Lines file to the configured store",
+		run:   importUsersCommand,
+	},
+	"export-users": {
+		usage: "export-users [-format csv|jsonl] [-out file]\n\twrites the users of the configured store, without their passwords",
+		run:   exportUsersCommand,
+	},
+	"bolt-backup": {
+		usage: "bolt-backup [-db file] -out file\n\twrites a copy of the bolt database, hmqauth must not be running",
+		run:   backupBoltCommand,
+	},
+}
+
+// runCommand runs the command named by the first argument and returns the exit code
+func runCommand(args []string) int {
+
+	cmd, found := commands[args[0]]
+	if found == false {
+		fmt.Fprintln(os.Stderr, "Unknown command", args[0])
+		printUsage()
+		return 2
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, args[0]+":", err)
+		return 1
+	}
+	return 0
+}
+
+// printUsage lists the commands
+func printUsage() {
+
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Usage: hmqauth [command]\nWithout a command the server is started. The commands are:")
+	for _, v := range names {
+		fmt.Fprintln(os.Stderr, " ", commands[v].usage)
+	}
+}
+
+// compactBoltCommand compacts the bolt database in place
+func compactBoltCommand(args []string) error {
+
+	flags := flag.NewFlagSet("bolt-compact", flag.ContinueOnError)
+	fname := flags.String("db", config.Config.GetBoltFileName(), "bolt database file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	before, statError := os.Stat(*fname)
+	if statError != nil {
+		return statError
+	}
+	if err := store.CompactBolt(*fname); err != nil {
+		return err
+	}
+	after, statError := os.Stat(*fname)
+	if statError != nil {
+		return statError
+	}
+	fmt.Printf("Compacted %s from %d to %d bytes\n", *fname, before.Size(), after.Size())
+	return nil
+}
+
+// backupBoltCommand copies the bolt database to a backup file
+func backupBoltCommand(args []string) error {
+
+	flags := flag.NewFlagSet("bolt-backup", flag.ContinueOnError)
+	fname := flags.String("db", config.Config.GetBoltFileName(), "bolt database file")
+	out := flags.String("out", "", "backup file to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("The backup file must be given with -out")
+	}
+	if err := store.BackupBolt(*fname, *out); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s\n", *fname, *out)
+	return nil
+}
+
+// migrationStatusCommand lists the postgres schema migrations, it does not apply them
+func migrationStatusCommand(args []string) error {
+
+	flags := flag.NewFlagSet("migration-status", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	db, connectError := pgxpool.Connect(context.Background(), config.Config.GetConnString())
+	if connectError != nil {
+		return connectError
+	}
+	defer db.Close()
+
+	statuses, statusError := store.PostgresMigrationStatus(db)
+	if statusError != nil {
+		return statusError
+	}
+	pending := 0
+	for _, v := range statuses {
+		switch {
+		case v.Known == false:
+			fmt.Printf("%4d  %-40s applied %s, unknown to this version\n", v.Version, v.Name, v.Applied.Format(time.RFC3339))
+		case v.Applied.IsZero():
+			fmt.Printf("%4d  %-40s pending\n", v.Version, v.Name)
+			pending++
+		default:
+			fmt.Printf("%4d  %-40s applied %s\n", v.Version, v.Name, v.Applied.Format(time.RFC3339))
+		}
+	}
+	fmt.Printf("%d pending, they are applied when hmqauth starts\n", pending)
+	return nil
+}
+
+// openStore opens and loads a store of the given type, set up from the configuration. Unlike NewStorage
+// it does not watch the json files, and an unknown type is an error. As with NewStorage no type is json
+func openStore(storageType string) (store.UserPersistence, error) {
+
+	var opened store.UserPersistence
+	switch storageType {
+	case "json", "":
+		collection := store.InitJSON(config.Config.GetStorageFileName(), config.Config.GetGroupsFileName(), config.Config.GetSessionsFileName())
+		collection.Backups = config.Config.GetJSONBackups()
+		collection.AuditFname = config.Config.GetAuditFileName()
+		opened = collection
+	case "postgres":
+		opened = store.InitPostgres(config.Config.GetConnString())
+	case "sqlite":
+		opened = store.InitSQLite(config.Config.GetSQLiteFileName())
+	case "bolt":
+		opened = store.InitBolt(config.Config.GetBoltFileName())
+	default:
+		return nil, errors.New("Unknown storage type " + storageType + ", it must be json, postgres, sqlite or bolt")
+	}
+	if err := opened.Load(); err != nil {
+		return nil, err
+	}
+	return opened, nil
+}
+
+// copyStoreCommand copies the users and groups from one store to another, or lists what it would change
+func copyStoreCommand(args []string) error {
+
+	flags := flag.NewFlagSet("copy-store", flag.ContinueOnError)
+	from := flags.String("from", "", "storage type to copy from: json, postgres, sqlite or bolt")
+	to := flags.String("to", "", "storage type to copy to")
+	dryRun := flags.Bool("dry-run", false, "list the changes without making them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New("Both -from and -to must be given")
+	}
+	if *from == *to {
+		return errors.New("The stores copied from and to must be of different types")
+	}
+	source, sourceError := openStore(*from)
+	if sourceError != nil {
+		return sourceError
+	}
+	target, targetError := openStore(*to)
+	if targetError != nil {
+		return targetError
+	}
+
+	audit := store.AuditEntry{Time: time.Now(), Actor: commandActor("copy-store"), Action: "copystore"}
+	changes, copyError := store.CopyStore(source, target, *dryRun, audit)
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind == "group"
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	counts := make(map[string]int)
+	for _, v := range changes {
+		fmt.Printf("%-6s %-5s %s\n", v.Action, v.Kind, v.Name)
+		counts[v.Action]++
+	}
+	if copyError != nil {
+		return copyError
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, nothing written: %d to add, %d to update, %d only in %s left alone\n", counts["add"], counts["update"], counts["extra"], *to)
+		return nil
+	}
+	fmt.Printf("Copied from %s to %s: %d added, %d updated, %d only in %s left alone\n", *from, *to, counts["add"], counts["update"], counts["extra"], *to)
+	return nil
+}
+
+// commandActor returns the actor the changes made by a command are recorded under in the audit trail,
+// the command along with the account it was run from
+func commandActor(command string) string {
+	if account, err := user.Current(); err == nil {
+		return command + " command run by " + account.Username
+	}
+	return command + " command"
+}
+
+// bulkFileFormat returns the format of a bulk file, from -format if given or else from its extension
+func bulkFileFormat(format string, fname string) string {
+
+	if format != "" {
+		return strings.ToLower(format)
+	}
+	if strings.ToLower(filepath.Ext(fname)) == ".csv" {
+		return store.BulkCSV
+	}
+	return store.BulkJSONL
+}
+
+// importUsersCommand adds the users in a file to the configured store and lists the rows it could not add
+func importUsersCommand(args []string) error {
+
+	flags := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	fname := flags.String("file", "", "CSV or JSON Lines file of users")
+	format := flags.String("format", "", "csv or jsonl, taken from the file extension if not given")
+	options := store.ImportOptions{Audit: store.AuditEntry{Time: time.Now(), Actor: commandActor("import-users"), Action: "importusers"}}
+	flags.BoolVar(&options.Atomic, "atomic", false, "import nothing if any row has an error")
+	flags.BoolVar(&options.Update, "update", false, "replace users that already exist")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *fname == "" {
+		return errors.New("The file must be given with -file")
+	}
+	file, openError := os.Open(*fname)
+	if openError != nil {
+		return openError
+	}
+	defer file.Close()
+	target, storeError := openStore(config.Config.GetStorageType())
+	if storeError != nil {
+		return storeError
+	}
+
+	result, importError := store.ImportUsers(target, file, bulkFileFormat(*format, *fname), options)
+	if importError != nil {
+		return importError
+	}
+	for _, v := range result.Errors {
+		fmt.Printf("row %d %s: %s\n", v.Row, v.UserName, v.Error)
+	}
+	if len(result.Errors) > 0 && options.Atomic {
+		return fmt.Errorf("Nothing imported, %d rows have errors", len(result.Errors))
+	}
+	fmt.Printf("%d added, %d updated, %d rows with errors\n", result.Added, result.Updated, len(result.Errors))
+	return nil
+}
+
+// exportUsersCommand writes the users of the configured store to a file or the standard output
+func exportUsersCommand(args []string) error {
+
+	flags := flag.NewFlagSet("export-users", flag.ContinueOnError)
+	out := flags.String("out", "", "file to write, the standard output if not given")
+	format := flags.String("format", "", "csv or jsonl, taken from the file extension if not given")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	source, storeError := openStore(config.Config.GetStorageType())
+	if storeError != nil {
+		return storeError
+	}
+	if *out == "" {
+		return store.ExportUsers(os.Stdout, source.GetUsers(), bulkFileFormat(*format, *out))
+	}
+	file, createError := os.Create(*out)
+	if createError != nil {
+		return createError
+	}
+	if err := store.ExportUsers(file, source.GetUsers(), bulkFileFormat(*format, *out)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
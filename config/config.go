@@ -15,26 +15,72 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 // Config is a global containing the current configuration info
 var Config Configuration
 
 // Done is a global chan which is closed when the app is shutting down
-var Done chan bool
+var Done = make(chan bool)
 
 // WG is a global waitgroup used in application shutdown
 var WG sync.WaitGroup
 
-//Configuration holds the runtime config info
+// Configuration holds the runtime config info
 type Configuration struct {
-	Connstring      string
-	Port            string
-	StorageType     string // json or postgres
-	StorageFileName string
+	Connstring       string
+	Port             string
+	StorageType      string // json, postgres, sqlite or bolt
+	StorageFileName  string
+	GroupsFileName   string
+	SessionsFileName string
+	JSONBackups      int    // backups kept of each json file in case json is used, -1 keeps none
+	AuditFileName    string // audit trail file in case json is used
+	SQLiteFileName   string // database file in case sqlite is used
+	BoltFileName     string // database file in case bolt is used
+	SessionTimeout   int    // minutes of inactivity before a management session expires
+	TokenHashKey     string // secret used to hash the session tokens before they are stored
+	TokenMode        string // opaque or jwt, the kind of token handed out by a management login
+	JWTIssuer        string // iss claim of the management JWTs
+	JWTKeys          []JWTKey
+	MQTTJWTIssuers   []JWTIssuer // issuers whose JWTs are accepted as mqtt passwords
+	LockoutThreshold int         // failed logins for a username or address before it is locked out
+	LockoutDuration  int         // seconds of the first lockout, doubled for every further failure
+	LockoutMax       int         // seconds a lockout is capped at
+	LockoutWindow    int         // minutes without a failed login after which the failures are forgotten
+	AuthAddressField string      // form field of /mqtt/auth holding the device's address, hmq does not send one
+	CacheSize        int         // number of auth and acl decisions cached, -1 turns the cache off
+	CacheTTL         int         // seconds an auth or acl decision is cached for
+	DecisionLog      bool        // log the auth and acl decisions answered to hmq
+	DecisionSample   float64     // fraction of the decisions logged, all of them if 0
+	DecisionLogSize  int         // recent decisions kept for the decisions endpoint, -1 keeps none
 	sync.RWMutex
 }
 
+// JWTKey is a key used to sign the management JWTs. Keys are rotated by adding a new key whose NotBefore
+// is in the future and setting a NotAfter on the old one - a little later than the new key's NotBefore
+// plus the session timeout, so that tokens signed with the old key stay valid until they expire
+type JWTKey struct {
+	KID       string    // key id, set in the header of the tokens and published in the JWKS
+	KeyFile   string    // PEM file with the RSA or ECDSA (P-256) private key
+	NotBefore time.Time // the key is not used to sign tokens before this time
+	NotAfter  time.Time // tokens signed with the key are not accepted after this time, zero for no limit
+}
+
+// JWTIssuer is a trusted issuer of the JWTs devices may send as their mqtt password
+type JWTIssuer struct {
+	Issuer   string         // iss claim the tokens must carry
+	Audience string         // aud claim the tokens must carry, not checked if blank
+	Keys     []JWTPublicKey // keys the issuer signs with
+}
+
+// JWTPublicKey is a public key of a trusted issuer
+type JWTPublicKey struct {
+	KID     string // key id the tokens carry in their header, may be blank if the issuer has a single key
+	KeyFile string // PEM file with the RSA or ECDSA public key
+}
+
 // GetConnString returns the DB connection string as defined in the config.json
 func (s *Configuration) GetConnString() string {
 	s.RLock()
@@ -65,7 +111,7 @@ func (s *Configuration) SetPort(newval string) {
 	return
 }
 
-// GetStorageType returns the type of data storage, json or postgres
+// GetStorageType returns the type of data storage, json, postgres, sqlite or bolt
 func (s *Configuration) GetStorageType() string {
 	s.RLock()
 	defer s.RUnlock()
@@ -79,6 +125,226 @@ func (s *Configuration) GetStorageFileName() string {
 	return s.StorageFileName
 }
 
+// GetGroupsFileName returns the name of the groups storage file in case json is used
+func (s *Configuration) GetGroupsFileName() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.GroupsFileName == "" {
+		return "assets/groups.json"
+	}
+	return s.GroupsFileName
+}
+
+// GetSessionsFileName returns the name of the sessions storage file in case json is used
+func (s *Configuration) GetSessionsFileName() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.SessionsFileName == "" {
+		return "assets/sessions.json"
+	}
+	return s.SessionsFileName
+}
+
+// GetSQLiteFileName returns the name of the database file in case sqlite is used
+func (s *Configuration) GetSQLiteFileName() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.SQLiteFileName == "" {
+		return "assets/users.db"
+	}
+	return s.SQLiteFileName
+}
+
+// GetBoltFileName returns the name of the database file in case bolt is used
+func (s *Configuration) GetBoltFileName() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.BoltFileName == "" {
+		return "assets/users.bolt"
+	}
+	return s.BoltFileName
+}
+
+// GetAuditFileName returns the name of the audit trail file in case json is used
+func (s *Configuration) GetAuditFileName() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.AuditFileName == "" {
+		return "assets/audit.jsonl"
+	}
+	return s.AuditFileName
+}
+
+// GetJSONBackups returns how many backups are kept of each json file, 3 by default and 0 if turned off
+func (s *Configuration) GetJSONBackups() int {
+	s.RLock()
+	defer s.RUnlock()
+	if s.JSONBackups < 0 {
+		return 0
+	}
+	if s.JSONBackups == 0 {
+		return 3
+	}
+	return s.JSONBackups
+}
+
+// GetSessionTimeout returns how long a management session lasts without being used, an hour by default
+func (s *Configuration) GetSessionTimeout() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	if s.SessionTimeout <= 0 {
+		return time.Hour
+	}
+	return time.Duration(s.SessionTimeout) * time.Minute
+}
+
+// GetTokenHashKey returns the secret the session tokens are hashed with
+func (s *Configuration) GetTokenHashKey() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.TokenHashKey
+}
+
+// GetTokenMode returns the kind of token handed out on a management login, opaque unless set to jwt
+func (s *Configuration) GetTokenMode() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.TokenMode == "" {
+		return "opaque"
+	}
+	return s.TokenMode
+}
+
+// GetJWTIssuer returns the issuer of the management JWTs
+func (s *Configuration) GetJWTIssuer() string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.JWTIssuer == "" {
+		return "hmqauth"
+	}
+	return s.JWTIssuer
+}
+
+// GetJWTKeys returns the keys used to sign the management JWTs
+func (s *Configuration) GetJWTKeys() []JWTKey {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]JWTKey, len(s.JWTKeys))
+	copy(keys, s.JWTKeys)
+	return keys
+}
+
+// GetMQTTJWTIssuers returns the issuers whose JWTs are accepted as mqtt passwords
+func (s *Configuration) GetMQTTJWTIssuers() []JWTIssuer {
+	s.RLock()
+	defer s.RUnlock()
+	issuers := make([]JWTIssuer, len(s.MQTTJWTIssuers))
+	copy(issuers, s.MQTTJWTIssuers)
+	return issuers
+}
+
+// GetLockoutThreshold returns how many failed logins lock out a username or address, 5 by default
+func (s *Configuration) GetLockoutThreshold() int {
+	s.RLock()
+	defer s.RUnlock()
+	if s.LockoutThreshold <= 0 {
+		return 5
+	}
+	return s.LockoutThreshold
+}
+
+// GetLockoutDuration returns how long the first lockout lasts, 30 seconds by default
+func (s *Configuration) GetLockoutDuration() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	if s.LockoutDuration <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(s.LockoutDuration) * time.Second
+}
+
+// GetLockoutMax returns the longest a lockout can last, an hour by default
+func (s *Configuration) GetLockoutMax() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	if s.LockoutMax <= 0 {
+		return time.Hour
+	}
+	return time.Duration(s.LockoutMax) * time.Second
+}
+
+// GetLockoutWindow returns how long failed logins are remembered, an hour by default
+func (s *Configuration) GetLockoutWindow() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	if s.LockoutWindow <= 0 {
+		return time.Hour
+	}
+	return time.Duration(s.LockoutWindow) * time.Minute
+}
+
+// GetAuthAddressField returns the form field of /mqtt/auth that holds the device's address, added by a proxy
+// in front of hmqauth as hmq only sends the username, client id and password. Blank if there is none
+func (s *Configuration) GetAuthAddressField() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.AuthAddressField
+}
+
+// GetCacheSize returns how many auth and acl decisions are cached, 10000 by default and 0 if turned off
+func (s *Configuration) GetCacheSize() int {
+	s.RLock()
+	defer s.RUnlock()
+	if s.CacheSize < 0 {
+		return 0
+	}
+	if s.CacheSize == 0 {
+		return 10000
+	}
+	return s.CacheSize
+}
+
+// GetCacheTTL returns how long an auth or acl decision is cached for, a minute by default
+func (s *Configuration) GetCacheTTL() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	if s.CacheTTL <= 0 {
+		return time.Minute
+	}
+	return time.Duration(s.CacheTTL) * time.Second
+}
+
+// GetDecisionLog returns whether the auth and acl decisions are logged
+func (s *Configuration) GetDecisionLog() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.DecisionLog
+}
+
+// GetDecisionSample returns the fraction of the decisions logged, all of them by default
+func (s *Configuration) GetDecisionSample() float64 {
+	s.RLock()
+	defer s.RUnlock()
+	if s.DecisionSample <= 0 || s.DecisionSample > 1 {
+		return 1
+	}
+	return s.DecisionSample
+}
+
+// GetDecisionLogSize returns how many recent decisions are kept for the decisions endpoint, 1000 by default
+// and 0 if turned off
+func (s *Configuration) GetDecisionLogSize() int {
+	s.RLock()
+	defer s.RUnlock()
+	if s.DecisionLogSize < 0 {
+		return 0
+	}
+	if s.DecisionLogSize == 0 {
+		return 1000
+	}
+	return s.DecisionLogSize
+}
+
 // SaveToFile saves the configuration
 func (s *Configuration) SaveToFile(fname string) {
 	if fname == "" {
@@ -3,10 +3,13 @@ module authserver
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/jackc/pgx/v4 v4.10.0
-	github.com/rs/xid v1.2.1
+	github.com/mattn/go-sqlite3 v1.14.16
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
@@ -0,0 +1,233 @@
+package jwtauth
+
+// This implements the checking of the JWTs devices may send as their mqtt password. The tokens are minted
+// by a trusted issuer and can carry the topic permissions of the device, which are kept in memory for
+// the life of the token so the ACL checks do not need a user in the store
+
+import (
+	"authserver/config"
+	"authserver/store"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// issuerKey is a public key of a trusted issuer
+type issuerKey struct {
+	kid    string
+	public crypto.PublicKey
+}
+
+// trustedIssuer is an issuer whose JWTs are accepted as mqtt passwords
+type trustedIssuer struct {
+	issuer   string
+	audience string
+	keys     []issuerKey
+}
+
+// DeviceVerifier checks the JWTs sent as mqtt passwords against the configured issuers
+type DeviceVerifier struct {
+	issuers map[string]trustedIssuer
+}
+
+// DeviceClaims are the claims of a device JWT, the subject is the mqtt username
+type DeviceClaims struct {
+	SuperUser bool                `json:"superuser"`
+	ClientIDs store.ClientIDArray `json:"clientids,omitempty"`
+	Topics    store.TopicArray    `json:"topics,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// User returns the user described by the claims of a device JWT
+func (me *DeviceClaims) User() store.User {
+	return store.User{
+		UserName:  me.Subject,
+		SuperUser: me.SuperUser,
+		ClientIDs: me.ClientIDs,
+		Topics:    me.Topics,
+	}
+}
+
+// LoadDeviceVerifier reads the public keys of the trusted issuers from their PEM files
+func LoadDeviceVerifier(issuers []config.JWTIssuer) (*DeviceVerifier, error) {
+
+	verifier := &DeviceVerifier{issuers: make(map[string]trustedIssuer)}
+	for _, v := range issuers {
+		if v.Issuer == "" {
+			return nil, errors.New("Every JWT issuer needs an Issuer")
+		}
+		if len(v.Keys) == 0 {
+			return nil, errors.New("No keys configured for JWT issuer " + v.Issuer)
+		}
+		trusted := trustedIssuer{issuer: v.Issuer, audience: v.Audience}
+		for _, k := range v.Keys {
+			if k.KID == "" && len(v.Keys) > 1 {
+				return nil, errors.New("JWT issuer " + v.Issuer + " has several keys so every key needs a KID")
+			}
+			pemBytes, readError := ioutil.ReadFile(k.KeyFile)
+			if readError != nil {
+				return nil, readError
+			}
+			public, keyError := parsePublicKey(pemBytes)
+			if keyError != nil {
+				return nil, errors.New("Could not read key of JWT issuer " + v.Issuer + ": " + keyError.Error())
+			}
+			trusted.keys = append(trusted.keys, issuerKey{kid: k.KID, public: public})
+		}
+		verifier.issuers[v.Issuer] = trusted
+	}
+	return verifier, nil
+}
+
+// parsePublicKey reads an RSA or ECDSA public key
+func parsePublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+
+	rsaKey, rsaError := jwt.ParseRSAPublicKeyFromPEM(pemBytes)
+	if rsaError == nil {
+		return rsaKey, nil
+	}
+	ecKey, ecError := jwt.ParseECPublicKeyFromPEM(pemBytes)
+	if ecError == nil {
+		return ecKey, nil
+	}
+	return nil, errors.New("Key must be a PEM encoded RSA or ECDSA public key")
+}
+
+// Verify checks a device JWT sent as the password of the given mqtt username and returns its claims
+func (me *DeviceVerifier) Verify(tokenString string, username string) (*DeviceClaims, error) {
+
+	// The issuer is read before the signature is checked, only to find the keys to check it with
+	var unverified DeviceClaims
+	_, _, parseError := jwt.NewParser().ParseUnverified(tokenString, &unverified)
+	if parseError != nil {
+		return nil, parseError
+	}
+	issuer, found := me.issuers[unverified.Issuer]
+	if found == false {
+		return nil, errors.New("Unknown issuer")
+	}
+
+	var claims DeviceClaims
+	_, verifyError := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, v := range issuer.keys {
+			if v.kid != kid {
+				continue
+			}
+			switch v.public.(type) {
+			case *rsa.PublicKey:
+				if _, isRSA := token.Method.(*jwt.SigningMethodRSA); isRSA == false {
+					return nil, errors.New("Unexpected signing method")
+				}
+			case *ecdsa.PublicKey:
+				if _, isECDSA := token.Method.(*jwt.SigningMethodECDSA); isECDSA == false {
+					return nil, errors.New("Unexpected signing method")
+				}
+			}
+			return v.public, nil
+		}
+		return nil, errors.New("Unknown key")
+	})
+	if verifyError != nil {
+		return nil, verifyError
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("Token does not expire")
+	}
+	if issuer.audience != "" && claims.VerifyAudience(issuer.audience, true) == false {
+		return nil, errors.New("Unexpected audience")
+	}
+	if claims.Subject == "" || claims.Subject != username {
+		return nil, errors.New("Token subject does not match the username")
+	}
+	return &claims, nil
+}
+
+// How often the devices whose tokens have expired are cleared out of the device cache. They are never
+// returned once expired, so this only bounds the memory they take up
+const deviceSweepInterval = time.Minute
+
+// cachedDevice is a device that connected with a JWT, kept until the token expires
+type cachedDevice struct {
+	user    store.User
+	expires time.Time
+}
+
+// DeviceCache holds the devices that connected with a JWT, by username and client id, so the ACL checks
+// can be answered from the claims of their token
+type DeviceCache struct {
+	devices map[string]cachedDevice
+	swept   time.Time
+	now     func() time.Time
+	sync.RWMutex
+}
+
+// NewDeviceCache returns an empty device cache
+func NewDeviceCache() *DeviceCache {
+	return &DeviceCache{
+		devices: make(map[string]cachedDevice),
+		now:     time.Now,
+	}
+}
+
+// deviceKey returns the cache key of a connection
+func deviceKey(username string, clientID string) string {
+	return username + "\x00" + clientID
+}
+
+// Add caches the claims of a device that connected with the given client id
+func (me *DeviceCache) Add(clientID string, claims *DeviceClaims) {
+	me.Lock()
+	defer me.Unlock()
+
+	// the expired devices are cleared out now and then rather than on every connect, which would scan
+	// every device under the lock each time during a reconnect storm
+	if now := me.now(); now.Sub(me.swept) >= deviceSweepInterval {
+		me.sweep(now)
+		me.swept = now
+	}
+	user := claims.User()
+	user.IndexTopics()
+	me.devices[deviceKey(claims.Subject, clientID)] = cachedDevice{user: user, expires: claims.ExpiresAt.Time}
+}
+
+// sweep forgets the devices whose tokens have expired. The caller must hold the lock
+func (me *DeviceCache) sweep(now time.Time) {
+	for k, v := range me.devices {
+		if now.After(v.expires) {
+			delete(me.devices, k)
+		}
+	}
+}
+
+// Get returns the user of a device that connected with a JWT that has not yet expired
+func (me *DeviceCache) Get(username string, clientID string) (store.User, bool) {
+	me.RLock()
+	defer me.RUnlock()
+
+	device, found := me.devices[deviceKey(username, clientID)]
+	if found == false || me.now().After(device.expires) {
+		return store.User{}, false
+	}
+	return device.user, true
+}
+
+// Remove forgets a device, used when it connects again with a stored password. It returns false if the
+// device was not cached
+func (me *DeviceCache) Remove(username string, clientID string) bool {
+	me.Lock()
+	defer me.Unlock()
+
+	key := deviceKey(username, clientID)
+	if _, found := me.devices[key]; found == false {
+		return false
+	}
+	delete(me.devices, key)
+	return true
+}
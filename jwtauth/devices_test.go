@@ -0,0 +1,146 @@
+package jwtauth
+
+import (
+	"authserver/config"
+	"authserver/store"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// newTestIssuer creates an ECDSA key for an issuer and writes its public half to a PEM file
+func newTestIssuer(t *testing.T) (*ecdsa.PrivateKey, string) {
+
+	dir, err := ioutil.TempDir("", "jwtauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "issuer.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key, keyFile
+}
+
+func signDeviceToken(t *testing.T, key *ecdsa.PrivateKey, claims DeviceClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestDeviceVerify(t *testing.T) {
+
+	key, keyFile := newTestIssuer(t)
+	otherKey, _ := newTestIssuer(t)
+	verifier, err := LoadDeviceVerifier([]config.JWTIssuer{{Issuer: "provisioning", Audience: "hmq", Keys: []config.JWTPublicKey{{KeyFile: keyFile}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := func(issuer string, subject string, audience string, expires time.Duration) jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
+		}
+	}
+	valid := DeviceClaims{
+		Topics:           store.TopicArray{{TopicString: "devices/%u/#", Pub: true, Sub: true}},
+		RegisteredClaims: registered("provisioning", "sensor42", "hmq", time.Minute),
+	}
+
+	claims, err := verifier.Verify(signDeviceToken(t, key, valid), "sensor42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, sub, err := claims.User().CheckTopicAuth("devices/sensor42/temp", "", nil)
+	if err != nil || pub == false || sub == false {
+		t.Errorf("topic from the claims not granted: %v %v %v", pub, sub, err)
+	}
+
+	tests := []struct {
+		name     string
+		key      *ecdsa.PrivateKey
+		claims   DeviceClaims
+		username string
+	}{
+		{"wrong username", key, valid, "sensor43"},
+		{"wrong signing key", otherKey, valid, "sensor42"},
+		{"unknown issuer", key, DeviceClaims{RegisteredClaims: registered("someone-else", "sensor42", "hmq", time.Minute)}, "sensor42"},
+		{"wrong audience", key, DeviceClaims{RegisteredClaims: registered("provisioning", "sensor42", "other", time.Minute)}, "sensor42"},
+		{"expired", key, DeviceClaims{RegisteredClaims: registered("provisioning", "sensor42", "hmq", -time.Minute)}, "sensor42"},
+	}
+	for _, tt := range tests {
+		if _, err := verifier.Verify(signDeviceToken(t, tt.key, tt.claims), tt.username); err == nil {
+			t.Errorf("%s: token was accepted", tt.name)
+		}
+	}
+}
+
+func TestDeviceCache(t *testing.T) {
+
+	cache := NewDeviceCache()
+	claims := &DeviceClaims{
+		SuperUser: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "sensor42",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	cache.Add("client1", claims)
+
+	user, found := cache.Get("sensor42", "client1")
+	if found == false || user.UserName != "sensor42" || user.SuperUser == false {
+		t.Errorf("cached device not found: %+v", user)
+	}
+	if _, found := cache.Get("sensor42", "client2"); found {
+		t.Errorf("device found under another client id")
+	}
+
+	cache.Remove("sensor42", "client1")
+	if _, found := cache.Get("sensor42", "client1"); found {
+		t.Errorf("removed device still found")
+	}
+
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+	cache.Add("client1", claims)
+	if _, found := cache.Get("sensor42", "client1"); found {
+		t.Errorf("device with an expired token found")
+	}
+
+	// expired devices are only cleared out once the sweep interval has passed
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Hour))
+	cache.Add("client2", claims)
+	if len(cache.devices) != 2 {
+		t.Errorf("expired device swept before the interval: %d devices", len(cache.devices))
+	}
+	now = now.Add(deviceSweepInterval + time.Second)
+	cache.Add("client3", claims)
+	if _, found := cache.devices[deviceKey("sensor42", "client1")]; found || len(cache.devices) != 2 {
+		t.Errorf("expired devices not swept: %d devices", len(cache.devices))
+	}
+}
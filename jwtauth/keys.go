@@ -0,0 +1,250 @@
+package jwtauth
+
+// This implements the signing and checking of the JWTs handed out on a management login when the
+// TokenMode is jwt, along with the JSON Web Key Set other services use to check them without calling
+// back into hmqauth
+
+import (
+	"authserver/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signingKey is one of the keys the management JWTs are signed with
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.PrivateKey
+	public    crypto.PublicKey
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// usableAt checks whether tokens signed with the key are accepted at the given time
+func (me signingKey) usableAt(now time.Time) bool {
+	return me.notAfter.IsZero() || now.Before(me.notAfter)
+}
+
+// KeySet holds the keys used to sign and check the management JWTs
+type KeySet struct {
+	issuer string
+	keys   []signingKey
+}
+
+// AccessClaims are the claims of a management JWT, the token id is the session the token was issued for
+type AccessClaims struct {
+	UserName string `json:"username"`
+	Admin    bool   `json:"admin"`
+	jwt.RegisteredClaims
+}
+
+// LoadKeySet reads the private keys of a key set from their PEM files
+func LoadKeySet(issuer string, keys []config.JWTKey) (*KeySet, error) {
+
+	if len(keys) == 0 {
+		return nil, errors.New("No JWT keys configured")
+	}
+	keySet := &KeySet{issuer: issuer}
+	for _, v := range keys {
+		if v.KID == "" {
+			return nil, errors.New("Every JWT key needs a KID")
+		}
+		pemBytes, readError := ioutil.ReadFile(v.KeyFile)
+		if readError != nil {
+			return nil, readError
+		}
+		key, keyError := parsePrivateKey(pemBytes)
+		if keyError != nil {
+			return nil, errors.New("Could not read JWT key " + v.KID + ": " + keyError.Error())
+		}
+		key.kid = v.KID
+		key.notBefore = v.NotBefore
+		key.notAfter = v.NotAfter
+		keySet.keys = append(keySet.keys, key)
+	}
+	return keySet, nil
+}
+
+// parsePrivateKey reads an RSA or ECDSA private key and picks the signing method that goes with it
+func parsePrivateKey(pemBytes []byte) (signingKey, error) {
+
+	var key signingKey
+	rsaKey, rsaError := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+	if rsaError == nil {
+		key.method = jwt.SigningMethodRS256
+		key.private = rsaKey
+		key.public = &rsaKey.PublicKey
+		return key, nil
+	}
+	ecKey, ecError := jwt.ParseECPrivateKeyFromPEM(pemBytes)
+	if ecError == nil {
+		method, methodError := ecdsaMethod(ecKey.Curve)
+		if methodError != nil {
+			return key, methodError
+		}
+		key.method = method
+		key.private = ecKey
+		key.public = &ecKey.PublicKey
+		return key, nil
+	}
+	return key, errors.New("Key must be a PEM encoded RSA or ECDSA private key")
+}
+
+// ecdsaMethod returns the signing method for the curve of an ECDSA key
+func ecdsaMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
+	}
+	return nil, errors.New("Unsupported elliptic curve")
+}
+
+// currentKey returns the key to sign with - of the keys that have come into use and not yet been
+// retired it is the one that came into use last
+func (me *KeySet) currentKey(now time.Time) (*signingKey, error) {
+	var current *signingKey
+	for k, v := range me.keys {
+		if now.Before(v.notBefore) || v.usableAt(now) == false {
+			continue
+		}
+		if current == nil || v.notBefore.After(current.notBefore) {
+			current = &me.keys[k]
+		}
+	}
+	if current == nil {
+		return nil, errors.New("No JWT key is currently valid for signing")
+	}
+	return current, nil
+}
+
+// Issue signs a management JWT for a user. The session id is carried as the token id so the JWT can still
+// be ended by logging out or by revoking the user's sessions. It must not be the session token: anyone
+// holding the JWT can read its claims, and the session outlives the JWT
+func (me *KeySet) Issue(username string, admin bool, sessionID string, lifetime time.Duration) (string, error) {
+
+	now := time.Now()
+	key, keyError := me.currentKey(now)
+	if keyError != nil {
+		return "", keyError
+	}
+
+	claims := AccessClaims{
+		UserName: username,
+		Admin:    admin,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    me.issuer,
+			Subject:   username,
+			ID:        sessionID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+		},
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Verify checks the signature, issuer and expiry of a management JWT and returns its claims
+func (me *KeySet) Verify(tokenString string) (*AccessClaims, error) {
+
+	var claims AccessClaims
+	_, parseError := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		now := time.Now()
+		for _, v := range me.keys {
+			if v.kid == kid && v.usableAt(now) {
+				if token.Method.Alg() != v.method.Alg() {
+					return nil, errors.New("Unexpected signing method")
+				}
+				return v.public, nil
+			}
+		}
+		return nil, errors.New("Unknown key")
+	})
+	if parseError != nil {
+		return nil, parseError
+	}
+	if claims.VerifyIssuer(me.issuer, true) == false {
+		return nil, errors.New("Unexpected issuer")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("Token does not expire")
+	}
+	return &claims, nil
+}
+
+// IsJWT checks whether a token looks like a JWT rather than an opaque token
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// JSONWebKey is the public half of a key as published in a JSON Web Key Set
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served on the JWKS endpoint
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys of every key that is not retired, including keys that will only be used
+// for signing in the future so that other services already know them when the rotation happens
+func (me *KeySet) JWKS() JSONWebKeySet {
+
+	jwks := JSONWebKeySet{Keys: []JSONWebKey{}}
+	now := time.Now()
+	for _, v := range me.keys {
+		if v.usableAt(now) == false {
+			continue
+		}
+		jwk := JSONWebKey{Kid: v.kid, Use: "sig", Alg: v.method.Alg()}
+		switch public := v.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(padCoordinate(public.X.Bytes(), size))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padCoordinate(public.Y.Bytes(), size))
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// padCoordinate left pads an elliptic curve coordinate with zeros to the full size of the curve
+func padCoordinate(coordinate []byte, size int) []byte {
+	if len(coordinate) >= size {
+		return coordinate
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(coordinate):], coordinate)
+	return padded
+}
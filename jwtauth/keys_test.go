@@ -0,0 +1,129 @@
+package jwtauth
+
+import (
+	"authserver/config"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeys writes an RSA and an ECDSA private key to PEM files in a temporary directory
+func writeTestKeys(t *testing.T) (string, string) {
+
+	dir, err := ioutil.TempDir("", "jwtauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile := filepath.Join(dir, "rsa.pem")
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(rsaFile, rsaPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecBytes, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecFile := filepath.Join(dir, "ec.pem")
+	if err := ioutil.WriteFile(ecFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return rsaFile, ecFile
+}
+
+func TestIssueAndVerify(t *testing.T) {
+
+	rsaFile, ecFile := writeTestKeys(t)
+	for _, keyFile := range []string{rsaFile, ecFile} {
+		keySet, err := LoadKeySet("hmqauth", []config.JWTKey{{KID: "k1", KeyFile: keyFile}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := keySet.Issue("Admin", true, "session1", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := keySet.Verify(token)
+		if err != nil {
+			t.Fatalf("Verify(%s) failed: %v", keyFile, err)
+		}
+		if claims.UserName != "Admin" || claims.Admin == false || claims.ID != "session1" {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+
+		otherIssuer, _ := LoadKeySet("someone-else", []config.JWTKey{{KID: "k1", KeyFile: keyFile}})
+		if _, err := otherIssuer.Verify(token); err == nil {
+			t.Errorf("token from another issuer was accepted")
+		}
+		expired, _ := keySet.Issue("Admin", true, "session1", -time.Minute)
+		if _, err := keySet.Verify(expired); err == nil {
+			t.Errorf("expired token was accepted")
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	rsaFile, ecFile := writeTestKeys(t)
+	now := time.Now()
+
+	oldKeys, err := LoadKeySet("hmqauth", []config.JWTKey{{KID: "old", KeyFile: rsaFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := oldKeys.Issue("Admin", true, "session1", time.Hour)
+
+	// the new key has come into use and the old one is retiring but not yet retired
+	rotated, err := LoadKeySet("hmqauth", []config.JWTKey{
+		{KID: "old", KeyFile: rsaFile, NotAfter: now.Add(time.Hour)},
+		{KID: "new", KeyFile: ecFile, NotBefore: now.Add(-time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Verify(oldToken); err != nil {
+		t.Errorf("token signed with the retiring key was rejected: %v", err)
+	}
+	newToken, _ := rotated.Issue("Admin", true, "session2", time.Hour)
+	claims, err := rotated.Verify(newToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ID != "session2" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if len(rotated.JWKS().Keys) != 2 {
+		t.Errorf("expected both keys in the JWKS, got %+v", rotated.JWKS())
+	}
+
+	// once the old key is retired its tokens are rejected and it leaves the JWKS
+	retired, _ := LoadKeySet("hmqauth", []config.JWTKey{
+		{KID: "old", KeyFile: rsaFile, NotAfter: now.Add(-time.Second)},
+		{KID: "new", KeyFile: ecFile, NotBefore: now.Add(-time.Minute)},
+	})
+	if _, err := retired.Verify(oldToken); err == nil {
+		t.Errorf("token signed with a retired key was accepted")
+	}
+	jwks := retired.JWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "new" || jwks.Keys[0].Kty != "EC" {
+		t.Errorf("unexpected JWKS %+v", jwks)
+	}
+}
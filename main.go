@@ -7,12 +7,17 @@ import (
 	"authserver/utils"
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
 
 	// load the configuration
 	configLoadErr := config.Config.LoadFromFile("assets/config.json")
+	if len(os.Args) > 1 {
+		// maintenance commands do not start the server, the configuration only gives them their defaults
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	if configLoadErr != nil {
 		log.Println("Could not get configuration", configLoadErr)
 		return
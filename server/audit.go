@@ -0,0 +1,113 @@
+package server
+
+import (
+	"authserver/store"
+	"authserver/utils"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The page size of the audit trail when none is asked for, and the largest that can be asked for
+const (
+	auditPageSize    = 50
+	auditMaxPageSize = 1000
+)
+
+// audit records a change in the audit trail. The change has already been made, so if it cannot be
+// recorded the failure is logged rather than returned
+func (me *StoreHandler) audit(r *http.Request, actor string, action string, target string, before json.RawMessage, after json.RawMessage) {
+	me.addAuditEntry(store.AuditEntry{Actor: actor, Action: action, Target: target, Before: before, After: after}, r)
+}
+
+// addAuditEntry records an audit entry, setting its time and the address the request came from
+func (me *StoreHandler) addAuditEntry(entry store.AuditEntry, r *http.Request) {
+	entry.Time = time.Now()
+	entry.SourceIP = remoteIP(r)
+	if err := me.store.AddAuditEntry(entry); err != nil {
+		log.Println("Could not record", entry.Action, "of", entry.Target, "by", entry.Actor, "in the audit trail:", err)
+	}
+}
+
+// auditUser records a change to a user, before is the user as they were or a blank user if they are new.
+// The user as they are after the change is read from the store
+func (me *StoreHandler) auditUser(r *http.Request, actor string, action string, username string, before store.User) {
+	after, _ := me.store.GetUserByUsername(username)
+	me.addAuditEntry(store.UserAuditEntry(store.AuditEntry{Actor: actor, Action: action, Target: username}, before, after), r)
+}
+
+// auditGroup records a change to a group, before is the group as it was or a blank group if it is new.
+// The group as it is after the change is read from the store
+func (me *StoreHandler) auditGroup(r *http.Request, actor string, action string, name string, before store.Group) {
+	after, _ := me.store.GetGroup(name)
+	me.addAuditEntry(store.GroupAuditEntry(store.AuditEntry{Actor: actor, Action: action, Target: name}, before, after), r)
+}
+
+// AuditLog returns a page of the audit trail, newest first. It can be filtered by actor, action, target
+// and by time with since and until in RFC 3339, and is paged with page (from 1) and pagesize
+func (me *StoreHandler) AuditLog(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	filter := store.AuditFilter{
+		Actor:  utils.GetSentValFromRequest(r, "actor"),
+		Action: utils.GetSentValFromRequest(r, "action"),
+		Target: utils.GetSentValFromRequest(r, "target"),
+		Limit:  auditPageSize,
+	}
+	for _, v := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := utils.GetSentValFromRequest(r, v.name)
+		if value == "" {
+			continue
+		}
+		parsed, parseError := time.Parse(time.RFC3339, value)
+		if parseError != nil {
+			utils.ReturnWithError(http.StatusBadRequest, v.name+" must be a time such as 2006-01-02T15:04:05Z", w)
+			return
+		}
+		*v.time = parsed
+	}
+	page := 1
+	if value := utils.GetSentValFromRequest(r, "page"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil || parsed < 1 {
+			utils.ReturnWithError(http.StatusBadRequest, "page must be a number from 1", w)
+			return
+		}
+		page = parsed
+	}
+	if value := utils.GetSentValFromRequest(r, "pagesize"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil || parsed < 1 || parsed > auditMaxPageSize {
+			utils.ReturnWithError(http.StatusBadRequest, "pagesize must be a number from 1 to "+strconv.Itoa(auditMaxPageSize), w)
+			return
+		}
+		filter.Limit = parsed
+	}
+	filter.Offset = (page - 1) * filter.Limit
+
+	entries, total, auditError := me.store.GetAuditEntries(filter)
+	if auditError != nil {
+		utils.ReturnWithError(http.StatusInternalServerError, "Error in reading the audit trail:"+auditError.Error(), w)
+		return
+	}
+	type auditPage struct {
+		Entries  []store.AuditEntry `json:"entries"`
+		Total    int                `json:"total"`
+		Page     int                `json:"page"`
+		PageSize int                `json:"pagesize"`
+	}
+	if entries == nil {
+		entries = []store.AuditEntry{}
+	}
+	utils.ReturnOKWithData("", auditPage{Entries: entries, Total: total, Page: page, PageSize: filter.Limit}, user.Token, w)
+}
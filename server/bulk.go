@@ -0,0 +1,87 @@
+package server
+
+import (
+	"authserver/store"
+	"authserver/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bulkFormat returns the format of a bulk import or export, from the format query parameter or else the
+// content type, JSON Lines by default. The query is read directly so that the body is left for the import
+func bulkFormat(r *http.Request) string {
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return store.BulkCSV
+	}
+	return store.BulkJSONL
+}
+
+// ImportUsers adds the users in the body of the request, a CSV or JSON Lines file, and reports the rows
+// that could not be added. With atomic=true nothing is added if any row has an error, and with
+// update=true users that already exist are replaced
+func (me *StoreHandler) ImportUsers(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+	if r.Method != "POST" {
+		utils.ReturnWithError(http.StatusMethodNotAllowed, "The users must be posted", w)
+		return
+	}
+
+	options := store.ImportOptions{Audit: store.AuditEntry{Time: time.Now(), Actor: user.UserName, Action: "importusers", SourceIP: remoteIP(r)}}
+	options.Atomic, _ = strconv.ParseBool(r.URL.Query().Get("atomic"))
+	options.Update, _ = strconv.ParseBool(r.URL.Query().Get("update"))
+	result, importError := store.ImportUsers(me.store, r.Body, bulkFormat(r), options)
+	if importError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, "Error in importing users:"+importError.Error(), w)
+		return
+	}
+
+	message := "Users imported"
+	switch {
+	case len(result.Errors) > 0 && options.Atomic:
+		message = "Nothing imported, " + strconv.Itoa(len(result.Errors)) + " rows have errors"
+	case len(result.Errors) > 0:
+		message = "Users imported, " + strconv.Itoa(len(result.Errors)) + " rows have errors"
+	}
+	log.Println(message+":", result.Added, "added,", result.Updated, "updated by", user.UserName)
+	utils.ReturnOKWithData(message, result, user.Token, w)
+}
+
+// ExportUsers streams every user along with their topics, client ids and groups as a CSV or JSON Lines
+// file. Password hashes are never exported
+func (me *StoreHandler) ExportUsers(w http.ResponseWriter, r *http.Request) {
+
+	_, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	format := bulkFormat(r)
+	switch format {
+	case store.BulkCSV:
+		w.Header().Set("Content-Type", "text/csv")
+	case store.BulkJSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		utils.ReturnWithError(http.StatusBadRequest, "Unknown format "+format+", it must be csv or jsonl", w)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=users."+format)
+	w.WriteHeader(http.StatusOK)
+	if err := store.ExportUsers(w, me.store.GetUsers(), format); err != nil {
+		// the response has started, so the export can only be cut short
+		log.Println("Error in exporting users:", err)
+	}
+}
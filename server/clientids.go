@@ -0,0 +1,135 @@
+package server
+
+import (
+	"authserver/store"
+	"authserver/utils"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// getClientIDFromRequest reads the client id sent either as a JSON body on a POST or as a parameter on a GET
+func getClientIDFromRequest(r *http.Request) (string, error) {
+
+	type clientIDRequest struct {
+		ClientID string `json:"clientid"`
+	}
+	var cidRequest clientIDRequest
+
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error Reading Body", err.Error())
+			return "", err
+		}
+		newerr := json.Unmarshal(body, &cidRequest)
+		if newerr != nil {
+			return "", newerr
+		}
+	}
+	if r.Method == "GET" {
+		cidRequest.ClientID = utils.GetSentValFromRequest(r, "clientid")
+	}
+	return cidRequest.ClientID, nil
+}
+
+// AddUserClientID adds a client id, or a client id pattern using * and ?, that the user is allowed to connect with
+func (me *StoreHandler) AddUserClientID(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	userToAddClientIDTo := mux.Vars(r)["userID"]
+	before, targetUserError := me.store.GetUserByUsername(userToAddClientIDTo)
+	if targetUserError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "User not found", w)
+		return
+	}
+
+	clientID, clientIDError := getClientIDFromRequest(r)
+	if clientIDError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, "Could not read request body", w)
+		return
+	}
+	if clientID == "" {
+		utils.ReturnWithError(http.StatusBadRequest, "Client id cannot be blank", w)
+		return
+	}
+
+	addClientIDError := me.store.AddClientIDToUser(userToAddClientIDTo, clientID)
+	if addClientIDError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, addClientIDError.Error(), w)
+		return
+	}
+	me.auditUser(r, user.UserName, "adduserclientid", userToAddClientIDTo, before)
+	utils.ReturnOK("Client id added", user.Token, w)
+}
+
+// DeleteUserClientID removes an allowed client id from a user
+func (me *StoreHandler) DeleteUserClientID(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	userToDeleteClientIDFrom := mux.Vars(r)["userID"]
+	clientID, clientIDError := getClientIDFromRequest(r)
+	if clientIDError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, "Could not read request body", w)
+		return
+	}
+	if clientID == "" {
+		utils.ReturnWithError(http.StatusBadRequest, "Must provide a client id", w)
+		return
+	}
+
+	before, _ := me.store.GetUserByUsername(userToDeleteClientIDFrom)
+	deleteClientIDError := me.store.DeleteClientIDFromUser(userToDeleteClientIDFrom, clientID)
+	if deleteClientIDError != nil {
+		utils.ReturnWithError(http.StatusNotFound, deleteClientIDError.Error(), w)
+		return
+	}
+	me.auditUser(r, user.UserName, "deleteuserclientid", userToDeleteClientIDFrom, before)
+	utils.ReturnOK("Client id deleted", user.Token, w)
+}
+
+// ListUserClientIDs returns the client ids a user is allowed to connect with
+// Any user can list their own client ids, only admin users can list another user's client ids
+func (me *StoreHandler) ListUserClientIDs(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, "Could not authorise user", w)
+		return
+	}
+
+	userIDToGetClientIDsFor := mux.Vars(r)["userID"]
+	if user.Admin == false && user.UserName != userIDToGetClientIDsFor {
+		utils.ReturnWithError(http.StatusUnauthorized, "Not Authorised", w)
+		return
+	}
+
+	userToGetClientIDsFor, getUserError := me.store.GetUserByUsername(userIDToGetClientIDsFor)
+	if getUserError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "Could not get that user", w)
+		return
+	}
+
+	type clientIDsReturn struct {
+		Username  string              `json:"username"`
+		ClientIDs store.ClientIDArray `json:"clientids"`
+	}
+	var cidr clientIDsReturn
+	cidr.Username = userToGetClientIDsFor.UserName
+	cidr.ClientIDs = userToGetClientIDsFor.ClientIDs
+
+	utils.ReturnOKWithData("ok", cidr, user.Token, w)
+}
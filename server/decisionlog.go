@@ -0,0 +1,200 @@
+package server
+
+import (
+	"authserver/config"
+	"authserver/store"
+	"authserver/utils"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The number of decisions returned by the decisions endpoint when none is asked for
+const decisionTail = 50
+
+// Decision is an auth or acl decision answered to hmq, as written to the decision log
+type Decision struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"` // auth or acl
+	UserName  string    `json:"username"`
+	ClientID  string    `json:"clientid"`
+	Topic     string    `json:"topic,omitempty"`
+	Access    string    `json:"access,omitempty"` // 1 for sub and 2 for pub, as sent by hmq
+	Result    string    `json:"result"`           // allow or deny
+	Status    int       `json:"status"`
+	Rule      string    `json:"rule"` // what the decision was made by, blank if it came from the decision cache
+	Cached    bool      `json:"cached"`
+	LatencyMS float64   `json:"latencyms"`
+}
+
+// DecisionLog writes the decisions answered to hmq to the log as json, or a sample of them, and keeps the
+// most recent to be looked at by user. A user can be debugged: every one of their decisions is logged
+// whether the log is on or not, and is worked out afresh rather than taken from the decision cache so
+// that it shows the rule it was made by
+type DecisionLog struct {
+	recent []Decision
+	next   int
+	debug  map[string]bool
+	random func() float64
+	sync.Mutex
+}
+
+// NewDecisionLog returns a decision log with nothing logged and no user debugged
+func NewDecisionLog() *DecisionLog {
+	return &DecisionLog{
+		debug:  make(map[string]bool),
+		random: rand.Float64,
+	}
+}
+
+// Debugging checks whether the decisions of a user are being debugged
+func (me *DecisionLog) Debugging(username string) bool {
+	me.Lock()
+	defer me.Unlock()
+	return me.debug[username]
+}
+
+// SetDebug turns the debugging of a user on or off
+func (me *DecisionLog) SetDebug(username string, debug bool) {
+	me.Lock()
+	defer me.Unlock()
+	if debug {
+		me.debug[username] = true
+	} else {
+		delete(me.debug, username)
+	}
+}
+
+// Debugged returns the users being debugged
+func (me *DecisionLog) Debugged() []string {
+	me.Lock()
+	defer me.Unlock()
+	usernames := []string{}
+	for k := range me.debug {
+		usernames = append(usernames, k)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// Record logs a decision made for a request that arrived at start, if the log is on and the decision is
+// sampled or if its user is being debugged
+func (me *DecisionLog) Record(decision Decision, start time.Time) {
+	decision.Time = start
+	decision.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	decision.Result = "deny"
+	if decision.Status == http.StatusOK {
+		decision.Result = "allow"
+	}
+
+	me.Lock()
+	if me.debug[decision.UserName] == false {
+		if config.Config.GetDecisionLog() == false {
+			me.Unlock()
+			return
+		}
+		if sample := config.Config.GetDecisionSample(); sample < 1 && me.random() >= sample {
+			me.Unlock()
+			return
+		}
+	}
+	if size := config.Config.GetDecisionLogSize(); size > 0 {
+		if len(me.recent) < size {
+			me.recent = append(me.recent, decision)
+		} else {
+			me.recent[me.next%len(me.recent)] = decision
+		}
+		me.next = (me.next + 1) % size
+	}
+	me.Unlock()
+
+	line, err := json.Marshal(decision)
+	if err != nil {
+		log.Println("Error in logging a decision:", err)
+		return
+	}
+	log.Println("Decision:", string(line))
+}
+
+// Recent returns up to n of the most recent decisions logged for a user, oldest first
+func (me *DecisionLog) Recent(username string, n int) []Decision {
+	me.Lock()
+	defer me.Unlock()
+
+	// until the ring is full next is its length, so the oldest decision is always the one at next
+	decisions := []Decision{}
+	start := me.next
+	if start >= len(me.recent) {
+		start = 0
+	}
+	for i := range me.recent {
+		if v := me.recent[(start+i)%len(me.recent)]; v.UserName == username {
+			decisions = append(decisions, v)
+		}
+	}
+	if len(decisions) > n {
+		decisions = decisions[len(decisions)-n:]
+	}
+	return decisions
+}
+
+// Decisions returns the most recent decisions logged for a user, oldest first, n of them (50 by default)
+func (me *StoreHandler) Decisions(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	username := mux.Vars(r)["userID"]
+	n := decisionTail
+	if value := utils.GetSentValFromRequest(r, "n"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil || parsed < 1 {
+			utils.ReturnWithError(http.StatusBadRequest, "n must be a number from 1", w)
+			return
+		}
+		n = parsed
+	}
+	type userDecisions struct {
+		UserName  string     `json:"username"`
+		Debug     bool       `json:"debug"`
+		Decisions []Decision `json:"decisions"`
+	}
+	utils.ReturnOKWithData("ok", userDecisions{UserName: username, Debug: me.decisionLog.Debugging(username),
+		Decisions: me.decisionLog.Recent(username, n)}, user.Token, w)
+}
+
+// DebugDecisions turns the debugging of a user's decisions on or off with enable=true or enable=false,
+// without a user it lists the users being debugged
+func (me *StoreHandler) DebugDecisions(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	username := mux.Vars(r)["userID"]
+	if username == "" {
+		utils.ReturnOKWithData("ok", me.decisionLog.Debugged(), user.Token, w)
+		return
+	}
+	enable, parseError := strconv.ParseBool(utils.GetSentValFromRequest(r, "enable"))
+	if parseError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, "enable must be true or false", w)
+		return
+	}
+	me.decisionLog.SetDebug(username, enable)
+	log.Println("Decision debugging of", username, "set to", enable, "by", user.UserName)
+	me.audit(r, user.UserName, "debugdecisions", username, nil, store.AuditSnapshot(map[string]bool{"debug": enable}))
+	utils.ReturnOK("Decision debugging set", user.Token, w)
+}
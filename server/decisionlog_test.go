@@ -0,0 +1,65 @@
+package server
+
+import (
+	"authserver/config"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDecisionLog(t *testing.T) {
+
+	config.Config.DecisionLogSize = 3
+	defer func() {
+		config.Config.DecisionLog = false
+		config.Config.DecisionSample = 0
+		config.Config.DecisionLogSize = 0
+	}()
+
+	decisions := NewDecisionLog()
+	start := time.Now()
+	decisions.Record(Decision{Kind: "acl", UserName: "Gaz", Status: http.StatusOK}, start)
+	if recent := decisions.Recent("Gaz", 10); len(recent) != 0 {
+		t.Errorf("decision logged with the log off: %+v", recent)
+	}
+
+	// a debugged user is logged with the log off
+	decisions.SetDebug("Gaz", true)
+	decisions.Record(Decision{Kind: "acl", UserName: "Gaz", Topic: "a/b", Status: http.StatusOK, Rule: "a/#:pub+sub"}, start)
+	recent := decisions.Recent("Gaz", 10)
+	if len(recent) != 1 || recent[0].Result != "allow" || recent[0].Rule != "a/#:pub+sub" || recent[0].Time.Equal(start) == false {
+		t.Errorf("decision of a debugged user not logged: %+v", recent)
+	}
+	if debugged := decisions.Debugged(); len(debugged) != 1 || debugged[0] != "Gaz" {
+		t.Errorf("unexpected debugged users %v", debugged)
+	}
+	decisions.SetDebug("Gaz", false)
+
+	// only the sampled decisions are logged
+	config.Config.DecisionLog = true
+	config.Config.DecisionSample = 0.5
+	for _, v := range []float64{0.7, 0.2} {
+		random := v
+		decisions.random = func() float64 { return random }
+		decisions.Record(Decision{Kind: "auth", UserName: "Chloe", ClientID: "c1", Status: http.StatusUnauthorized}, start)
+	}
+	if recent := decisions.Recent("Chloe", 10); len(recent) != 1 || recent[0].Result != "deny" {
+		t.Errorf("expected 1 sampled decision, got %+v", recent)
+	}
+
+	// the oldest decisions are dropped once the log is full, and are returned oldest first
+	config.Config.DecisionSample = 0
+	for _, topic := range []string{"c", "d"} {
+		decisions.Record(Decision{Kind: "acl", UserName: "Gaz", Topic: topic, Status: http.StatusNoContent}, start)
+	}
+	recent = decisions.Recent("Gaz", 10)
+	if len(recent) != 2 || recent[0].Topic != "c" || recent[1].Topic != "d" {
+		t.Errorf("unexpected recent decisions %+v", recent)
+	}
+	if recent = decisions.Recent("Gaz", 1); len(recent) != 1 || recent[0].Topic != "d" {
+		t.Errorf("unexpected last decision %+v", recent)
+	}
+	if recent = decisions.Recent("Chloe", 10); len(recent) != 1 {
+		t.Errorf("decision of another user dropped too soon: %+v", recent)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"authserver/config"
+	"authserver/store"
+	"authserver/utils"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedDecision is an auth or acl decision held in the decision cache
+type cachedDecision struct {
+	key      string
+	username string
+	status   int
+	expires  time.Time
+}
+
+// DecisionStats are the counters of the decision cache as shown on the cache stats endpoint
+type DecisionStats struct {
+	Size       int    `json:"size"`
+	Capacity   int    `json:"capacity"`
+	AuthHits   uint64 `json:"authhits"`
+	AuthMisses uint64 `json:"authmisses"`
+	ACLHits    uint64 `json:"aclhits"`
+	ACLMisses  uint64 `json:"aclmisses"`
+}
+
+// DecisionCache is a bounded cache of the answers given to hmq, the least recently used decision is dropped
+// once it is full and every decision expires after the CacheTTL. The decisions of a user are dropped
+// whenever the store reports a change to that user
+type DecisionCache struct {
+	// the counters come first to keep them 64 bit aligned for the atomic operations on 32 bit platforms
+	authHits   uint64
+	authMisses uint64
+	aclHits    uint64
+	aclMisses  uint64
+
+	passwordKey []byte
+	entries     map[string]*list.Element
+	order       *list.List
+	byUser      map[string]map[*list.Element]bool
+	generation  uint64
+	now         func() time.Time
+	sync.Mutex
+}
+
+// NewDecisionCache returns an empty decision cache
+func NewDecisionCache() *DecisionCache {
+	// Passwords are only ever held as an HMAC keyed with a secret that lives as long as the process
+	passwordKey := make([]byte, 32)
+	rand.Read(passwordKey)
+	return &DecisionCache{
+		passwordKey: passwordKey,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		byUser:      make(map[string]map[*list.Element]bool),
+		now:         time.Now,
+	}
+}
+
+// authKey returns the cache key of an mqtt login
+func (me *DecisionCache) authKey(username string, clientID string, password string) string {
+	mac := hmac.New(sha256.New, me.passwordKey)
+	mac.Write([]byte(password))
+	return "auth\x00" + username + "\x00" + clientID + "\x00" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// aclKey returns the cache key of an acl check
+func aclKey(username string, clientID string, topic string, access string) string {
+	return "acl\x00" + username + "\x00" + clientID + "\x00" + topic + "\x00" + access
+}
+
+// Generation returns a counter that moves on with every invalidation. It is taken before a decision is
+// worked out and handed back when caching it, so a decision made from data that changed in the meantime
+// is not cached
+func (me *DecisionCache) Generation() uint64 {
+	me.Lock()
+	defer me.Unlock()
+	return me.generation
+}
+
+// GetAuth checks whether an mqtt login was recently allowed
+func (me *DecisionCache) GetAuth(username string, clientID string, password string) bool {
+	_, found := me.get(me.authKey(username, clientID, password))
+	if found {
+		atomic.AddUint64(&me.authHits, 1)
+	} else {
+		atomic.AddUint64(&me.authMisses, 1)
+	}
+	return found
+}
+
+// SetAuth records that an mqtt login was allowed, failed logins are never cached
+func (me *DecisionCache) SetAuth(username string, clientID string, password string, generation uint64) {
+	me.set(me.authKey(username, clientID, password), username, http.StatusOK, generation)
+}
+
+// GetACL returns the status recently given for an acl check
+func (me *DecisionCache) GetACL(username string, clientID string, topic string, access string) (int, bool) {
+	status, found := me.get(aclKey(username, clientID, topic, access))
+	if found {
+		atomic.AddUint64(&me.aclHits, 1)
+	} else {
+		atomic.AddUint64(&me.aclMisses, 1)
+	}
+	return status, found
+}
+
+// SetACL records the status given for an acl check
+func (me *DecisionCache) SetACL(username string, clientID string, topic string, access string, status int, generation uint64) {
+	me.set(aclKey(username, clientID, topic, access), username, status, generation)
+}
+
+// get returns a cached decision that has not expired, moving it to the front of the queue
+func (me *DecisionCache) get(key string) (int, bool) {
+	me.Lock()
+	defer me.Unlock()
+
+	element, found := me.entries[key]
+	if found == false {
+		return 0, false
+	}
+	decision := element.Value.(*cachedDecision)
+	if me.now().After(decision.expires) {
+		me.remove(element)
+		return 0, false
+	}
+	me.order.MoveToFront(element)
+	return decision.status, true
+}
+
+// set caches a decision, dropping the least recently used one if the cache is full
+func (me *DecisionCache) set(key string, username string, status int, generation uint64) {
+	capacity := config.Config.GetCacheSize()
+	if capacity == 0 {
+		return
+	}
+	expires := me.now().Add(config.Config.GetCacheTTL())
+
+	me.Lock()
+	defer me.Unlock()
+
+	if generation != me.generation {
+		return
+	}
+	if element, found := me.entries[key]; found {
+		decision := element.Value.(*cachedDecision)
+		decision.status = status
+		decision.expires = expires
+		me.order.MoveToFront(element)
+		return
+	}
+	for me.order.Len() >= capacity {
+		me.remove(me.order.Back())
+	}
+	element := me.order.PushFront(&cachedDecision{key: key, username: username, status: status, expires: expires})
+	me.entries[key] = element
+	if me.byUser[username] == nil {
+		me.byUser[username] = make(map[*list.Element]bool)
+	}
+	me.byUser[username][element] = true
+}
+
+// remove drops a decision from the cache, the caller must hold the lock
+func (me *DecisionCache) remove(element *list.Element) {
+	decision := element.Value.(*cachedDecision)
+	me.order.Remove(element)
+	delete(me.entries, decision.key)
+	delete(me.byUser[decision.username], element)
+	if len(me.byUser[decision.username]) == 0 {
+		delete(me.byUser, decision.username)
+	}
+}
+
+// Invalidate drops the cached decisions of a user, or every decision if the username is blank
+func (me *DecisionCache) Invalidate(username string) {
+	me.Lock()
+	defer me.Unlock()
+
+	me.generation++
+	if username == "" {
+		me.entries = make(map[string]*list.Element)
+		me.order.Init()
+		me.byUser = make(map[string]map[*list.Element]bool)
+		return
+	}
+	for element := range me.byUser[username] {
+		me.remove(element)
+	}
+}
+
+// watchStoreChanges drops the cached decisions of a user whenever the store reports a change to them
+func (me *DecisionCache) watchStoreChanges() {
+	store.OnUserChange(me.Invalidate)
+}
+
+// Stats returns the size of the cache along with its hit and miss counters
+func (me *DecisionCache) Stats() DecisionStats {
+	me.Lock()
+	size := me.order.Len()
+	me.Unlock()
+
+	return DecisionStats{
+		Size:       size,
+		Capacity:   config.Config.GetCacheSize(),
+		AuthHits:   atomic.LoadUint64(&me.authHits),
+		AuthMisses: atomic.LoadUint64(&me.authMisses),
+		ACLHits:    atomic.LoadUint64(&me.aclHits),
+		ACLMisses:  atomic.LoadUint64(&me.aclMisses),
+	}
+}
+
+// CacheStats returns the hit and miss counters of the decision cache
+func (me *StoreHandler) CacheStats(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+	utils.ReturnOKWithData("ok", me.decisions.Stats(), user.Token, w)
+}
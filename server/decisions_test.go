@@ -0,0 +1,68 @@
+package server
+
+import (
+	"authserver/config"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDecisionCache(t *testing.T) {
+
+	config.Config.CacheSize = 2
+	config.Config.CacheTTL = 60
+	defer func() {
+		config.Config.CacheSize = 0
+		config.Config.CacheTTL = 0
+	}()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewDecisionCache()
+	cache.now = func() time.Time { return now }
+
+	cache.SetACL("Gaz", "c1", "a/b", "1", http.StatusOK, cache.Generation())
+	cache.SetAuth("Gaz", "c1", "secret", cache.Generation())
+	if status, found := cache.GetACL("Gaz", "c1", "a/b", "1"); found == false || status != http.StatusOK {
+		t.Errorf("acl decision not cached")
+	}
+	if cache.GetAuth("Gaz", "c1", "secret") == false || cache.GetAuth("Gaz", "c1", "wrong") {
+		t.Errorf("auth decision not cached by password")
+	}
+
+	// the acl decision was used last so the auth decision is the one dropped when the cache is full
+	cache.GetACL("Gaz", "c1", "a/b", "1")
+	cache.SetACL("Chloe", "c2", "a/b", "2", http.StatusNoContent, cache.Generation())
+	if cache.GetAuth("Gaz", "c1", "secret") {
+		t.Errorf("least recently used decision not dropped")
+	}
+	if _, found := cache.GetACL("Gaz", "c1", "a/b", "1"); found == false {
+		t.Errorf("recently used decision dropped")
+	}
+
+	cache.Invalidate("Gaz")
+	if _, found := cache.GetACL("Gaz", "c1", "a/b", "1"); found {
+		t.Errorf("decision of a changed user still cached")
+	}
+	if _, found := cache.GetACL("Chloe", "c2", "a/b", "2"); found == false {
+		t.Errorf("decision of another user dropped")
+	}
+
+	// a decision worked out before an invalidation is not cached
+	generation := cache.Generation()
+	cache.Invalidate("")
+	cache.SetACL("Gaz", "c1", "a/b", "1", http.StatusOK, generation)
+	if _, found := cache.GetACL("Gaz", "c1", "a/b", "1"); found {
+		t.Errorf("stale decision cached")
+	}
+
+	cache.SetACL("Gaz", "c1", "a/b", "1", http.StatusOK, cache.Generation())
+	now = now.Add(61 * time.Second)
+	if _, found := cache.GetACL("Gaz", "c1", "a/b", "1"); found {
+		t.Errorf("expired decision returned")
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 0 || stats.Capacity != 2 || stats.ACLHits != 4 || stats.ACLMisses != 3 || stats.AuthHits != 1 || stats.AuthMisses != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
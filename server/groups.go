@@ -0,0 +1,249 @@
+package server
+
+import (
+	"authserver/store"
+	"authserver/utils"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ListGroups returns a JSON object containing the list of groups along with their topics
+func (me *StoreHandler) ListGroups(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+	utils.ReturnOKWithData("", me.store.GetGroups(), user.Token, w)
+}
+
+// GetGroup returns a JSON object containing a group along with its topics and members
+func (me *StoreHandler) GetGroup(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	groupID := mux.Vars(r)["groupID"]
+	group, getGroupError := me.store.GetGroup(groupID)
+	if getGroupError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "Group not found", w)
+		return
+	}
+
+	type groupReturn struct {
+		Name    string           `json:"name"`
+		Topics  store.TopicArray `json:"topics"`
+		Members []string         `json:"members"`
+	}
+	var gr groupReturn
+	gr.Name = group.Name
+	gr.Topics = group.Topics
+	for _, v := range me.store.GetUsers() {
+		if v.InGroup(group.Name) {
+			gr.Members = append(gr.Members, v.UserName)
+		}
+	}
+	utils.ReturnOKWithData("ok", gr, user.Token, w)
+}
+
+// AddGroup handles a request to add a new group
+func (me *StoreHandler) AddGroup(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	var tempGroup store.Group
+
+	if r.Method == "POST" {
+		gp, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(err)
+		}
+		newerr := json.Unmarshal(gp, &tempGroup)
+		if newerr != nil {
+			log.Println(newerr)
+		}
+	}
+	if r.Method == "GET" {
+		tempGroup.Name = utils.GetSentValFromRequest(r, "name")
+	}
+
+	addGroupError := me.store.AddGroup(tempGroup)
+	if addGroupError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, "Error in adding group:"+addGroupError.Error(), w)
+		return
+	}
+	me.auditGroup(r, user.UserName, "addgroup", tempGroup.Name, store.Group{})
+	utils.ReturnOK("Group Added", user.Token, w)
+}
+
+// DeleteGroup deletes a group, its members lose the topics it granted
+func (me *StoreHandler) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	groupToDelete := mux.Vars(r)["groupID"]
+	before, _ := me.store.GetGroup(groupToDelete)
+	deleteGroupError := me.store.DeleteGroup(groupToDelete)
+	if deleteGroupError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, deleteGroupError.Error(), w)
+		return
+	}
+	me.auditGroup(r, user.UserName, "deletegroup", groupToDelete, before)
+	utils.ReturnOK("Group deleted", user.Token, w)
+}
+
+// AddGroupTopic adds an authorisation for a group to a given topic
+func (me *StoreHandler) AddGroupTopic(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	groupToAddTopicTo := mux.Vars(r)["groupID"]
+	before, targetGroupError := me.store.GetGroup(groupToAddTopicTo)
+	if targetGroupError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "Group not found", w)
+		return
+	}
+
+	newTopic, topicStatus, topicError := getTopicFromRequest(r)
+	if topicError != nil {
+		utils.ReturnWithError(topicStatus, topicError.Error(), w)
+		return
+	}
+
+	addTopicError := me.store.AddTopicToGroup(groupToAddTopicTo, newTopic)
+	if addTopicError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, addTopicError.Error(), w)
+		return
+	}
+	me.auditGroup(r, user.UserName, "addgrouptopic", groupToAddTopicTo, before)
+	utils.ReturnOK("Topic added", user.Token, w)
+}
+
+// EditGroupTopic edits an authorisation for a group to a given topic
+func (me *StoreHandler) EditGroupTopic(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	groupToEditTopicFor := mux.Vars(r)["groupID"]
+	before, targetGroupError := me.store.GetGroup(groupToEditTopicFor)
+	if targetGroupError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "Group not found", w)
+		return
+	}
+
+	newTopic, topicStatus, topicError := getTopicFromRequest(r)
+	if topicError != nil {
+		utils.ReturnWithError(topicStatus, topicError.Error(), w)
+		return
+	}
+
+	editTopicError := me.store.EditTopicForGroup(groupToEditTopicFor, newTopic)
+	if editTopicError != nil {
+		utils.ReturnWithError(http.StatusNotFound, editTopicError.Error(), w)
+		return
+	}
+	me.auditGroup(r, user.UserName, "editgrouptopic", groupToEditTopicFor, before)
+	utils.ReturnOK("Topic modified", user.Token, w)
+}
+
+// DeleteGroupTopic removes a group authorisation to a topic / topic pattern
+func (me *StoreHandler) DeleteGroupTopic(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	topicToDelete := utils.GetSentValFromRequest(r, "topic")
+	groupToDeleteTopicFrom := utils.GetSentValFromRequest(r, "group")
+	if topicToDelete == "" || groupToDeleteTopicFrom == "" {
+		utils.ReturnWithError(http.StatusBadRequest, "Must provide a group and a topic", w)
+		return
+	}
+
+	before, _ := me.store.GetGroup(groupToDeleteTopicFrom)
+	deleteTopicError := me.store.DeleteTopicFromGroup(groupToDeleteTopicFrom, topicToDelete)
+	if deleteTopicError != nil {
+		utils.ReturnWithError(http.StatusNotFound, deleteTopicError.Error(), w)
+		return
+	}
+	me.auditGroup(r, user.UserName, "deletegrouptopic", groupToDeleteTopicFrom, before)
+	utils.ReturnOK("Topics deleted", user.Token, w)
+}
+
+// AddUserToGroup makes a user a member of a group
+func (me *StoreHandler) AddUserToGroup(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	userToAdd := mux.Vars(r)["userID"]
+	groupName := utils.GetSentValFromRequest(r, "group")
+	if groupName == "" {
+		utils.ReturnWithError(http.StatusBadRequest, "Must provide a group", w)
+		return
+	}
+
+	before, _ := me.store.GetUserByUsername(userToAdd)
+	addError := me.store.AddUserToGroup(userToAdd, groupName)
+	if addError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, addError.Error(), w)
+		return
+	}
+	me.auditUser(r, user.UserName, "addusertogroup", userToAdd, before)
+	utils.ReturnOK("User added to group", user.Token, w)
+}
+
+// RemoveUserFromGroup takes a user out of a group
+func (me *StoreHandler) RemoveUserFromGroup(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	userToRemove := mux.Vars(r)["userID"]
+	groupName := utils.GetSentValFromRequest(r, "group")
+	if groupName == "" {
+		utils.ReturnWithError(http.StatusBadRequest, "Must provide a group", w)
+		return
+	}
+
+	before, _ := me.store.GetUserByUsername(userToRemove)
+	removeError := me.store.RemoveUserFromGroup(userToRemove, groupName)
+	if removeError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, removeError.Error(), w)
+		return
+	}
+	me.auditUser(r, user.UserName, "removeuserfromgroup", userToRemove, before)
+	utils.ReturnOK("User removed from group", user.Token, w)
+}
@@ -1,15 +1,20 @@
 package server
 
 import (
+	"authserver/config"
+	"authserver/jwtauth"
+	"authserver/store"
 	"authserver/utils"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // AuthHandler authenticates the mqtt client trying to connect to hmq broker
 func (me *StoreHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
+	start := time.Now()
 	error := r.ParseForm()
 	if error != nil {
 		log.Fatalln(error)
@@ -17,32 +22,129 @@ func (me *StoreHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	password := r.Form["password"][0]
 	username := r.Form["username"][0]
+	clientID := r.Form.Get("clientid")
+	// hmq makes the request itself and does not send the address of the device, so failures are only
+	// counted by address if a proxy adds it in the configured field
+	ip := ""
+	if field := config.Config.GetAuthAddressField(); field != "" {
+		ip = r.Form.Get(field)
+	}
+
+	decision := Decision{Kind: "auth", UserName: username, ClientID: clientID, Status: http.StatusUnauthorized}
+	defer func() { me.decisionLog.Record(decision, start) }()
+
+	if wait, locked := me.limiter.Locked(username, ip); locked {
+		decision.Rule = "Locked out"
+		refuseLockedLogin(wait, http.StatusUnauthorized, w)
+		return
+	}
+
+	// A JWT from a trusted issuer is accepted as the password, if it does not check out the password is
+	// tried against the store as usual
+	if me.deviceJWT != nil && jwtauth.IsJWT(password) {
+		claims, verifyError := me.deviceJWT.Verify(password, username)
+		if verifyError == nil {
+			if claims.User().CheckClientID(clientID) == false {
+				log.Println("Client id not allowed for JWT user:", username, clientID)
+				decision.Rule = "Client id not allowed by JWT"
+				utils.ReturnWithError(http.StatusUnauthorized, "Invalid client id", w)
+				return
+			}
+			me.limiter.Succeeded(username)
+			me.devices.Add(clientID, claims)
+			// the claims may differ from those of the device's last token
+			me.decisions.Invalidate(username)
+			decision.Status, decision.Rule = http.StatusOK, "JWT"
+			return
+		}
+		log.Println("JWT login failed for user:", username, verifyError.Error())
+	}
+
+	// A device that just logged in with the same password is let straight back in without bcrypt
+	if me.decisionLog.Debugging(username) == false && me.decisions.GetAuth(username, clientID, password) {
+		decision.Status, decision.Cached = http.StatusOK, true
+		return
+	}
 
-	_, loginErr := me.store.Login(username, password, false)
+	generation := me.decisions.Generation()
+	thisUser, loginErr := me.store.Login(username, password, false)
 	if loginErr != nil {
+		me.limiter.Failed(username, ip)
+		decision.Rule = loginErr.Error()
 		utils.ReturnWithError(http.StatusUnauthorized, "Invalid login", w)
 		return
 	}
+
+	if thisUser.CheckClientID(clientID) == false {
+		log.Println("Client id not allowed for user:", username, clientID)
+		decision.Rule = "Client id not allowed"
+		utils.ReturnWithError(http.StatusUnauthorized, "Invalid client id", w)
+		return
+	}
+	me.limiter.Succeeded(username)
+	if me.devices.Remove(username, clientID) {
+		// the acl decisions cached for the device came from its JWT
+		me.decisions.Invalidate(username)
+	}
+	me.decisions.SetAuth(username, clientID, password, generation)
+	decision.Status, decision.Rule = http.StatusOK, "Password"
 	return
 }
 
 // ACLHandler verifies the client has the write to pub/sub to the topic
 func (me *StoreHandler) ACLHandler(w http.ResponseWriter, r *http.Request) {
 
+	start := time.Now()
 	access := utils.GetSentValFromRequest(r, "access")
 	topic := utils.GetSentValFromRequest(r, "topic")
 	username := utils.GetSentValFromRequest(r, "username")
+	clientID := utils.GetSentValFromRequest(r, "clientid")
 
-	thisUser, getUserError := me.store.GetUserByUsername(username)
-	if getUserError != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	var status int
+	var rule string
+	cached := false
+	if me.decisionLog.Debugging(username) == false {
+		status, cached = me.decisions.GetACL(username, clientID, topic, access)
+	}
+	if cached == false {
+		generation := me.decisions.Generation()
+		status, rule = me.aclDecision(username, clientID, topic, access)
+		me.decisions.SetACL(username, clientID, topic, access, status, generation)
 	}
+	w.WriteHeader(status)
+	me.decisionLog.Record(Decision{Kind: "acl", UserName: username, ClientID: clientID, Topic: topic, Access: access,
+		Status: status, Rule: rule, Cached: cached}, start)
+}
 
-	userPub, userSub, CheckErr := thisUser.CheckTopicAuth(topic)
+// aclDecision works out the status to answer an acl check with, along with the rule that decided it
+func (me *StoreHandler) aclDecision(username string, clientID string, topic string, access string) (int, string) {
+
+	// Devices that connected with a JWT are checked against the claims of their token
+	thisUser, isDevice := me.devices.Get(username, clientID)
+	if isDevice == false {
+		var getUserError error
+		thisUser, getUserError = me.store.GetUserByUsername(username)
+		if getUserError != nil {
+			return http.StatusNotFound, "User not found"
+		}
+	}
+
+	if thisUser.CheckClientID(clientID) == false {
+		return http.StatusNoContent, "Client id not allowed"
+	}
+
+	// Superusers are not subject to topic permissions
+	if thisUser.SuperUser == true {
+		return http.StatusOK, "Superuser"
+	}
+
+	var groups []store.Group
+	if isDevice == false {
+		groups = store.GetGroupsForUser(me.store, thisUser)
+	}
+	pubRule, subRule, CheckErr := thisUser.TopicAuthRules(topic, clientID, groups)
 	if CheckErr != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return http.StatusNotFound, "No topic matches"
 	}
 
 	hasHash := strings.Index(topic, "#")
@@ -50,34 +152,48 @@ func (me *StoreHandler) ACLHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch access {
 	case "1":
-		if userSub == true {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusNoContent)
+		if subRule == nil {
+			return http.StatusNoContent, "No matching topic has sub"
 		}
+		if subRule.Deny == false {
+			return http.StatusOK, subRule.String()
+		}
+		return http.StatusNoContent, subRule.String()
 	case "2":
-		if userPub == true && hasHash < 0 && hasPlus < 0 {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusNoContent)
+		if pubRule == nil {
+			return http.StatusNoContent, "No matching topic has pub"
+		}
+		if hasHash >= 0 || hasPlus >= 0 {
+			return http.StatusNoContent, "Wildcards cannot be published to"
 		}
+		if pubRule.Deny == false {
+			return http.StatusOK, pubRule.String()
+		}
+		return http.StatusNoContent, pubRule.String()
 	}
+	return http.StatusOK, "Access not checked"
 }
 
-// SuperUserHandler is unfinished - we really need to address this one
+// SuperUserHandler tells hmq whether the connecting client is a superuser
+// hmq treats a 200 as a superuser, anything else means the normal ACL checks apply
 func (me *StoreHandler) SuperUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	utils.ReturnWithError(http.StatusInternalServerError, "Not implemented", w)
-	return
-	/*
-		fmt.Println("Superuser Request")
-		//fmt.Println(r.Method)
-		//fmt.Println(r)
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println(string(body))
-
-		}*/
+	username := utils.GetSentValFromRequest(r, "username")
+	clientID := utils.GetSentValFromRequest(r, "clientid")
+
+	thisUser, isDevice := me.devices.Get(username, clientID)
+	if isDevice == false {
+		var getUserError error
+		thisUser, getUserError = me.store.GetUserByUsername(username)
+		if getUserError != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	if thisUser.SuperUser == true {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
 }
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"authserver/config"
+	"authserver/jwtauth"
+	"authserver/store"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// postAuth sends a login to the AuthHandler as hmq does
+func postAuth(handler *StoreHandler, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/mqtt/auth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.AuthHandler(rr, req)
+	return rr
+}
+
+func TestAuthHandlerLockout(t *testing.T) {
+
+	config.Config.LockoutThreshold = 3
+	defer func() {
+		config.Config.LockoutThreshold = 0
+		config.Config.AuthAddressField = ""
+	}()
+
+	dir := t.TempDir()
+	sqlite := store.InitSQLite(filepath.Join(dir, "users.db"))
+	t.Cleanup(func() { sqlite.DB.Close() })
+	var users store.UserPersistence = sqlite
+	if err := users.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddUser(store.User{UserName: "Gaz", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// devices of the Gaz user can also log in with a JWT from a trusted issuer
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "issuer.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := jwtauth.LoadDeviceVerifier([]config.JWTIssuer{{Issuer: "provisioning", Keys: []config.JWTPublicKey{{KeyFile: keyFile}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwtauth.DeviceClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer: "provisioning", Subject: "Gaz", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := SetStoreHandler(&users)
+	handler.deviceJWT = verifier
+	login := func(username string, password string, ip string) *httptest.ResponseRecorder {
+		return postAuth(handler, url.Values{"username": {username}, "password": {password}, "clientid": {"c1"}, "ip": {ip}})
+	}
+
+	// a JWT login clears the failures of the username as a password login does
+	login("Gaz", "wrong", "")
+	login("Gaz", "wrong", "")
+	if rr := login("Gaz", token, ""); rr.Code != http.StatusOK {
+		t.Fatalf("JWT login refused: %d", rr.Code)
+	}
+	login("Gaz", "wrong", "")
+	login("Gaz", "wrong", "")
+	if rr := login("Gaz", "secret", ""); rr.Code != http.StatusOK {
+		t.Errorf("failures before a JWT login still counted: %d", rr.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		login("Gaz", "wrong", "")
+	}
+	for _, password := range []string{"secret", token} {
+		if rr := login("Gaz", password, ""); rr.Code != http.StatusUnauthorized || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("locked out username let in: %d", rr.Code)
+		}
+	}
+
+	// the address sent by hmq is only counted when it is in the configured field
+	handler = SetStoreHandler(&users)
+	for _, v := range []string{"Chloe", "Lights", "Heating"} {
+		login(v, "wrong", "10.0.0.9")
+	}
+	if rr := login("Gaz", "secret", "10.0.0.9"); rr.Code != http.StatusOK {
+		t.Errorf("address counted without a field configured: %d", rr.Code)
+	}
+
+	config.Config.AuthAddressField = "ip"
+	handler = SetStoreHandler(&users)
+	for _, v := range []string{"Chloe", "Lights", "Heating"} {
+		login(v, "wrong", "10.0.0.9")
+	}
+	if rr := login("Gaz", "secret", "10.0.0.9"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("locked out address let in: %d", rr.Code)
+	}
+	if rr := login("Gaz", "secret", "10.0.0.8"); rr.Code != http.StatusOK {
+		t.Errorf("login from another address refused: %d", rr.Code)
+	}
+}
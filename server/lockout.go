@@ -0,0 +1,211 @@
+package server
+
+import (
+	"authserver/config"
+	"authserver/utils"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// loginFailures is the record of failed logins for one username or address
+type loginFailures struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Lockout is a username or address that has failed to log in, as listed on the lockouts endpoint
+type Lockout struct {
+	Kind        string    `json:"kind"` // username or ip
+	Name        string    `json:"name"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockeduntil"`
+}
+
+// loginKey identifies a username or an address in the login limiter
+type loginKey struct {
+	kind string
+	name string
+}
+
+// LoginLimiter counts failed logins by username and by source address. Once a username or address has
+// failed LockoutThreshold times it is locked out, and every further failure doubles the lockout
+type LoginLimiter struct {
+	entries map[loginKey]*loginFailures
+	now     func() time.Time
+	sync.Mutex
+}
+
+// NewLoginLimiter returns a login limiter with no failures recorded
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		entries: make(map[loginKey]*loginFailures),
+		now:     time.Now,
+	}
+}
+
+// loginKeys returns the keys a login attempt is counted against, the address is left out if unknown
+func loginKeys(username string, ip string) []loginKey {
+	keys := []loginKey{{kind: "username", name: username}}
+	if ip != "" {
+		keys = append(keys, loginKey{kind: "ip", name: ip})
+	}
+	return keys
+}
+
+// Locked checks whether a login attempt must be refused, returning how long until it may be tried again
+func (me *LoginLimiter) Locked(username string, ip string) (time.Duration, bool) {
+	me.Lock()
+	defer me.Unlock()
+
+	now := me.now()
+	var wait time.Duration
+	for _, k := range loginKeys(username, ip) {
+		entry, found := me.entries[k]
+		if found && now.Before(entry.lockedUntil) && entry.lockedUntil.Sub(now) > wait {
+			wait = entry.lockedUntil.Sub(now)
+		}
+	}
+	return wait, wait > 0
+}
+
+// Failed records a failed login, locking out the username or address once it reaches the threshold
+func (me *LoginLimiter) Failed(username string, ip string) {
+	me.Lock()
+	defer me.Unlock()
+
+	now := me.now()
+	window := config.Config.GetLockoutWindow()
+	threshold := config.Config.GetLockoutThreshold()
+	me.prune(now, window)
+
+	for _, k := range loginKeys(username, ip) {
+		entry, found := me.entries[k]
+		if found == false {
+			entry = &loginFailures{}
+			me.entries[k] = entry
+		}
+		entry.failures++
+		entry.lastFailure = now
+		if entry.failures < threshold {
+			continue
+		}
+
+		lockout := config.Config.GetLockoutDuration()
+		max := config.Config.GetLockoutMax()
+		for i := threshold; i < entry.failures && lockout < max; i++ {
+			lockout *= 2
+		}
+		if lockout > max {
+			lockout = max
+		}
+		entry.lockedUntil = now.Add(lockout)
+		log.Println("Login locked out:", k.kind, k.name, "after", entry.failures, "failures for", lockout)
+	}
+}
+
+// Succeeded forgets the failed logins of a username once it has logged in
+func (me *LoginLimiter) Succeeded(username string) {
+	me.Lock()
+	defer me.Unlock()
+
+	delete(me.entries, loginKey{kind: "username", name: username})
+}
+
+// prune forgets usernames and addresses that are not locked out and have not failed within the window
+func (me *LoginLimiter) prune(now time.Time, window time.Duration) {
+	for k, v := range me.entries {
+		if now.After(v.lockedUntil) && now.Sub(v.lastFailure) > window {
+			delete(me.entries, k)
+		}
+	}
+}
+
+// Lockouts returns the usernames and addresses that are currently locked out
+func (me *LoginLimiter) Lockouts() []Lockout {
+	me.Lock()
+	defer me.Unlock()
+
+	now := me.now()
+	lockouts := []Lockout{}
+	for k, v := range me.entries {
+		if now.Before(v.lockedUntil) {
+			lockouts = append(lockouts, Lockout{Kind: k.kind, Name: k.name, Failures: v.failures, LockedUntil: v.lockedUntil})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].LockedUntil.Before(lockouts[j].LockedUntil) })
+	return lockouts
+}
+
+// Clear forgets the failed logins of a username or address, returning false if there were none
+func (me *LoginLimiter) Clear(kind string, name string) bool {
+	me.Lock()
+	defer me.Unlock()
+
+	key := loginKey{kind: kind, name: name}
+	if _, found := me.entries[key]; found == false {
+		return false
+	}
+	delete(me.entries, key)
+	return true
+}
+
+// remoteIP returns the address a request came from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// refuseLockedLogin replies to a login attempt from a locked out username or address
+func refuseLockedLogin(wait time.Duration, status int, w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	utils.ReturnWithError(status, "Too many failed logins, try again later", w)
+}
+
+// ListLockouts returns the usernames and addresses that are locked out after failed logins
+func (me *StoreHandler) ListLockouts(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+	utils.ReturnOKWithData("ok", me.limiter.Lockouts(), user.Token, w)
+}
+
+// ClearLockout lifts the lockout of a username or an address
+func (me *StoreHandler) ClearLockout(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	username := utils.GetSentValFromRequest(r, "username")
+	ip := utils.GetSentValFromRequest(r, "ip")
+	if (username == "") == (ip == "") {
+		utils.ReturnWithError(http.StatusBadRequest, "Must provide either a username or an ip", w)
+		return
+	}
+
+	kind, name := "username", username
+	if ip != "" {
+		kind, name = "ip", ip
+	}
+	if me.limiter.Clear(kind, name) == false {
+		utils.ReturnWithError(http.StatusNotFound, "No failed logins recorded", w)
+		return
+	}
+	log.Println("Lockout cleared by", user.UserName+":", kind, name)
+	me.audit(r, user.UserName, "clearlockout", kind+" "+name, nil, nil)
+	utils.ReturnOK("Lockout cleared", user.Token, w)
+}
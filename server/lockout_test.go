@@ -0,0 +1,72 @@
+package server
+
+import (
+	"authserver/config"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+
+	config.Config.LockoutThreshold = 3
+	config.Config.LockoutDuration = 10
+	config.Config.LockoutMax = 30
+	defer func() {
+		config.Config.LockoutThreshold = 0
+		config.Config.LockoutDuration = 0
+		config.Config.LockoutMax = 0
+	}()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewLoginLimiter()
+	limiter.now = func() time.Time { return now }
+
+	limiter.Failed("Gaz", "10.0.0.1")
+	limiter.Failed("Gaz", "10.0.0.1")
+	if _, locked := limiter.Locked("Gaz", "10.0.0.1"); locked {
+		t.Fatalf("locked out before reaching the threshold")
+	}
+
+	// the lockout starts at the threshold and doubles with every further failure up to the maximum
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		limiter.Failed("Gaz", "10.0.0.1")
+		wait, locked := limiter.Locked("Gaz", "")
+		if locked == false || wait != want {
+			t.Errorf("got lockout %v %v, want %v", wait, locked, want)
+		}
+		now = now.Add(wait)
+	}
+
+	// the address is locked out for other usernames too
+	limiter.Failed("Chloe", "10.0.0.1")
+	if _, locked := limiter.Locked("Lights", "10.0.0.1"); locked == false {
+		t.Errorf("address not locked out")
+	}
+	if _, locked := limiter.Locked("Lights", "10.0.0.2"); locked {
+		t.Errorf("unrelated username and address locked out")
+	}
+
+	// the username's last lockout has run out by now, only the address is still locked out
+	if lockouts := limiter.Lockouts(); len(lockouts) != 1 || lockouts[0].Kind != "ip" || lockouts[0].Failures != 7 {
+		t.Errorf("unexpected lockouts %+v", limiter.Lockouts())
+	}
+	if limiter.Clear("ip", "10.0.0.1") == false || limiter.Clear("ip", "10.0.0.1") == true {
+		t.Errorf("clearing the address lockout did not work once")
+	}
+
+	limiter.Succeeded("Gaz")
+	if _, locked := limiter.Locked("Gaz", ""); locked {
+		t.Errorf("still locked out after a successful login")
+	}
+
+	// failures are forgotten once the window has passed without another
+	limiter.Failed("Lights", "")
+	now = now.Add(config.Config.GetLockoutWindow() + time.Second)
+	limiter.Failed("Chloe", "")
+	limiter.Lock()
+	_, found := limiter.entries[loginKey{kind: "username", name: "Lights"}]
+	limiter.Unlock()
+	if found {
+		t.Errorf("old failures not pruned")
+	}
+}
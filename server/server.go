@@ -2,6 +2,7 @@ package server
 
 import (
 	"authserver/config"
+	"authserver/jwtauth"
 	"authserver/store"
 	"context"
 	"log"
@@ -31,6 +32,21 @@ func NewServer(port string, store *store.UserPersistence) *MyServer {
 
 	// prepare handler to use store
 	storeHandler := SetStoreHandler(store)
+	storeHandler.decisions.watchStoreChanges()
+	if config.Config.GetTokenMode() == "jwt" {
+		keySet, keyError := jwtauth.LoadKeySet(config.Config.GetJWTIssuer(), config.Config.GetJWTKeys())
+		if keyError != nil {
+			log.Fatalln("Could not load JWT keys:", keyError)
+		}
+		storeHandler.jwtKeys = keySet
+	}
+	if issuers := config.Config.GetMQTTJWTIssuers(); len(issuers) > 0 {
+		verifier, verifierError := jwtauth.LoadDeviceVerifier(issuers)
+		if verifierError != nil {
+			log.Fatalln("Could not load mqtt JWT issuers:", verifierError)
+		}
+		storeHandler.deviceJWT = verifier
+	}
 	// create server - this version creates a server that listens on any address
 	s := &MyServer{
 		Server: http.Server{
@@ -60,11 +76,28 @@ func NewServer(port string, store *store.UserPersistence) *MyServer {
 
 	// http users handlers
 	router.HandleFunc("/mqtt/login", storeHandler.Login)
+	router.HandleFunc("/mqtt/logout", storeHandler.Logout)
+	router.HandleFunc("/mqtt/jwks", storeHandler.JWKS)
+	router.HandleFunc("/mqtt/revokesessions/{userID}", storeHandler.RevokeSessions)
+	router.HandleFunc("/mqtt/lockouts", storeHandler.ListLockouts)
+	router.HandleFunc("/mqtt/clearlockout", storeHandler.ClearLockout)
+	router.HandleFunc("/mqtt/cachestats", storeHandler.CacheStats)
+	router.HandleFunc("/mqtt/decisions/{userID}", storeHandler.Decisions)
+	router.HandleFunc("/mqtt/decisiondebug", storeHandler.DebugDecisions)
+	router.HandleFunc("/mqtt/decisiondebug/{userID}", storeHandler.DebugDecisions)
 	router.HandleFunc("/mqtt/listusers", storeHandler.ListUsers)
 	router.HandleFunc("/mqtt/getuser/{userID}", storeHandler.GetUser)
 	router.HandleFunc("/mqtt/adduser", storeHandler.AddUser)
 	router.HandleFunc("/mqtt/edituser", storeHandler.EditUser)
 	router.HandleFunc("/mqtt/deleteuser/{userID}", storeHandler.DeleteUser)
+	router.HandleFunc("/mqtt/importusers", storeHandler.ImportUsers)
+	router.HandleFunc("/mqtt/exportusers", storeHandler.ExportUsers)
+	router.HandleFunc("/mqtt/audit", storeHandler.AuditLog)
+
+	// http client ids handlers
+	router.HandleFunc("/mqtt/adduserclientid/{userID}", storeHandler.AddUserClientID)
+	router.HandleFunc("/mqtt/deleteuserclientid/{userID}", storeHandler.DeleteUserClientID)
+	router.HandleFunc("/mqtt/clientids/{userID}", storeHandler.ListUserClientIDs)
 
 	// http topics handlers
 	router.HandleFunc("/mqtt/addusertopic/{userID}", storeHandler.AddUserTopic)
@@ -73,6 +106,17 @@ func NewServer(port string, store *store.UserPersistence) *MyServer {
 	router.HandleFunc("/mqtt/topics/{userID}", storeHandler.CheckUserTopics)
 	router.HandleFunc("/mqtt/checkTopicAuth", storeHandler.CheckTopicAuth)
 
+	// http groups handlers
+	router.HandleFunc("/mqtt/listgroups", storeHandler.ListGroups)
+	router.HandleFunc("/mqtt/getgroup/{groupID}", storeHandler.GetGroup)
+	router.HandleFunc("/mqtt/addgroup", storeHandler.AddGroup)
+	router.HandleFunc("/mqtt/deletegroup/{groupID}", storeHandler.DeleteGroup)
+	router.HandleFunc("/mqtt/addgrouptopic/{groupID}", storeHandler.AddGroupTopic)
+	router.HandleFunc("/mqtt/editgrouptopic/{groupID}", storeHandler.EditGroupTopic)
+	router.HandleFunc("/mqtt/deletegrouptopic", storeHandler.DeleteGroupTopic)
+	router.HandleFunc("/mqtt/addusertogroup/{userID}", storeHandler.AddUserToGroup)
+	router.HandleFunc("/mqtt/removeuserfromgroup/{userID}", storeHandler.RemoveUserFromGroup)
+
 	return s
 }
 
@@ -4,28 +4,18 @@ import (
 	"authserver/store"
 	"authserver/utils"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
-// AddUserTopic adds an authorisation for a user to a given topic
-func (me *StoreHandler) AddUserTopic(w http.ResponseWriter, r *http.Request) {
-
-	user, userError := me.GetAdminUserFromRequest(r)
-	if userError != nil {
-		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
-		return
-	}
-
-	userToAddTopicTo := mux.Vars(r)["userID"]
-	_, targetUserError := me.store.GetUserByUsername(userToAddTopicTo)
-	if targetUserError != nil {
-		utils.ReturnWithError(http.StatusNotFound, "User not found", w)
-		return
-	}
+// getTopicFromRequest reads a topic permission sent either as a JSON body on a POST or as parameters on a GET
+// on failure it returns the http status to reply with along with the error
+func getTopicFromRequest(r *http.Request) (store.Topic, int, error) {
 
 	var newTopic store.Topic
 
@@ -33,51 +23,77 @@ func (me *StoreHandler) AddUserTopic(w http.ResponseWriter, r *http.Request) {
 		tp, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Println("Error Reading Body", err.Error())
-			utils.ReturnWithError(http.StatusBadRequest, "Could not read request body", w)
-			return
+			return newTopic, http.StatusBadRequest, errors.New("Could not read request body")
 		}
 		newerr := json.Unmarshal([]byte(string(tp)), &newTopic)
 		if newerr != nil {
-			utils.ReturnWithError(http.StatusInternalServerError, "Could not marshal request body", w)
-			return
+			return newTopic, http.StatusInternalServerError, errors.New("Could not marshal request body")
 		}
 	}
 	if r.Method == "GET" {
 		topicString := utils.GetSentValFromRequest(r, "topicstring")
 		pubString := utils.GetSentValFromRequest(r, "pub")
 		subString := utils.GetSentValFromRequest(r, "sub")
+		denyString := utils.GetSentValFromRequest(r, "deny")
 
 		pub := false
 		sub := false
+		deny := false
 		if pubString == "1" || pubString == "true" {
 			pub = true
 		}
 		if subString == "1" || subString == "true" {
 			sub = true
 		}
+		if denyString == "1" || denyString == "true" {
+			deny = true
+		}
 		if pub == false && sub == false {
-			utils.ReturnWithError(http.StatusBadRequest, "Pub and Sub cannot both be false", w)
-			return
+			return newTopic, http.StatusBadRequest, errors.New("Pub and Sub cannot both be false")
 		}
 		if topicString == "" {
-			utils.ReturnWithError(http.StatusBadRequest, "Topic cannot be blank", w)
-			return
+			return newTopic, http.StatusBadRequest, errors.New("Topic cannot be blank")
 		}
 		if string(topicString[len(topicString)-1]) == "/" {
-			utils.ReturnWithError(http.StatusBadRequest, "Topic cannot end with a /", w)
-			return
+			return newTopic, http.StatusBadRequest, errors.New("Topic cannot end with a /")
 		}
 
 		newTopic.Pub = pub
 		newTopic.Sub = sub
+		newTopic.Deny = deny
 		newTopic.TopicString = topicString
 	}
+	return newTopic, http.StatusOK, nil
+}
+
+// AddUserTopic adds an authorisation for a user to a given topic
+func (me *StoreHandler) AddUserTopic(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	userToAddTopicTo := mux.Vars(r)["userID"]
+	before, targetUserError := me.store.GetUserByUsername(userToAddTopicTo)
+	if targetUserError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "User not found", w)
+		return
+	}
+
+	newTopic, topicStatus, topicError := getTopicFromRequest(r)
+	if topicError != nil {
+		utils.ReturnWithError(topicStatus, topicError.Error(), w)
+		return
+	}
 
 	addTopicError := me.store.AddTopicToUser(userToAddTopicTo, newTopic)
 	if addTopicError != nil {
 		utils.ReturnWithError(http.StatusBadRequest, addTopicError.Error(), w)
 		return
 	}
+	me.auditUser(r, user.UserName, "addusertopic", userToAddTopicTo, before)
 	utils.ReturnOK("Topic added", user.Token, w)
 }
 
@@ -91,54 +107,16 @@ func (me *StoreHandler) EditUserTopic(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userToAddTopicTo := mux.Vars(r)["userID"]
-	_, targetUserError := me.store.GetUserByUsername(userToAddTopicTo)
+	before, targetUserError := me.store.GetUserByUsername(userToAddTopicTo)
 	if targetUserError != nil {
 		utils.ReturnWithError(http.StatusNotFound, "User not found", w)
 		return
 	}
 
-	var newTopic store.Topic
-	if r.Method == "POST" {
-		tp, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Println(err)
-			utils.ReturnWithError(http.StatusBadRequest, "Could not read request body", w)
-		}
-		newerr := json.Unmarshal([]byte(string(tp)), &newTopic)
-		if newerr != nil {
-			log.Println(newerr)
-			utils.ReturnWithError(http.StatusInternalServerError, "Could not marshal request body", w)
-		}
-	}
-	if r.Method == "GET" {
-		topicString := utils.GetSentValFromRequest(r, "topicstring")
-		pubString := utils.GetSentValFromRequest(r, "pub")
-		subString := utils.GetSentValFromRequest(r, "sub")
-
-		pub := false
-		sub := false
-		if pubString == "1" || pubString == "true" {
-			pub = true
-		}
-		if subString == "1" || subString == "true" {
-			sub = true
-		}
-		if pub == false && sub == false {
-			utils.ReturnWithError(http.StatusBadRequest, "Pub and Sub cannot both be false", w)
-			return
-		}
-		if topicString == "" {
-			utils.ReturnWithError(http.StatusBadRequest, "Topic cannot be blank", w)
-			return
-		}
-		if string(topicString[len(topicString)-1]) == "/" {
-			utils.ReturnWithError(http.StatusBadRequest, "Topic cannot end with a /", w)
-			return
-		}
-
-		newTopic.Pub = pub
-		newTopic.Sub = sub
-		newTopic.TopicString = topicString
+	newTopic, topicStatus, topicError := getTopicFromRequest(r)
+	if topicError != nil {
+		utils.ReturnWithError(topicStatus, topicError.Error(), w)
+		return
 	}
 
 	EditTopicError := me.store.EditTopicForUser(userToAddTopicTo, newTopic)
@@ -146,6 +124,7 @@ func (me *StoreHandler) EditUserTopic(w http.ResponseWriter, r *http.Request) {
 		utils.ReturnWithError(http.StatusNotFound, EditTopicError.Error(), w)
 		return
 	}
+	me.auditUser(r, user.UserName, "editusertopic", userToAddTopicTo, before)
 	utils.ReturnOK("Topic modified", user.Token, w)
 }
 
@@ -176,11 +155,13 @@ func (me *StoreHandler) DeleteTopic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before, _ := me.store.GetUserByUsername(userToDeleteTopicFrom)
 	deleteTopicError := me.store.DeleteTopicFromUser(userToDeleteTopicFrom, topicToDelete)
 	if deleteTopicError != nil {
 		utils.ReturnWithError(http.StatusNotFound, deleteTopicError.Error(), w)
 		return
 	}
+	me.auditUser(r, user.UserName, "deletetopic", userToDeleteTopicFrom, before)
 	utils.ReturnOK("Topics deleted", user.Token, w)
 }
 
@@ -239,7 +220,9 @@ func (me *StoreHandler) CheckUserTopics(w http.ResponseWriter, r *http.Request)
 	return
 }
 
-// CheckTopicAuth checks to see whether a user is authorised on a given topic
+// CheckTopicAuth checks to see whether a user is authorised on a given topic. With explain set it returns
+// how the answer was reached instead of the bare answer: every topic entry evaluated, whether and through
+// which wildcards it matched, and which entry settled the pub and the sub rights
 func (me *StoreHandler) CheckTopicAuth(w http.ResponseWriter, r *http.Request) {
 	user, userError := me.GetUserFromRequest(r)
 	if userError != nil {
@@ -250,11 +233,15 @@ func (me *StoreHandler) CheckTopicAuth(w http.ResponseWriter, r *http.Request) {
 	var usernameToCheck string
 	var topicToCheck string
 	var access string
+	var clientIDToCheck string
+	var explain bool
 
 	type topicCheck struct {
 		Username string `json:"username"`
 		Topic    string `json:"topic"`
 		Access   string `json:"access"`
+		ClientID string `json:"clientid"`
+		Explain  bool   `json:"explain"`
 	}
 
 	var tpCheck topicCheck
@@ -271,12 +258,16 @@ func (me *StoreHandler) CheckTopicAuth(w http.ResponseWriter, r *http.Request) {
 		usernameToCheck = tpCheck.Username
 		topicToCheck = tpCheck.Topic
 		access = tpCheck.Access
+		clientIDToCheck = tpCheck.ClientID
+		explain = tpCheck.Explain
 	}
 
 	if r.Method == "GET" {
 		usernameToCheck = utils.GetSentValFromRequest(r, "username")
 		topicToCheck = utils.GetSentValFromRequest(r, "topic")
 		access = utils.GetSentValFromRequest(r, "access")
+		clientIDToCheck = utils.GetSentValFromRequest(r, "clientid")
+		explain, _ = strconv.ParseBool(utils.GetSentValFromRequest(r, "explain"))
 	}
 
 	if usernameToCheck == "" || topicToCheck == "" || access == "" {
@@ -300,7 +291,21 @@ func (me *StoreHandler) CheckTopicAuth(w http.ResponseWriter, r *http.Request) {
 		utils.ReturnWithError(http.StatusNotFound, "Could not fetch user to check", w)
 		return
 	}
-	userPub, userSub, CheckErr := userToCheck.CheckTopicAuth(topicToCheck)
+	if explain {
+		type explainedCheck struct {
+			store.TopicAuthExplanation
+			Access  string `json:"access"`
+			Allowed bool   `json:"allowed"`
+		}
+		explanation := userToCheck.ExplainTopicAuth(topicToCheck, clientIDToCheck, store.GetGroupsForUser(me.store, userToCheck))
+		allowed := explanation.Sub
+		if access == "pub" {
+			allowed = explanation.Pub
+		}
+		utils.ReturnOKWithData("ok", explainedCheck{TopicAuthExplanation: explanation, Access: access, Allowed: allowed}, user.Token, w)
+		return
+	}
+	userPub, userSub, CheckErr := userToCheck.CheckTopicAuth(topicToCheck, clientIDToCheck, store.GetGroupsForUser(me.store, userToCheck))
 	if CheckErr != nil {
 		utils.ReturnWithError(http.StatusNotFound, "Could not get auth", w)
 		return
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"authserver/config"
+	"authserver/jwtauth"
 	"authserver/store"
 	"authserver/utils"
 	"encoding/json"
@@ -14,13 +16,23 @@ import (
 )
 
 type StoreHandler struct {
-	store store.UserPersistence
+	store       store.UserPersistence
+	jwtKeys     *jwtauth.KeySet
+	deviceJWT   *jwtauth.DeviceVerifier
+	devices     *jwtauth.DeviceCache
+	limiter     *LoginLimiter
+	decisions   *DecisionCache
+	decisionLog *DecisionLog
 }
 
 // SetStoreHandler sets handler to use store
 func SetStoreHandler(store *store.UserPersistence) *StoreHandler {
 	return &StoreHandler{
-		store: *store,
+		store:       *store,
+		devices:     jwtauth.NewDeviceCache(),
+		limiter:     NewLoginLimiter(),
+		decisions:   NewDecisionCache(),
+		decisionLog: NewDecisionLog(),
 	}
 }
 
@@ -53,14 +65,85 @@ func (me *StoreHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := remoteIP(r)
+	if wait, locked := me.limiter.Locked(login.UserName, ip); locked {
+		refuseLockedLogin(wait, http.StatusTooManyRequests, w)
+		return
+	}
+
 	loggedInUser, loginError := me.store.Login(login.UserName, login.Password, true)
 	if loginError != nil {
+		me.limiter.Failed(login.UserName, ip)
 		utils.ReturnWithError(http.StatusUnauthorized, loginError.Error(), w)
 		return
 	}
+	me.limiter.Succeeded(login.UserName)
+	// In jwt mode a signed JWT naming the session is handed out rather than the session token
+	if me.jwtKeys != nil {
+		signedToken, signError := me.jwtKeys.Issue(loggedInUser.UserName, loggedInUser.Admin, store.SessionID(loggedInUser.Token), config.Config.GetSessionTimeout())
+		if signError != nil {
+			log.Println("Could not sign JWT:", signError.Error())
+			utils.ReturnWithError(http.StatusInternalServerError, "Could not issue token", w)
+			return
+		}
+		loggedInUser.Token = signedToken
+	}
 	utils.ReturnOKWithData("ok", loggedInUser, loggedInUser.Token, w)
 }
 
+// Logout ends the session the request was made with
+func (me *StoreHandler) Logout(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	sessionID, _, sessionError := me.getSessionID(user.Token)
+	if sessionError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, sessionError.Error(), w)
+		return
+	}
+	logoutError := me.store.DeleteSessionByID(sessionID)
+	if logoutError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, logoutError.Error(), w)
+		return
+	}
+	utils.ReturnOK("Logged out", "", w)
+}
+
+// RevokeSessions ends every session of a user, logging them out everywhere
+func (me *StoreHandler) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+
+	user, userError := me.GetAdminUserFromRequest(r)
+	if userError != nil {
+		utils.ReturnWithError(http.StatusUnauthorized, userError.Error(), w)
+		return
+	}
+
+	userToRevoke := mux.Vars(r)["userID"]
+	_, targetUserError := me.store.GetUserByUsername(userToRevoke)
+	if targetUserError != nil {
+		utils.ReturnWithError(http.StatusNotFound, "User not found", w)
+		return
+	}
+
+	revokeError := me.store.DeleteUserSessions(userToRevoke)
+	if revokeError != nil {
+		utils.ReturnWithError(http.StatusBadRequest, revokeError.Error(), w)
+		return
+	}
+	me.audit(r, user.UserName, "revokesessions", userToRevoke, nil, nil)
+
+	// An admin revoking their own sessions has just ended the one this request was made with
+	if userToRevoke == user.UserName {
+		utils.ReturnOK("Sessions revoked", "", w)
+		return
+	}
+	utils.ReturnOK("Sessions revoked", user.Token, w)
+}
+
 // GetUser returns a JSON object containing a user
 func (me *StoreHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 
@@ -77,13 +160,14 @@ func (me *StoreHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type UserEntry struct {
-		UserName string `json:"username"`
-		IsAdmin  bool   `json:"admin"`
+		UserName    string `json:"username"`
+		IsAdmin     bool   `json:"admin"`
+		IsSuperUser bool   `json:"superuser"`
 	}
 
 	for _, v := range me.store.GetUsers() {
 		if userfilter == "" || v.UserName == userfilter {
-			utils.ReturnOKWithData("", UserEntry{UserName: v.UserName, IsAdmin: v.Admin}, user.Token, w)
+			utils.ReturnOKWithData("", UserEntry{UserName: v.UserName, IsAdmin: v.Admin, IsSuperUser: v.SuperUser}, user.Token, w)
 			return
 		}
 	}
@@ -106,15 +190,16 @@ func (me *StoreHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type UserListEntry struct {
-		UserName string `json:"username"`
-		IsAdmin  bool   `json:"admin"`
+		UserName    string `json:"username"`
+		IsAdmin     bool   `json:"admin"`
+		IsSuperUser bool   `json:"superuser"`
 	}
 
 	var ReturnArr []UserListEntry
 
 	for _, v := range me.store.GetUsers() {
 		if userfilter == "" || v.UserName == userfilter {
-			ReturnArr = append(ReturnArr, UserListEntry{UserName: v.UserName, IsAdmin: v.Admin})
+			ReturnArr = append(ReturnArr, UserListEntry{UserName: v.UserName, IsAdmin: v.Admin, IsSuperUser: v.SuperUser})
 		}
 	}
 	utils.ReturnOKWithData("", ReturnArr, user.Token, w)
@@ -147,9 +232,19 @@ func (me *StoreHandler) GetUserFromRequest(r *http.Request) (store.User, error)
 		return thisUser, errors.New("No token provided")
 	}
 
-	thisUser, _ = me.store.GetUserByToken(token)
-	if thisUser.UserName == "" {
-		log.Println("token is not valid: ")
+	sessionID, claims, sessionError := me.getSessionID(token)
+	if sessionError != nil {
+		log.Println("token is not valid: ", sessionError)
+		return thisUser, errors.New("Invalid Token")
+	}
+
+	thisUser, tokenError := me.store.GetUserBySessionID(sessionID)
+	if tokenError != nil || thisUser.UserName == "" {
+		log.Println("token is not valid: ", tokenError)
+		return thisUser, errors.New("Invalid Token")
+	}
+	if claims != nil && claims.UserName != thisUser.UserName {
+		log.Println("token is not valid: JWT username does not match its session")
 		return thisUser, errors.New("Invalid Token")
 	}
 
@@ -157,6 +252,40 @@ func (me *StoreHandler) GetUserFromRequest(r *http.Request) (store.User, error)
 	return thisUser, nil
 }
 
+// getSessionID returns the id of the session a request token stands for. In opaque mode the token is the
+// session token, in jwt mode the JWT is checked and its token id is the session id
+func (me *StoreHandler) getSessionID(token string) (string, *jwtauth.AccessClaims, error) {
+
+	if me.jwtKeys == nil {
+		return store.SessionID(token), nil, nil
+	}
+	if jwtauth.IsJWT(token) == false {
+		return "", nil, errors.New("Token is not a JWT")
+	}
+	claims, verifyError := me.jwtKeys.Verify(token)
+	if verifyError != nil {
+		return "", nil, verifyError
+	}
+	return claims.ID, claims, nil
+}
+
+// JWKS publishes the public keys the management JWTs are signed with
+func (me *StoreHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+
+	if me.jwtKeys == nil {
+		utils.ReturnWithError(http.StatusNotFound, "Token mode is not jwt", w)
+		return
+	}
+	jwks, err := json.Marshal(me.jwtKeys.JWKS())
+	if err != nil {
+		utils.ReturnWithError(http.StatusInternalServerError, err.Error(), w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jwks)
+}
+
 // EditUser handles a request to add a new user
 func (me *StoreHandler) EditUser(w http.ResponseWriter, r *http.Request) {
 	user, userError := me.GetAdminUserFromRequest(r)
@@ -180,16 +309,23 @@ func (me *StoreHandler) EditUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		newUserName := utils.GetSentValFromRequest(r, "username")
 		newUserAdmin := utils.GetSentValFromRequest(r, "admin")
+		newUserSuperUser := utils.GetSentValFromRequest(r, "superuser")
 		newUserPassword := utils.GetSentValFromRequest(r, "password")
 		if newUserAdmin == "true" {
 			tempUser.Admin = true
 		} else {
 			tempUser.Admin = false
 		}
+		if newUserSuperUser == "true" {
+			tempUser.SuperUser = true
+		} else {
+			tempUser.SuperUser = false
+		}
 		tempUser.UserName = newUserName
 		tempUser.Password = newUserPassword
 	}
 
+	before, _ := me.store.GetUserByUsername(tempUser.UserName)
 	var er error
 	er = me.store.EditUser(tempUser)
 
@@ -197,6 +333,7 @@ func (me *StoreHandler) EditUser(w http.ResponseWriter, r *http.Request) {
 		utils.ReturnWithError(http.StatusBadRequest, "Error in editing user:"+er.Error(), w)
 		return
 	}
+	me.auditUser(r, user.UserName, "edituser", tempUser.UserName, before)
 	utils.ReturnOK("User edited", user.Token, w)
 	return
 }
@@ -228,12 +365,18 @@ func (me *StoreHandler) AddUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		newUserName := utils.GetSentValFromRequest(r, "username")
 		newUserAdmin := utils.GetSentValFromRequest(r, "admin")
+		newUserSuperUser := utils.GetSentValFromRequest(r, "superuser")
 		newUserPassword := utils.GetSentValFromRequest(r, "password")
 		if newUserAdmin == "true" {
 			tempUser.Admin = true
 		} else {
 			tempUser.Admin = false
 		}
+		if newUserSuperUser == "true" {
+			tempUser.SuperUser = true
+		} else {
+			tempUser.SuperUser = false
+		}
 		tempUser.UserName = newUserName
 		tempUser.Password = newUserPassword
 	}
@@ -245,6 +388,7 @@ func (me *StoreHandler) AddUser(w http.ResponseWriter, r *http.Request) {
 		utils.ReturnWithError(http.StatusBadRequest, "Error in adding user:"+er.Error(), w)
 		return
 	}
+	me.auditUser(r, user.UserName, "adduser", tempUser.UserName, store.User{})
 	utils.ReturnOK("User Added", user.Token, w)
 	return
 }
@@ -266,6 +410,7 @@ func (me *StoreHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before, _ := me.store.GetUserByUsername(userToDelete)
 	var er error
 	er = me.store.DeleteUser(userToDelete)
 
@@ -273,5 +418,6 @@ func (me *StoreHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		utils.ReturnWithError(http.StatusBadRequest, er.Error(), w)
 		return
 	}
+	me.auditUser(r, thisUser.UserName, "deleteuser", userToDelete, before)
 	utils.ReturnOK("users deleted", thisUser.Token, w)
 }
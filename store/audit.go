@@ -0,0 +1,172 @@
+package store
+
+// This is the audit trail of the changes made through the management api: who changed which user or
+// group, how it was before and after, when and from where. Every store keeps it alongside the users,
+// entries are only ever added
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry is one change in the audit trail. Before and After are the user or group as it was and as
+// it became, without password hashes, and are empty when there was nothing before or after
+type AuditEntry struct {
+	ID       int64           `json:"id"`
+	Time     time.Time       `json:"time"`
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	Target   string          `json:"target"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+	SourceIP string          `json:"sourceip"`
+}
+
+// AuditFilter selects the entries returned from the audit trail, blank fields select everything. The
+// entries come newest first, Offset and Limit page through them
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+// matches checks whether an entry is selected by the filter, for the stores that filter in memory
+func (me AuditFilter) matches(entry AuditEntry) bool {
+	return (me.Actor == "" || entry.Actor == me.Actor) &&
+		(me.Action == "" || entry.Action == me.Action) &&
+		(me.Target == "" || entry.Target == me.Target) &&
+		(me.Since.IsZero() || entry.Time.Before(me.Since) == false) &&
+		(me.Until.IsZero() || entry.Time.Before(me.Until))
+}
+
+// page returns the entries of the page the filter asks for, from the entries it matches newest first
+func (me AuditFilter) page(entries []AuditEntry) []AuditEntry {
+	if me.Offset >= len(entries) {
+		return []AuditEntry{}
+	}
+	entries = entries[me.Offset:]
+	if me.Limit > 0 && me.Limit < len(entries) {
+		entries = entries[:me.Limit]
+	}
+	return entries
+}
+
+// where returns the WHERE clause and its arguments for the stores that filter in sql, placeholder
+// returns the placeholder for the nth argument
+func (me AuditFilter) where(placeholder func(n int) string) (string, []interface{}) {
+
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+placeholder(len(args)))
+	}
+	if me.Actor != "" {
+		add("actor = ", me.Actor)
+	}
+	if me.Action != "" {
+		add("action = ", me.Action)
+	}
+	if me.Target != "" {
+		add("target = ", me.Target)
+	}
+	if me.Since.IsZero() == false {
+		add("time >= ", me.Since.UTC())
+	}
+	if me.Until.IsZero() == false {
+		add("time < ", me.Until.UTC())
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// limit returns the LIMIT and OFFSET clause for the stores that page in sql, all is how the db writes no limit
+func (me AuditFilter) limit(all string) string {
+	limit := all
+	if me.Limit > 0 {
+		limit = strconv.Itoa(me.Limit)
+	}
+	return " LIMIT " + limit + " OFFSET " + strconv.Itoa(me.Offset)
+}
+
+// nullJSON turns an empty snapshot into a NULL for the sql stores
+func nullJSON(snapshot json.RawMessage) interface{} {
+	if len(snapshot) == 0 {
+		return nil
+	}
+	return string(snapshot)
+}
+
+// auditedUser is a user as recorded in the audit trail, without their password hash. PasswordChanged is
+// set on the user as they are after a change that gave them a new password
+type auditedUser struct {
+	UserName        string        `json:"username"`
+	Admin           bool          `json:"admin"`
+	SuperUser       bool          `json:"superuser"`
+	Topics          TopicArray    `json:"topics"`
+	ClientIDs       ClientIDArray `json:"clientids"`
+	Groups          GroupArray    `json:"groups"`
+	PasswordChanged bool          `json:"passwordchanged,omitempty"`
+}
+
+// AuditSnapshot turns what is recorded before or after a change into json for the audit trail
+func AuditSnapshot(v interface{}) json.RawMessage {
+	recorded, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error in recording an audit snapshot:", err)
+		return nil
+	}
+	return recorded
+}
+
+// UserAuditEntry fills in the target and the snapshots of an audit entry for a change to a user. before is
+// the user as they were and after as they became, a blank user where there was none, and the target is
+// left as it is if both are blank
+func UserAuditEntry(entry AuditEntry, before User, after User) AuditEntry {
+	entry.Before, entry.After = nil, nil
+	if before.UserName != "" {
+		entry.Target = before.UserName
+		entry.Before = AuditSnapshot(auditedUser{UserName: before.UserName, Admin: before.Admin, SuperUser: before.SuperUser,
+			Topics: before.Topics, ClientIDs: before.ClientIDs, Groups: before.Groups})
+	}
+	if after.UserName != "" {
+		entry.Target = after.UserName
+		entry.After = AuditSnapshot(auditedUser{UserName: after.UserName, Admin: after.Admin, SuperUser: after.SuperUser,
+			Topics: after.Topics, ClientIDs: after.ClientIDs, Groups: after.Groups,
+			PasswordChanged: before.UserName != "" && before.Password != after.Password})
+	}
+	return entry
+}
+
+// GroupAuditEntry fills in the target and the snapshots of an audit entry for a change to a group. before
+// is the group as it was and after as it became, a blank group where there was none
+func GroupAuditEntry(entry AuditEntry, before Group, after Group) AuditEntry {
+	entry.Before, entry.After = nil, nil
+	if before.Name != "" {
+		entry.Target = before.Name
+		entry.Before = AuditSnapshot(before)
+	}
+	if after.Name != "" {
+		entry.Target = after.Name
+		entry.After = AuditSnapshot(after)
+	}
+	return entry
+}
+
+// addAuditEntries records changes that have already been made, so a failure is logged rather than returned
+func addAuditEntries(store UserPersistence, entries []AuditEntry) {
+	for _, v := range entries {
+		if err := store.AddAuditEntry(v); err != nil {
+			log.Println("Could not record", v.Action, "of", v.Target, "by", v.Actor, "in the audit trail:", err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditTrail(t *testing.T) {
+
+	dir := t.TempDir()
+	stores := map[string]UserPersistence{
+		"json":   newTestJSONCollection(t),
+		"sqlite": openTestSQLite(t, filepath.Join(dir, "users.db")),
+		"bolt":   openTestBolt(t, filepath.Join(dir, "users.bolt")),
+	}
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for name, collection := range stores {
+		for i, v := range []AuditEntry{
+			{Actor: "Admin", Action: "adduser", Target: "sensor1", After: json.RawMessage(`{"username":"sensor1"}`)},
+			{Actor: "Admin", Action: "addusertopic", Target: "sensor1", Before: json.RawMessage(`{"username":"sensor1"}`),
+				After: json.RawMessage(`{"username":"sensor1","topics":[{"topic":"devices/#"}]}`)},
+			{Actor: "Gaz", Action: "deleteuser", Target: "sensor2", Before: json.RawMessage(`{"username":"sensor2"}`)},
+		} {
+			v.Time = start.Add(time.Duration(i) * time.Minute)
+			v.SourceIP = "127.0.0.1"
+			if err := collection.AddAuditEntry(v); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		entries, total, err := collection.GetAuditEntries(AuditFilter{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if total != 3 || len(entries) != 3 || entries[0].Action != "deleteuser" || entries[2].Action != "adduser" {
+			t.Errorf("%s: expected the 3 entries newest first, got %d of %d: %+v", name, len(entries), total, entries)
+			continue
+		}
+		if entries[0].ID <= entries[1].ID || entries[0].SourceIP != "127.0.0.1" || entries[0].Time.Equal(start.Add(2*time.Minute)) == false {
+			t.Errorf("%s: entry not kept as added: %+v", name, entries[0])
+		}
+		if len(entries[0].After) != 0 || string(entries[2].After) != `{"username":"sensor1"}` {
+			t.Errorf("%s: snapshots not kept as added: %q %q", name, entries[0].After, entries[2].After)
+		}
+
+		entries, total, err = collection.GetAuditEntries(AuditFilter{Target: "sensor1", Limit: 1, Offset: 1})
+		if err != nil || total != 2 || len(entries) != 1 || entries[0].Action != "adduser" {
+			t.Errorf("%s: expected the second of 2 entries for sensor1, got %d of %d: %+v %v", name, len(entries), total, entries, err)
+		}
+		entries, total, err = collection.GetAuditEntries(AuditFilter{Actor: "Admin", Since: start.Add(time.Minute)})
+		if err != nil || total != 1 || len(entries) != 1 || entries[0].Action != "addusertopic" {
+			t.Errorf("%s: expected 1 entry by Admin since the first, got %d of %d: %+v %v", name, len(entries), total, entries, err)
+		}
+		entries, total, err = collection.GetAuditEntries(AuditFilter{Until: start.Add(time.Minute), Offset: 5})
+		if err != nil || total != 1 || len(entries) != 0 {
+			t.Errorf("%s: expected an empty page of 1 entry, got %d of %d: %v", name, len(entries), total, err)
+		}
+	}
+
+	// the audit trail can only be added to
+	collection := stores["sqlite"].(*UserSQLiteCollection)
+	if _, err := collection.DB.Exec("UPDATE hmqaudit SET actor = 'nobody'"); err == nil {
+		t.Errorf("audit entries updated")
+	}
+	if _, err := collection.DB.Exec("DELETE FROM hmqaudit"); err == nil {
+		t.Errorf("audit entries deleted")
+	}
+}
@@ -0,0 +1,975 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The buckets of the bolt store. The topics bucket holds a bucket per user with their topics in order,
+// so that the users bucket only holds the accounts themselves
+var (
+	boltUsersBucket    = []byte("users")
+	boltTopicsBucket   = []byte("topics")
+	boltGroupsBucket   = []byte("groups")
+	boltSessionsBucket = []byte("sessions")
+	boltAuditBucket    = []byte("audit")
+)
+
+// boltUser is a user as kept in the users bucket, without the topics
+type boltUser struct {
+	UserName  string        `json:"username"`
+	Password  string        `json:"password"`
+	Admin     bool          `json:"admin"`
+	SuperUser bool          `json:"superuser"`
+	ClientIDs ClientIDArray `json:"clientids"`
+	Groups    GroupArray    `json:"groups"`
+}
+
+// InitBolt returns the store object that uses a bolt database file
+func InitBolt(fname string) *UserBoltCollection {
+
+	log.Println("Storage type is bolt")
+	UsersBolt.open(fname)
+	return &UsersBolt
+}
+
+// open opens the database file, creating it and its buckets if needed
+func (me *UserBoltCollection) open(fname string) {
+
+	// Only one process can have the file open, the timeout stops a second one from waiting forever
+	me.DB, me.DBerr = bolt.Open(fname, 0600, &bolt.Options{Timeout: time.Second})
+	if me.DBerr == nil {
+		me.DBerr = me.DB.Update(func(tx *bolt.Tx) error {
+			for _, v := range [][]byte{boltUsersBucket, boltTopicsBucket, boltGroupsBucket, boltSessionsBucket, boltAuditBucket} {
+				if _, err := tx.CreateBucketIfNotExists(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if me.DBerr != nil {
+		log.Println("Unable to open the bolt db", me.DBerr)
+	}
+	me.usernames = indexUsers(me.Users)
+}
+
+// Load loads the users along with their topics from the db
+func (me *UserBoltCollection) Load() error {
+
+	if me.DBerr != nil {
+		return me.DBerr
+	}
+	var usersOut []User
+	var groupsOut []Group
+	loadError := me.DB.View(func(tx *bolt.Tx) error {
+		topics := tx.Bucket(boltTopicsBucket)
+		usersError := tx.Bucket(boltUsersBucket).ForEach(func(k []byte, v []byte) error {
+			var stored boltUser
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			user := User{
+				UserName:  stored.UserName,
+				Password:  stored.Password,
+				Admin:     stored.Admin,
+				SuperUser: stored.SuperUser,
+				ClientIDs: stored.ClientIDs,
+				Groups:    stored.Groups,
+			}
+			if userTopics := topics.Bucket(k); userTopics != nil {
+				topicsError := userTopics.ForEach(func(_ []byte, t []byte) error {
+					var topic Topic
+					if err := json.Unmarshal(t, &topic); err != nil {
+						return err
+					}
+					user.Topics = append(user.Topics, topic)
+					return nil
+				})
+				if topicsError != nil {
+					return topicsError
+				}
+			}
+			user.IndexTopics()
+			usersOut = append(usersOut, user)
+			return nil
+		})
+		if usersError != nil {
+			return usersError
+		}
+		return tx.Bucket(boltGroupsBucket).ForEach(func(_ []byte, v []byte) error {
+			var group Group
+			if err := json.Unmarshal(v, &group); err != nil {
+				return err
+			}
+			group.IndexTopics()
+			groupsOut = append(groupsOut, group)
+			return nil
+		})
+	})
+	if loadError != nil {
+		log.Println("Error in loading the bolt db: ", loadError)
+		return loadError
+	}
+
+	me.Lock()
+	me.Users = usersOut
+	me.Groups = groupsOut
+	me.usernames = indexUsers(me.Users)
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// putUser writes a user to the users bucket and replaces their topics in the topics bucket
+func putUser(tx *bolt.Tx, user User) error {
+
+	stored, marshalError := json.Marshal(boltUser{
+		UserName:  user.UserName,
+		Password:  user.Password,
+		Admin:     user.Admin,
+		SuperUser: user.SuperUser,
+		ClientIDs: user.ClientIDs,
+		Groups:    user.Groups,
+	})
+	if marshalError != nil {
+		return marshalError
+	}
+	key := []byte(user.UserName)
+	if err := tx.Bucket(boltUsersBucket).Put(key, stored); err != nil {
+		return err
+	}
+
+	topics := tx.Bucket(boltTopicsBucket)
+	if topics.Bucket(key) != nil {
+		if err := topics.DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+	if len(user.Topics) == 0 {
+		return nil
+	}
+	userTopics, createError := topics.CreateBucket(key)
+	if createError != nil {
+		return createError
+	}
+	for k, v := range user.Topics {
+		topic, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		position := make([]byte, 4)
+		binary.BigEndian.PutUint32(position, uint32(k))
+		if err := userTopics.Put(position, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putGroup writes a group along with its topics to the groups bucket
+func putGroup(tx *bolt.Tx, group Group) error {
+
+	stored, marshalError := json.Marshal(group)
+	if marshalError != nil {
+		return marshalError
+	}
+	return tx.Bucket(boltGroupsBucket).Put([]byte(group.Name), stored)
+}
+
+// deleteUserSessions removes every session of a user from the sessions bucket
+func deleteUserSessions(tx *bolt.Tx, username string) error {
+
+	sessions := tx.Bucket(boltSessionsBucket)
+	cursor := sessions.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var session Session
+		if err := json.Unmarshal(v, &session); err != nil {
+			return err
+		}
+		if session.UserName == username {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Login logs the user in and generates a token for the session if required
+func (me *UserBoltCollection) Login(username string, password string, requesttoken bool) (User, error) {
+
+	userLoggingIn, getUserError := me.GetUserByUsername(username)
+	if getUserError != nil {
+		return userLoggingIn, errors.New("User not found")
+	}
+
+	PasswordValid := bcrypt.CompareHashAndPassword([]byte(userLoggingIn.Password), []byte(password))
+	if PasswordValid != nil {
+		var blankUser User
+		return blankUser, errors.New("Passwords don't match")
+	}
+
+	if requesttoken == true {
+		// Create a session
+		session, token, sessionError := newSession(username)
+		if sessionError != nil {
+			var blankUser User
+			return blankUser, sessionError
+		}
+		sessionAddError := me.AddSession(session)
+		if sessionAddError != nil {
+			var blankUser User
+			return blankUser, sessionAddError
+		}
+		userLoggingIn.Token = token
+	}
+	return userLoggingIn, nil
+}
+
+// AddUser adds a new user to the collection
+// As with the sqlite store the db is written first, under the lock, so the users in memory never get ahead of it
+func (me *UserBoltCollection) AddUser(user User) error {
+	// Validate the user
+	// if the username and/or the password are blank then reject
+	if user.UserName == "" || user.Password == "" {
+		return errors.New("Username and password must both be non-blank")
+	}
+	me.Lock()
+	if _, exists := me.usernames[user.UserName]; exists {
+		me.Unlock()
+		return errors.New("User already exists")
+	}
+
+	hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		me.Unlock()
+		log.Println("Cannot create password hash")
+		return errors.New("Cannot create password hash")
+	}
+	user.Password = string(hashPWD)
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		return putUser(tx, user)
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in adding a user", result)
+		return result
+	}
+	user.IndexTopics()
+	me.Users = append(me.Users, user)
+	me.usernames[user.UserName] = len(me.Users) - 1
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	return nil
+}
+
+// EditUser edits an existing user, the password is only changed if a new one is given
+func (me *UserBoltCollection) EditUser(user User) error {
+	// Validate the user
+	// if the username is blank then reject
+	if user.UserName == "" {
+		return errors.New("Username and password must both be non-blank")
+	}
+
+	if user.Password != "" {
+		hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Println("Cannot create password hash")
+			return errors.New("Cannot create password hash")
+		}
+		user.Password = string(hashPWD)
+	}
+
+	me.Lock()
+	foundindex, found := me.usernames[user.UserName]
+	if !found {
+		me.Unlock()
+		return errors.New("User not found")
+	}
+	edited := me.Users[foundindex]
+	edited.Admin = user.Admin
+	edited.SuperUser = user.SuperUser
+	if user.Password != "" {
+		edited.Password = user.Password
+	}
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		return putUser(tx, edited)
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in editing user: ", result)
+		return result
+	}
+	me.Users[foundindex] = edited
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	return nil
+}
+
+// UpdateUser accepts a user object and updates the relevant user
+// users cannot change their name - so we can rely upon username as a key
+func (me *UserBoltCollection) UpdateUser(user User) error {
+
+	me.Lock()
+	k, found := me.usernames[user.UserName]
+	if !found {
+		me.Unlock()
+		return errors.New("Could not find user")
+	}
+	if me.Users[k].Password != user.Password {
+		hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			me.Unlock()
+			log.Println("Cannot create password hash")
+			return errors.New("Cannot create password hash")
+		}
+		user.Password = string(hashPWD)
+	}
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		return putUser(tx, user)
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in updating user: ", result)
+		return result
+	}
+	user.IndexTopics()
+	me.Users[k] = user
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	return nil
+}
+
+// PutUsers adds the users or replaces those that exist, as they are given and in a single transaction.
+// The passwords must already be bcrypt hashes and are kept unchanged, as when copying the users from another store
+func (me *UserBoltCollection) PutUsers(users []User) error {
+
+	if err := checkPutUsers(users); err != nil {
+		return err
+	}
+	me.Lock()
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range users {
+			if err := putUser(tx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in putting users: ", result)
+		return result
+	}
+	me.Users = putUsers(me.Users, me.usernames, users)
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// DeleteUser removes a user from the collection along with their topics and sessions, using the username as a key
+func (me *UserBoltCollection) DeleteUser(username string) error {
+
+	me.Lock()
+	k, found := me.usernames[username]
+	if !found {
+		me.Unlock()
+		return errors.New("User Not Found")
+	}
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		key := []byte(username)
+		if err := tx.Bucket(boltUsersBucket).Delete(key); err != nil {
+			return err
+		}
+		if tx.Bucket(boltTopicsBucket).Bucket(key) != nil {
+			if err := tx.Bucket(boltTopicsBucket).DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		return deleteUserSessions(tx, username)
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in deleting user: ", result)
+		return result
+	}
+	last := len(me.Users) - 1
+	me.Users[k] = me.Users[last]
+	me.usernames[me.Users[k].UserName] = k
+	delete(me.usernames, username)
+	me.Users = me.Users[:last]
+	me.Unlock()
+	notifyUserChange(username)
+	return nil
+}
+
+// GetUserByToken returns the user logged in with a session token, expired sessions are rejected and
+// the expiry of a valid session is moved on
+func (me *UserBoltCollection) GetUserByToken(token string) (User, error) {
+	return me.GetUserBySessionID(hashToken(token))
+}
+
+// GetUserBySessionID returns the user a session belongs to, renewing the session
+func (me *UserBoltCollection) GetUserBySessionID(tokenHash string) (User, error) {
+
+	var blankUser User
+	var session Session
+
+	key := []byte(tokenHash)
+	me.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltSessionsBucket).Get(key); v != nil {
+			return json.Unmarshal(v, &session)
+		}
+		return nil
+	})
+	if tokenHashMatch(session.TokenHash, tokenHash) == false {
+		return blankUser, errors.New("Session not found")
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		return blankUser, errors.New("Session expired")
+	}
+	if session.renew(now) {
+		result := me.DB.Update(func(tx *bolt.Tx) error {
+			stored, err := json.Marshal(session)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket(boltSessionsBucket).Put(key, stored)
+		})
+		if result != nil {
+			log.Println("Error in renewing session: ", result)
+		}
+	}
+	return me.GetUserByUsername(session.UserName)
+}
+
+// AddSession stores a new session, any sessions that have expired are cleared out at the same time
+func (me *UserBoltCollection) AddSession(session Session) error {
+
+	now := time.Now()
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(boltSessionsBucket)
+		cursor := sessions.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var stored Session
+			if json.Unmarshal(v, &stored) == nil && stored.Expired(now) {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		stored, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return sessions.Put([]byte(session.TokenHash), stored)
+	})
+	if result != nil {
+		log.Println("Error in adding a session: ", result)
+	}
+	return result
+}
+
+// DeleteSession removes a session, logging it out
+func (me *UserBoltCollection) DeleteSession(token string) error {
+	return me.DeleteSessionByID(hashToken(token))
+}
+
+// DeleteSessionByID removes a session by its id
+func (me *UserBoltCollection) DeleteSessionByID(tokenHash string) error {
+
+	key := []byte(tokenHash)
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(boltSessionsBucket)
+		if sessions.Get(key) == nil {
+			return errors.New("Session not found")
+		}
+		return sessions.Delete(key)
+	})
+	if result != nil {
+		log.Println("Error in deleting session: ", result)
+	}
+	return result
+}
+
+// DeleteUserSessions removes every session of a user
+func (me *UserBoltCollection) DeleteUserSessions(username string) error {
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		return deleteUserSessions(tx, username)
+	})
+	if result != nil {
+		log.Println("Error in deleting sessions: ", result)
+	}
+	return result
+}
+
+// GetUserByUsername returns a user from the collection using username as a key
+func (me *UserBoltCollection) GetUserByUsername(username string) (User, error) {
+
+	me.RLock()
+	defer me.RUnlock()
+	if k, found := me.usernames[username]; found {
+		return me.Users[k], nil
+	}
+	var blankUser User
+	return blankUser, errors.New("User not found")
+}
+
+// GetUsers returns all the users from the collection
+func (me *UserBoltCollection) GetUsers() []User {
+	me.RLock()
+	defer me.RUnlock()
+	return me.Users
+}
+
+// AddTopicToUser adds a new topic to an existing user
+func (me *UserBoltCollection) AddTopicToUser(username string, topic Topic) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for _, v := range targetUser.Topics {
+		if v.TopicString == topic.TopicString {
+			return errors.New("Topic already exists")
+		}
+	}
+
+	topics := make(TopicArray, 0, len(targetUser.Topics)+1)
+	targetUser.Topics = append(append(topics, targetUser.Topics...), topic)
+	return me.UpdateUser(targetUser)
+}
+
+// EditTopicForUser edits and existing topic for an existing user in the collection
+func (me *UserBoltCollection) EditTopicForUser(username string, topic Topic) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.Topics {
+		if v.TopicString == topic.TopicString {
+			// the topics are copied as the stored user shares them until UpdateUser replaces it
+			topics := make(TopicArray, len(targetUser.Topics))
+			copy(topics, targetUser.Topics)
+			topics[k] = topic
+			targetUser.Topics = topics
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromUser removes a topic permission for that user if the topic does not exist it returns an error
+func (me *UserBoltCollection) DeleteTopicFromUser(username string, topicString string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.Topics {
+		if v.TopicString == topicString {
+			topics := make(TopicArray, 0, len(targetUser.Topics)-1)
+			topics = append(topics, targetUser.Topics[:k]...)
+			targetUser.Topics = append(topics, targetUser.Topics[k+1:]...)
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// AddClientIDToUser adds an allowed client id (or client id pattern) to an existing user
+func (me *UserBoltCollection) AddClientIDToUser(username string, clientID string) error {
+
+	if clientID == "" {
+		return errors.New("Client id cannot be blank")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for _, v := range targetUser.ClientIDs {
+		if v == clientID {
+			return errors.New("Client id already exists")
+		}
+	}
+
+	clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)+1)
+	targetUser.ClientIDs = append(append(clientIDs, targetUser.ClientIDs...), clientID)
+	return me.UpdateUser(targetUser)
+}
+
+// DeleteClientIDFromUser removes an allowed client id from a user, if the client id does not exist it returns an error
+func (me *UserBoltCollection) DeleteClientIDFromUser(username string, clientID string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.ClientIDs {
+		if v == clientID {
+			clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)-1)
+			clientIDs = append(clientIDs, targetUser.ClientIDs[:k]...)
+			targetUser.ClientIDs = append(clientIDs, targetUser.ClientIDs[k+1:]...)
+
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Client id not found")
+}
+
+// GetGroups returns all the groups from the collection
+func (me *UserBoltCollection) GetGroups() []Group {
+	me.RLock()
+	defer me.RUnlock()
+	return me.Groups
+}
+
+// GetGroup returns a group from the collection using its name as a key
+func (me *UserBoltCollection) GetGroup(name string) (Group, error) {
+
+	me.RLock()
+	defer me.RUnlock()
+
+	for _, v := range me.Groups {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	var blankGroup Group
+	return blankGroup, errors.New("Group not found")
+}
+
+// AddGroup adds a new group to the collection
+func (me *UserBoltCollection) AddGroup(group Group) error {
+	if group.Name == "" {
+		return errors.New("Group name must be non-blank")
+	}
+
+	me.Lock()
+	defer me.Unlock()
+	for _, v := range me.Groups {
+		if v.Name == group.Name {
+			return errors.New("Group already exists")
+		}
+	}
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		return putGroup(tx, group)
+	})
+	if result != nil {
+		log.Println("Error in adding a group", result)
+		return result
+	}
+	group.IndexTopics()
+	me.Groups = append(me.Groups, group)
+	return nil
+}
+
+// UpdateGroup accepts a group object and replaces the group with the same name
+func (me *UserBoltCollection) UpdateGroup(group Group) error {
+
+	me.Lock()
+	for k, v := range me.Groups {
+		if v.Name == group.Name {
+			result := me.DB.Update(func(tx *bolt.Tx) error {
+				return putGroup(tx, group)
+			})
+			if result != nil {
+				me.Unlock()
+				log.Println("Error in updating group: ", result)
+				return result
+			}
+			group.IndexTopics()
+			me.Groups[k] = group
+			me.Unlock()
+			notifyUserChange("")
+			return nil
+		}
+	}
+	me.Unlock()
+	return errors.New("Could not find group")
+}
+
+// PutGroups adds the groups or replaces those that exist, as they are given and in a single transaction
+func (me *UserBoltCollection) PutGroups(groups []Group) error {
+
+	if err := checkPutGroups(groups); err != nil {
+		return err
+	}
+	me.Lock()
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range groups {
+			if err := putGroup(tx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in putting groups: ", result)
+		return result
+	}
+	me.Groups = putGroups(me.Groups, groups)
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// DeleteGroup removes a group from the collection and takes every user out of it, in a single transaction
+func (me *UserBoltCollection) DeleteGroup(name string) error {
+
+	me.Lock()
+	found := -1
+	for k, v := range me.Groups {
+		if v.Name == name {
+			found = k
+			break
+		}
+	}
+	if found < 0 {
+		me.Unlock()
+		return errors.New("Group Not Found")
+	}
+	var members []User
+	for _, v := range me.Users {
+		if v.InGroup(name) {
+			v.Groups = removeGroupName(v.Groups, name)
+			members = append(members, v)
+		}
+	}
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range members {
+			if err := putUser(tx, v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(boltGroupsBucket).Delete([]byte(name))
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in deleting group: ", result)
+		return result
+	}
+	for _, v := range members {
+		me.Users[me.usernames[v.UserName]].Groups = v.Groups
+	}
+	me.Groups[found] = me.Groups[len(me.Groups)-1]
+	me.Groups = me.Groups[:len(me.Groups)-1]
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// AddTopicToGroup adds a new topic to an existing group
+func (me *UserBoltCollection) AddTopicToGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for _, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			return errors.New("Topic already exists")
+		}
+	}
+
+	topics := make(TopicArray, 0, len(targetGroup.Topics)+1)
+	targetGroup.Topics = append(append(topics, targetGroup.Topics...), topic)
+	return me.UpdateGroup(targetGroup)
+}
+
+// EditTopicForGroup edits an existing topic for an existing group in the collection
+func (me *UserBoltCollection) EditTopicForGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			topics := make(TopicArray, len(targetGroup.Topics))
+			copy(topics, targetGroup.Topics)
+			topics[k] = topic
+			targetGroup.Topics = topics
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromGroup removes a topic permission from a group, if the topic does not exist it returns an error
+func (me *UserBoltCollection) DeleteTopicFromGroup(name string, topicString string) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topicString {
+			topics := make(TopicArray, 0, len(targetGroup.Topics)-1)
+			topics = append(topics, targetGroup.Topics[:k]...)
+			targetGroup.Topics = append(topics, targetGroup.Topics[k+1:]...)
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// AddUserToGroup makes an existing user a member of an existing group
+func (me *UserBoltCollection) AddUserToGroup(username string, name string) error {
+
+	_, getGroupError := me.GetGroup(name)
+	if getGroupError != nil {
+		return errors.New("Could not find group")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) {
+		return errors.New("User already in group")
+	}
+
+	groups := make(GroupArray, 0, len(targetUser.Groups)+1)
+	targetUser.Groups = append(append(groups, targetUser.Groups...), name)
+	return me.UpdateUser(targetUser)
+}
+
+// RemoveUserFromGroup takes a user out of a group
+func (me *UserBoltCollection) RemoveUserFromGroup(username string, name string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) == false {
+		return errors.New("User not in group")
+	}
+
+	targetUser.Groups = removeGroupName(targetUser.Groups, name)
+	return me.UpdateUser(targetUser)
+}
+
+// AddAuditEntry appends an entry to the audit trail, keyed by the bucket's sequence so that the entries stay in order
+func (me *UserBoltCollection) AddAuditEntry(entry AuditEntry) error {
+
+	result := me.DB.Update(func(tx *bolt.Tx) error {
+		audit := tx.Bucket(boltAuditBucket)
+		id, sequenceError := audit.NextSequence()
+		if sequenceError != nil {
+			return sequenceError
+		}
+		entry.ID = int64(id)
+		entry.Time = entry.Time.UTC()
+		stored, marshalError := json.Marshal(entry)
+		if marshalError != nil {
+			return marshalError
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, id)
+		return audit.Put(key, stored)
+	})
+	if result != nil {
+		log.Println("Error in adding an audit entry: ", result)
+	}
+	return result
+}
+
+// GetAuditEntries returns the page of audit entries the filter selects, newest first, along with how
+// many entries it selects in all
+func (me *UserBoltCollection) GetAuditEntries(filter AuditFilter) ([]AuditEntry, int, error) {
+
+	entries := []AuditEntry{}
+	total := 0
+	result := me.DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltAuditBucket).Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var entry AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if filter.matches(entry) == false {
+				continue
+			}
+			if total >= filter.Offset && (filter.Limit <= 0 || len(entries) < filter.Limit) {
+				entries = append(entries, entry)
+			}
+			total++
+		}
+		return nil
+	})
+	return entries, total, result
+}
+
+// CompactBolt copies a bolt database into a new file, leaving out the free pages, and then replaces the
+// original with the copy. hmqauth must not be running as the database is opened for writing
+func CompactBolt(fname string) error {
+
+	if _, statError := os.Stat(fname); statError != nil {
+		return statError
+	}
+	src, openError := bolt.Open(fname, 0600, &bolt.Options{Timeout: time.Second})
+	if openError != nil {
+		return openError
+	}
+
+	tmpName := fname + ".compact"
+	os.Remove(tmpName)
+	dst, createError := bolt.Open(tmpName, 0600, &bolt.Options{Timeout: time.Second})
+	if createError != nil {
+		src.Close()
+		return createError
+	}
+	compactError := bolt.Compact(dst, src, 1<<20)
+	if closeError := dst.Close(); compactError == nil {
+		compactError = closeError
+	}
+	src.Close()
+	if compactError != nil {
+		os.Remove(tmpName)
+		return compactError
+	}
+	return os.Rename(tmpName, fname)
+}
+
+// BackupBolt writes a consistent copy of a bolt database to a new file
+func BackupBolt(fname string, backupName string) error {
+
+	if _, statError := os.Stat(fname); statError != nil {
+		return statError
+	}
+	db, openError := bolt.Open(fname, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if openError != nil {
+		return openError
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backupName, 0600)
+	})
+}
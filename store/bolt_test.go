@@ -0,0 +1,189 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestBolt opens a bolt store, it is closed at the end of the test unless closed before
+func openTestBolt(t *testing.T, fname string) *UserBoltCollection {
+	collection := &UserBoltCollection{}
+	collection.open(fname)
+	if collection.DBerr != nil {
+		t.Fatal(collection.DBerr)
+	}
+	t.Cleanup(func() { collection.DB.Close() })
+	if err := collection.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return collection
+}
+
+func TestBoltUsers(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "users.bolt")
+	collection := openTestBolt(t, fname)
+
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw"}); err == nil {
+		t.Errorf("duplicate user added")
+	}
+	if err := collection.AddUser(User{UserName: "sensor1", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"zz/#", "devices/%u/#", "alerts/#"} {
+		if err := collection.AddTopicToUser("sensor1", Topic{TopicString: v, Sub: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := collection.EditTopicForUser("sensor1", Topic{TopicString: "alerts/#", Pub: true, Sub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.DeleteTopicFromUser("sensor1", "devices/%u/#"); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddClientIDToUser("sensor1", "sensor1-*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.EditUser(User{UserName: "sensor1", SuperUser: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.Login("sensor1", "pw", false); err != nil {
+		t.Errorf("password lost when editing without one: %v", err)
+	}
+	collection.DB.Close()
+
+	// the topics keep their order when they are loaded again
+	reopened := openTestBolt(t, fname)
+	user, err := reopened.GetUserByUsername("sensor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.SuperUser == false || reflect.DeepEqual(user.ClientIDs, ClientIDArray{"sensor1-*"}) == false {
+		t.Errorf("user not saved: %+v", user)
+	}
+	wantTopics := TopicArray{{TopicString: "zz/#", Sub: true}, {TopicString: "alerts/#", Pub: true, Sub: true}}
+	if reflect.DeepEqual(user.Topics, wantTopics) == false {
+		t.Errorf("topics not saved: %+v", user.Topics)
+	}
+	if pub, _, _ := user.CheckTopicAuth("alerts/fire", "sensor1-a", nil); pub == false {
+		t.Errorf("topic check failed after loading")
+	}
+
+	if err := reopened.DeleteUser("sensor1"); err != nil {
+		t.Fatal(err)
+	}
+	reopened.DB.Close()
+	reopened = openTestBolt(t, fname)
+	if users := reopened.GetUsers(); len(users) != 1 || users[0].UserName != "Gaz" || users[0].Admin == false {
+		t.Errorf("unexpected users after a delete: %+v", users)
+	}
+}
+
+func TestBoltSessionsAndGroups(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "users.bolt")
+	collection := openTestBolt(t, fname)
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := collection.Login("Gaz", "pw", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := collection.Login("Gaz", "pw", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.DeleteSession(first.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.DeleteSession(first.Token); err == nil {
+		t.Errorf("session deleted twice")
+	}
+	if _, err := collection.GetUserByToken(first.Token); err == nil {
+		t.Errorf("logged out session still valid")
+	}
+	if user, err := collection.GetUserByToken(second.Token); err != nil || user.UserName != "Gaz" {
+		t.Errorf("other session logged out: %v", err)
+	}
+
+	if err := collection.AddGroup(Group{Name: "sensors"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddTopicToGroup("sensors", Topic{TopicString: "telemetry/%u", Pub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddUserToGroup("Gaz", "sensors"); err != nil {
+		t.Fatal(err)
+	}
+	collection.DB.Close()
+
+	reopened := openTestBolt(t, fname)
+	if _, err := reopened.GetUserByToken(second.Token); err != nil {
+		t.Errorf("session not found after reopening: %v", err)
+	}
+	user, _ := reopened.GetUserByUsername("Gaz")
+	if pub, _, _ := user.CheckTopicAuth("telemetry/Gaz", "", GetGroupsForUser(reopened, user)); pub == false {
+		t.Errorf("group topic not saved")
+	}
+	if err := reopened.DeleteGroup("sensors"); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := reopened.GetUserByUsername("Gaz"); user.InGroup("sensors") {
+		t.Errorf("user still in the deleted group")
+	}
+
+	// deleting the user ends their sessions
+	if err := reopened.DeleteUser("Gaz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.GetUserByToken(second.Token); err == nil {
+		t.Errorf("session left after deleting the user")
+	}
+}
+
+func TestBoltCompactAndBackup(t *testing.T) {
+
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "users.bolt")
+	collection := openTestBolt(t, fname)
+	// users are put in memory first to save hashing a password for each, UpdateUser then writes them
+	for i := 0; i < 200; i++ {
+		collection.Users = append(collection.Users, User{UserName: fmt.Sprintf("device%03d", i)})
+	}
+	collection.usernames = indexUsers(collection.Users)
+	for _, v := range collection.GetUsers() {
+		v.Topics = TopicArray{{TopicString: "devices/%u/#", Pub: true, Sub: true}}
+		if err := collection.UpdateUser(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 150; i++ {
+		if err := collection.DeleteUser(fmt.Sprintf("device%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	collection.DB.Close()
+
+	if err := CompactBolt(fname); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "users.bak")
+	if err := BackupBolt(fname, backup); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{fname, backup} {
+		if users := openTestBolt(t, v).GetUsers(); len(users) != 50 {
+			t.Errorf("%s has %d users, expected 50", v, len(users))
+		}
+	}
+	if err := BackupBolt(filepath.Join(dir, "missing.bolt"), backup); err == nil {
+		t.Errorf("backup of a missing database")
+	}
+}
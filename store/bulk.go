@@ -0,0 +1,444 @@
+package store
+
+// This imports and exports users along with their topics in bulk, as CSV or JSON Lines, for provisioning
+// devices by the thousand rather than one request at a time.
+//
+// A CSV file has a header naming its columns, in any order: username, password, admin, superuser,
+// clientids, groups and topics. Only username is required. Client ids and groups are separated by ";",
+// and topics are separated by ";" with each written as the topic, a ":" and its access joined by "+",
+// for example devices/%u/#:pub+sub;alerts/#:pub+sub+deny - an entry with no access is written with nothing
+// after the ":", and a deny must flag pub and/or sub. A ";" or "\" within an entry is escaped with a "\"
+//
+// A JSON Lines file has one user per line, in the same form as the users in users.json
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The formats users can be imported and exported in
+const (
+	BulkCSV   = "csv"
+	BulkJSONL = "jsonl"
+)
+
+// bulkColumns are the columns of an exported CSV file, and the columns an imported one may have
+var bulkColumns = []string{"username", "password", "admin", "superuser", "clientids", "groups", "topics"}
+
+// BulkUser is a user as imported and exported in bulk, the password is in plain text when imported and
+// is never exported
+type BulkUser struct {
+	UserName  string        `json:"username"`
+	Password  string        `json:"password,omitempty"`
+	Admin     bool          `json:"admin"`
+	SuperUser bool          `json:"superuser"`
+	Topics    TopicArray    `json:"topics"`
+	ClientIDs ClientIDArray `json:"clientids"`
+	Groups    GroupArray    `json:"groups"`
+}
+
+// ImportOptions control how an import treats errors and users that already exist
+type ImportOptions struct {
+	// Atomic imports nothing at all if any row has an error, rather than every row that has none
+	Atomic bool
+	// Update replaces users that already exist rather than reporting them as errors. Their password is
+	// only changed if the row has one
+	Update bool
+	// Audit is the actor, action, time and source recorded in the audit trail for every user added or
+	// updated, with the user as they were and as they became. Nothing is recorded if the actor is blank
+	Audit AuditEntry
+}
+
+// ImportError is a row that could not be imported. Rows are counted from 1, for a CSV file the header is row 1
+type ImportError struct {
+	Row      int    `json:"row"`
+	UserName string `json:"username,omitempty"`
+	Error    string `json:"error"`
+}
+
+// ImportResult is what an import did
+type ImportResult struct {
+	Added   int           `json:"added"`
+	Updated int           `json:"updated"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// bulkRow is a user read from an import along with the row it came from
+type bulkRow struct {
+	row  int
+	user BulkUser
+}
+
+// ImportUsers reads users in the given format and adds them to the store. Every row is checked before
+// anything is written, and the users are then written in one go
+func ImportUsers(store UserPersistence, r io.Reader, format string, options ImportOptions) (ImportResult, error) {
+
+	var result ImportResult
+	var rows []bulkRow
+	var readError error
+	switch format {
+	case BulkCSV:
+		rows, result.Errors, readError = readCSVUsers(r)
+	case BulkJSONL:
+		rows, result.Errors, readError = readJSONLUsers(r)
+	default:
+		return result, errors.New("Unknown format " + format + ", it must be csv or jsonl")
+	}
+	if readError != nil {
+		return result, readError
+	}
+
+	groups := make(map[string]bool)
+	for _, v := range store.GetGroups() {
+		groups[v.Name] = true
+	}
+	seen := make(map[string]bool)
+	var users []User
+	var befores []User
+	var toHash []int
+	added := 0
+	for _, v := range rows {
+		existing, existsError := store.GetUserByUsername(v.user.UserName)
+		exists := existsError == nil
+		rowError := checkBulkUser(v.user, exists, options.Update, groups)
+		if rowError == nil && seen[v.user.UserName] {
+			rowError = errors.New("User appears more than once")
+		}
+		seen[v.user.UserName] = true
+		if rowError != nil {
+			result.Errors = append(result.Errors, ImportError{Row: v.row, UserName: v.user.UserName, Error: rowError.Error()})
+			continue
+		}
+
+		user := User{
+			UserName:  v.user.UserName,
+			Password:  v.user.Password,
+			Admin:     v.user.Admin,
+			SuperUser: v.user.SuperUser,
+			Topics:    v.user.Topics,
+			ClientIDs: v.user.ClientIDs,
+			Groups:    v.user.Groups,
+		}
+		if user.Password == "" {
+			user.Password = existing.Password
+		} else {
+			toHash = append(toHash, len(users))
+		}
+		if exists == false {
+			added++
+			existing = User{}
+		}
+		users = append(users, user)
+		befores = append(befores, existing)
+	}
+
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Row < result.Errors[j].Row })
+	if len(result.Errors) > 0 && options.Atomic {
+		return result, nil
+	}
+	if len(users) == 0 {
+		return result, nil
+	}
+	if err := hashPasswords(users, toHash); err != nil {
+		return result, err
+	}
+	if err := store.PutUsers(users); err != nil {
+		return result, err
+	}
+	if options.Audit.Actor != "" {
+		entries := make([]AuditEntry, len(users))
+		for k, v := range users {
+			entries[k] = UserAuditEntry(options.Audit, befores[k], v)
+		}
+		addAuditEntries(store, entries)
+	}
+	result.Added = added
+	result.Updated = len(users) - added
+	return result, nil
+}
+
+// checkBulkUser checks a user read from an import against the store
+func checkBulkUser(user BulkUser, exists bool, update bool, groups map[string]bool) error {
+
+	if user.UserName == "" {
+		return errors.New("Username must be non-blank")
+	}
+	if exists && update == false {
+		return errors.New("User already exists")
+	}
+	if exists == false && user.Password == "" {
+		return errors.New("Password must be non-blank for a new user")
+	}
+	for _, v := range user.Topics {
+		if v.TopicString == "" {
+			return errors.New("Topic must be non-blank")
+		}
+		if v.Deny && v.Pub == false && v.Sub == false {
+			return errors.New("Topic " + v.TopicString + " denies nothing, a deny must flag pub and/or sub such as " + v.TopicString + ":pub+sub+deny")
+		}
+	}
+	for _, v := range user.Groups {
+		if groups[v] == false {
+			return errors.New("Group " + v + " not found")
+		}
+	}
+	return nil
+}
+
+// hashPasswords replaces the plain text passwords of the users at the given positions with their bcrypt
+// hashes. Hashing is slow by design, so a large import spreads it over every cpu
+func hashPasswords(users []User, positions []int) error {
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	var hashError error
+	var errorOnce sync.Once
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				hashPWD, err := bcrypt.GenerateFromPassword([]byte(users[k].Password), bcrypt.DefaultCost)
+				if err != nil {
+					errorOnce.Do(func() { hashError = errors.New("Cannot create password hash") })
+					continue
+				}
+				users[k].Password = string(hashPWD)
+			}
+		}()
+	}
+	for _, v := range positions {
+		work <- v
+	}
+	close(work)
+	wg.Wait()
+	return hashError
+}
+
+// readJSONLUsers reads users in JSON Lines, blank lines are skipped
+func readJSONLUsers(r io.Reader) ([]bulkRow, []ImportError, error) {
+
+	var rows []bulkRow
+	var rowErrors []ImportError
+	reader := bufio.NewReader(r)
+	for row := 1; ; row++ {
+		line, readError := reader.ReadBytes('\n')
+		if readError != nil && readError != io.EOF {
+			return rows, rowErrors, readError
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var user BulkUser
+			if err := json.Unmarshal(line, &user); err != nil {
+				rowErrors = append(rowErrors, ImportError{Row: row, Error: err.Error()})
+			} else {
+				rows = append(rows, bulkRow{row: row, user: user})
+			}
+		}
+		if readError == io.EOF {
+			return rows, rowErrors, nil
+		}
+	}
+}
+
+// readCSVUsers reads users in CSV, the columns are named by the header
+func readCSVUsers(r io.Reader) ([]bulkRow, []ImportError, error) {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, headerError := reader.Read()
+	if headerError == io.EOF {
+		return nil, nil, nil
+	}
+	if headerError != nil {
+		return nil, nil, headerError
+	}
+	columns := make(map[string]int)
+	for k, v := range header {
+		name := strings.ToLower(strings.TrimSpace(v))
+		known := false
+		for _, column := range bulkColumns {
+			known = known || column == name
+		}
+		if known == false {
+			return nil, nil, errors.New("Unknown column " + v)
+		}
+		columns[name] = k
+	}
+	if _, found := columns["username"]; found == false {
+		return nil, nil, errors.New("The header has no username column")
+	}
+
+	var rows []bulkRow
+	var rowErrors []ImportError
+	for row := 2; ; row++ {
+		record, readError := reader.Read()
+		if readError == io.EOF {
+			break
+		}
+		if readError != nil {
+			rowErrors = append(rowErrors, ImportError{Row: row, Error: readError.Error()})
+			continue
+		}
+		if len(record) != len(header) {
+			rowErrors = append(rowErrors, ImportError{Row: row, Error: "Row has " + strconv.Itoa(len(record)) + " columns, the header has " + strconv.Itoa(len(header))})
+			continue
+		}
+		user, parseError := parseCSVUser(record, columns)
+		if parseError != nil {
+			rowErrors = append(rowErrors, ImportError{Row: row, UserName: user.UserName, Error: parseError.Error()})
+			continue
+		}
+		rows = append(rows, bulkRow{row: row, user: user})
+	}
+	return rows, rowErrors, nil
+}
+
+// parseCSVUser makes a user from a CSV record
+func parseCSVUser(record []string, columns map[string]int) (BulkUser, error) {
+
+	field := func(name string) string {
+		if k, found := columns[name]; found {
+			return strings.TrimSpace(record[k])
+		}
+		return ""
+	}
+	user := BulkUser{
+		UserName:  field("username"),
+		Password:  field("password"),
+		ClientIDs: splitCSVList(field("clientids")),
+		Groups:    splitCSVList(field("groups")),
+	}
+	var err error
+	if user.Admin, err = parseCSVBool(field("admin")); err != nil {
+		return user, errors.New("Admin must be true or false")
+	}
+	if user.SuperUser, err = parseCSVBool(field("superuser")); err != nil {
+		return user, errors.New("Superuser must be true or false")
+	}
+	for _, v := range splitCSVList(field("topics")) {
+		separator := strings.LastIndex(v, ":")
+		if separator < 0 {
+			return user, errors.New("Topic " + v + " has no access, such as " + v + ":pub+sub")
+		}
+		topic := Topic{TopicString: v[:separator]}
+		if strings.TrimSpace(v[separator+1:]) == "" {
+			// an entry that grants nothing, as exported for an entry with no access flagged
+			user.Topics = append(user.Topics, topic)
+			continue
+		}
+		for _, access := range strings.Split(v[separator+1:], "+") {
+			switch strings.ToLower(strings.TrimSpace(access)) {
+			case "pub":
+				topic.Pub = true
+			case "sub":
+				topic.Sub = true
+			case "deny":
+				topic.Deny = true
+			default:
+				return user, errors.New("Topic " + v + " has an unknown access, it must be pub, sub or deny")
+			}
+		}
+		user.Topics = append(user.Topics, topic)
+	}
+	return user, nil
+}
+
+// parseCSVBool reads a flag column, blank is false
+func parseCSVBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// splitCSVList splits a list column on the ";" that are not escaped with a "\", leaving out blank entries
+func splitCSVList(value string) []string {
+	var list []string
+	var entry strings.Builder
+	add := func() {
+		if v := strings.TrimSpace(entry.String()); v != "" {
+			list = append(list, v)
+		}
+		entry.Reset()
+	}
+	escaped := false
+	for _, c := range value {
+		switch {
+		case escaped:
+			entry.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ';':
+			add()
+		default:
+			entry.WriteRune(c)
+		}
+	}
+	add()
+	return list
+}
+
+// joinCSVList writes a list column, escaping any ";" or "\" in the entries so splitCSVList reads them back
+func joinCSVList(list []string) string {
+	escaper := strings.NewReplacer("\\", "\\\\", ";", "\\;")
+	escaped := make([]string, len(list))
+	for k, v := range list {
+		escaped[k] = escaper.Replace(v)
+	}
+	return strings.Join(escaped, ";")
+}
+
+// ExportUsers writes the users, with their topics but without their passwords, in the given format.
+// Each user is written as it is reached rather than the whole export being built first
+func ExportUsers(w io.Writer, users []User, format string) error {
+
+	switch format {
+	case BulkCSV:
+		writer := csv.NewWriter(w)
+		header := []string{}
+		for _, v := range bulkColumns {
+			if v != "password" {
+				header = append(header, v)
+			}
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		for _, v := range users {
+			var topics []string
+			for _, topic := range v.Topics {
+				topics = append(topics, topic.String())
+			}
+			record := []string{v.UserName, strconv.FormatBool(v.Admin), strconv.FormatBool(v.SuperUser),
+				joinCSVList(v.ClientIDs), joinCSVList(v.Groups), joinCSVList(topics)}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case BulkJSONL:
+		encoder := json.NewEncoder(w)
+		for _, v := range users {
+			user := BulkUser{UserName: v.UserName, Admin: v.Admin, SuperUser: v.SuperUser, Topics: v.Topics, ClientIDs: v.ClientIDs, Groups: v.Groups}
+			if err := encoder.Encode(user); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errors.New("Unknown format " + format + ", it must be csv or jsonl")
+	}
+}
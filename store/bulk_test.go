@@ -0,0 +1,148 @@
+package store
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportUsersCSV(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	if err := collection.AddGroup(Group{Name: "sensors"}); err != nil {
+		t.Fatal(err)
+	}
+	csv := `username,password,superuser,clientids,groups,topics
+sensor1,pw1,false,sensor1-*,sensors,devices/%u/#:pub+sub;aa:bb/#:pub+sub+deny
+sensor2,pw2,,,,
+,pw3,,,,
+sensor4,pw4,maybe,,,
+sensor5,pw5,,,nogroup,
+sensor6,pw6,,,,alerts/#:write
+sensor1,pw7,,,,
+sensor8,pw8
+sensor10,pw10,,,,alerts/#:deny
+`
+	result, err := ImportUsers(collection, strings.NewReader(csv), BulkCSV, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 {
+		t.Errorf("added %d users, expected 2", result.Added)
+	}
+	var rows []int
+	for _, v := range result.Errors {
+		rows = append(rows, v.Row)
+	}
+	if reflect.DeepEqual(rows, []int{4, 5, 6, 7, 8, 9, 10}) == false {
+		t.Errorf("errors reported for rows %v: %+v", rows, result.Errors)
+	}
+
+	if _, err := collection.Login("sensor1", "pw1", false); err != nil {
+		t.Errorf("imported user cannot log in: %v", err)
+	}
+	user, _ := collection.GetUserByUsername("sensor1")
+	want := TopicArray{{TopicString: "devices/%u/#", Pub: true, Sub: true}, {TopicString: "aa:bb/#", Pub: true, Sub: true, Deny: true}}
+	if reflect.DeepEqual(user.Topics, want) == false || user.InGroup("sensors") == false {
+		t.Errorf("user not imported as given: %+v", user)
+	}
+	if pub, _, _ := user.CheckTopicAuth("devices/sensor1/temp", "sensor1-a", nil); pub == false {
+		t.Errorf("imported topics not checked")
+	}
+}
+
+func TestImportUsersAtomicAndUpdate(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	jsonl := `{"username": "sensor1", "password": "pw1", "topics": [{"topicstring": "a/#", "pub": true}]}
+
+{"username": "sensor2", "password": "pw2"}
+{"username": "sensor3", "password": 3}
+`
+	result, err := ImportUsers(collection, strings.NewReader(jsonl), BulkJSONL, ImportOptions{Atomic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Row != 4 || len(collection.GetUsers()) != 0 {
+		t.Errorf("atomic import wrote users despite errors: %+v", result)
+	}
+
+	jsonl = jsonl[:strings.LastIndex(strings.TrimSpace(jsonl), "\n")]
+	if result, err = ImportUsers(collection, strings.NewReader(jsonl), BulkJSONL, ImportOptions{Atomic: true}); err != nil || result.Added != 2 {
+		t.Fatalf("atomic import of valid users: %+v %v", result, err)
+	}
+
+	// without update existing users are errors, with it they are replaced and keep their password if none is given
+	update := `{"username": "sensor1", "superuser": true}`
+	if result, _ = ImportUsers(collection, strings.NewReader(update), BulkJSONL, ImportOptions{}); len(result.Errors) != 1 {
+		t.Errorf("existing user imported without update: %+v", result)
+	}
+	audit := AuditEntry{Time: time.Now(), Actor: "Admin", Action: "importusers", SourceIP: "10.0.0.1"}
+	if result, err = ImportUsers(collection, strings.NewReader(update), BulkJSONL, ImportOptions{Update: true, Audit: audit}); err != nil || result.Updated != 1 {
+		t.Fatalf("update: %+v %v", result, err)
+	}
+	entries, total, _ := collection.GetAuditEntries(AuditFilter{Target: "sensor1"})
+	if total != 1 || entries[0].Actor != "Admin" || entries[0].SourceIP != "10.0.0.1" ||
+		strings.Contains(string(entries[0].Before), `"topicstring":"a/#"`) == false || strings.Contains(string(entries[0].After), `"superuser":true`) == false ||
+		strings.Contains(string(entries[0].After), "passwordchanged") || strings.Contains(string(entries[0].After), "$2a$") {
+		t.Errorf("update not audited with before and after: %+v", entries)
+	}
+	user, _ := collection.GetUserByUsername("sensor1")
+	if user.SuperUser == false || len(user.Topics) != 0 {
+		t.Errorf("user not replaced: %+v", user)
+	}
+	if _, err := collection.Login("sensor1", "pw1", false); err != nil {
+		t.Errorf("password lost on update: %v", err)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	if err := collection.AddGroup(Group{Name: "sensors"}); err != nil {
+		t.Fatal(err)
+	}
+	csv := "username,password,admin,clientids,groups,topics\nsensor1,pw1,true,a;b,sensors,devices/%u/#:pub+sub;alerts/#:pub+sub+deny\n"
+	if _, err := ImportUsers(collection, strings.NewReader(csv), BulkCSV, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{BulkCSV, BulkJSONL} {
+		var exported bytes.Buffer
+		if err := ExportUsers(&exported, collection.GetUsers(), format); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(exported.String(), "$2a$") || strings.Contains(exported.String(), "password") {
+			t.Errorf("%s export has passwords: %s", format, exported.String())
+		}
+
+		// an export imported again with update changes nothing
+		before, _ := collection.GetUserByUsername("sensor1")
+		result, err := ImportUsers(collection, &exported, format, ImportOptions{Update: true, Atomic: true})
+		if err != nil || result.Updated != 1 {
+			t.Fatalf("%s export not imported: %+v %v", format, result, err)
+		}
+		after, _ := collection.GetUserByUsername("sensor1")
+		if sameUser(before, after) == false {
+			t.Errorf("%s export did not round trip: %+v %+v", format, before, after)
+		}
+	}
+
+	// entries with no access and with a ; or \ in them round trip too
+	awkward := User{UserName: "sensor1", Groups: GroupArray{"sensors"}, ClientIDs: ClientIDArray{`gw;1`, `gw\2`},
+		Topics: TopicArray{{TopicString: "devices/#"}, {TopicString: `odd;topic\`, Pub: true}, {TopicString: "plain/#", Sub: true}}}
+	var exported bytes.Buffer
+	if err := ExportUsers(&exported, []User{awkward}, BulkCSV); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ImportUsers(collection, &exported, BulkCSV, ImportOptions{Update: true, Atomic: true})
+	if err != nil || result.Updated != 1 {
+		t.Fatalf("export with awkward entries not imported: %+v %v", result, err)
+	}
+	after, _ := collection.GetUserByUsername("sensor1")
+	if reflect.DeepEqual(after.Topics, awkward.Topics) == false || reflect.DeepEqual(after.ClientIDs, awkward.ClientIDs) == false {
+		t.Errorf("export with awkward entries did not round trip: %+v", after)
+	}
+}
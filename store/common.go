@@ -2,14 +2,25 @@ package store
 
 import (
 	"authserver/config"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"log"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	pgx "github.com/jackc/pgx/v4/pgxpool"
+	bolt "go.etcd.io/bbolt"
 )
 
 // User Persistence manages the cache and updates to
@@ -18,57 +29,268 @@ type UserPersistence interface {
 	Login(username string, password string, requesttoken bool) (User, error)
 	AddUser(user User) error
 	EditUser(user User) error
+	PutUsers(users []User) error
 	DeleteUser(username string) error
 	GetUserByToken(token string) (User, error)
+	GetUserBySessionID(sessionID string) (User, error)
+	DeleteSession(token string) error
+	DeleteSessionByID(sessionID string) error
+	DeleteUserSessions(username string) error
 	GetUserByUsername(username string) (User, error)
 	GetUsers() []User
 	AddTopicToUser(username string, topic Topic) error
 	EditTopicForUser(username string, topic Topic) error
 	DeleteTopicFromUser(username string, topicString string) error
+	AddClientIDToUser(username string, clientID string) error
+	DeleteClientIDFromUser(username string, clientID string) error
+	GetGroups() []Group
+	GetGroup(name string) (Group, error)
+	AddGroup(group Group) error
+	PutGroups(groups []Group) error
+	DeleteGroup(name string) error
+	AddTopicToGroup(name string, topic Topic) error
+	EditTopicForGroup(name string, topic Topic) error
+	DeleteTopicFromGroup(name string, topicString string) error
+	AddUserToGroup(username string, name string) error
+	RemoveUserFromGroup(username string, name string) error
+	AddAuditEntry(entry AuditEntry) error
+	GetAuditEntries(filter AuditFilter) ([]AuditEntry, int, error)
 }
 
 func NewStorage(storageType string) UserPersistence {
 	switch storageType {
 	case "json":
-		return InitJSON(config.Config.GetStorageFileName())
+		collection := InitJSON(config.Config.GetStorageFileName(), config.Config.GetGroupsFileName(), config.Config.GetSessionsFileName())
+		collection.Backups = config.Config.GetJSONBackups()
+		collection.AuditFname = config.Config.GetAuditFileName()
+		collection.WatchFile()
+		return collection
 	case "postgres":
 		return InitPostgres(config.Config.GetConnString())
+	case "sqlite":
+		return InitSQLite(config.Config.GetSQLiteFileName())
+	case "bolt":
+		return InitBolt(config.Config.GetBoltFileName())
 	default:
-		return InitJSON(config.Config.GetStorageFileName())
+		return InitJSON(config.Config.GetStorageFileName(), config.Config.GetGroupsFileName(), config.Config.GetSessionsFileName())
 	}
 }
 
 type UserJSONCollection struct {
-	Users []User
+	Users    []User
+	Groups   []Group
+	Sessions []Session
 	sync.RWMutex
 	Fname string
+	// usernames and tokenHashes index Users and Sessions, they are kept up to date under the lock
+	usernames     map[string]int
+	tokenHashes   map[string]int
+	GroupsFname   string
+	SessionsFname string
+	// savedHash is the sha256 of the users file as last loaded or saved, to tell hmqauth's own changes
+	// to the file from those made by something else
+	savedHash atomic.Value
+	// Backups is how many backups are kept of each file when it is saved
+	Backups int
+	// AuditFname is the audit trail, a JSON Lines file that is only ever appended to
+	AuditFname string
+	// auditLock orders the appends to the audit trail, auditNext is the id of the next entry or 0 if not known yet
+	auditLock sync.Mutex
+	auditNext int64
 }
 
 var UsersJSON UserJSONCollection
 
 type UserPostgresCollection struct {
-	Users []User
+	Users  []User
+	Groups []Group
 	sync.RWMutex
-	DB    *pgx.Pool
-	DBerr error
+	// usernames indexes Users, it is kept up to date under the lock
+	usernames map[string]int
+	DB        *pgx.Pool
+	DBerr     error
+	// instance tells the changes this instance announces from those of other instances sharing the db
+	instance string
 }
 
 var UsersPostgres UserPostgresCollection
 
+// UserSQLiteCollection keeps the users and groups in a sqlite database file, with a copy of them in memory
+// like the postgres store. Sessions are only kept in the db
+type UserSQLiteCollection struct {
+	Users  []User
+	Groups []Group
+	sync.RWMutex
+	// usernames indexes Users, it is kept up to date under the lock
+	usernames map[string]int
+	DB        *sql.DB
+	DBerr     error
+}
+
+var UsersSQLite UserSQLiteCollection
+
+// UserBoltCollection keeps the users and groups in a bolt key-value file, with a copy of them in memory.
+// Sessions are only kept in the db
+type UserBoltCollection struct {
+	Users  []User
+	Groups []Group
+	sync.RWMutex
+	// usernames indexes Users, it is kept up to date under the lock
+	usernames map[string]int
+	DB        *bolt.DB
+	DBerr     error
+}
+
+var UsersBolt UserBoltCollection
+
 type User struct {
-	UserName string     `json:"username"`
-	Password string     `json:"password"`
-	Admin    bool       `json:"admin"`
-	CreateTS string     `json:"createTS"`
-	UpdateTS string     `json:"updateTS"`
-	Token    string     `json:"token"`
-	Topics   TopicArray `json:"topics"`
+	UserName  string        `json:"username"`
+	Password  string        `json:"password"`
+	Admin     bool          `json:"admin"`
+	SuperUser bool          `json:"superuser"`
+	CreateTS  string        `json:"createTS"`
+	UpdateTS  string        `json:"updateTS"`
+	Token     string        `json:"token,omitempty"`
+	Topics    TopicArray    `json:"topics"`
+	ClientIDs ClientIDArray `json:"clientids"`
+	Groups    GroupArray    `json:"groups"`
+	// topicIndex is the trie of the user's topics, see IndexTopics
+	topicIndex *topicTrie
+}
+
+// Group is a named set of topic permissions, every user in the group inherits them
+type Group struct {
+	Name   string     `json:"name"`
+	Topics TopicArray `json:"topics"`
+	// topicIndex is the trie of the group's topics, see IndexTopics
+	topicIndex *topicTrie
+}
+
+// IndexTopics builds the trie CheckTopicAuth uses to find the user's matching topics, it has to be called
+// again whenever the topics change. Without it the topics are checked one by one
+func (me *User) IndexTopics() {
+	me.topicIndex = newTopicTrie(me.Topics)
+}
+
+// IndexTopics builds the trie CheckTopicAuth uses to find the group's matching topics, it has to be called
+// again whenever the topics change. Without it the topics are checked one by one
+func (me *Group) IndexTopics() {
+	me.topicIndex = newTopicTrie(me.Topics)
+}
+
+// Session is a logged in session on the management portal, a user can have several sessions at once
+// Only a keyed hash of the session token is kept (see hashToken), the token itself is handed to the user
+// when they log in and never stored
+type Session struct {
+	TokenHash string    `json:"tokenhash"`
+	UserName  string    `json:"username"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// sessionRenewalInterval is how far a session's expiry has to move before the renewal is saved,
+// so that a busy session does not write to the store on every request
+const sessionRenewalInterval = time.Minute
+
+// newSession creates a session with a random token for a user, it expires after the configured session timeout
+// The token is returned separately as the session only holds its hash
+func newSession(username string) (Session, string, error) {
+	var session Session
+	tokenBytes := make([]byte, 32)
+	_, randError := rand.Read(tokenBytes)
+	if randError != nil {
+		log.Println("Cannot create session token", randError)
+		return session, "", errors.New("Cannot create session token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	now := time.Now()
+	session.TokenHash = hashToken(token)
+	session.UserName = username
+	session.Created = now
+	session.Expires = now.Add(config.Config.GetSessionTimeout())
+	return session, token, nil
+}
+
+// legacySession creates a session for a token that was stored in plain text before tokens were hashed
+func legacySession(username string, token string) Session {
+	now := time.Now()
+	return Session{
+		TokenHash: hashToken(token),
+		UserName:  username,
+		Created:   now,
+		Expires:   now.Add(config.Config.GetSessionTimeout()),
+	}
+}
+
+var tokenKey []byte
+var tokenKeyOnce sync.Once
+
+// hashToken returns the HMAC-SHA256 of a session token, keyed with the TokenHashKey from the configuration
+// so that the stored hashes are of no use without the key
+func hashToken(token string) string {
+	tokenKeyOnce.Do(func() {
+		tokenKey = []byte(config.Config.GetTokenHashKey())
+		if len(tokenKey) == 0 {
+			log.Println("No TokenHashKey configured, using a random key - sessions will not survive a restart")
+			tokenKey = make([]byte, 32)
+			rand.Read(tokenKey)
+		}
+	})
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SessionID returns the id of the session a token belongs to, the keyed hash the session is stored under.
+// Unlike the token it is no secret: it cannot be turned back into the token, and looking a session up by
+// it is only done for ids taken from a signed JWT
+func SessionID(token string) string {
+	return hashToken(token)
+}
+
+// tokenHashMatch compares two token hashes in constant time
+func tokenHashMatch(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Expired checks whether the session has passed its expiry time
+func (me Session) Expired(now time.Time) bool {
+	return now.After(me.Expires)
 }
 
+// renew slides the expiry of the session on from now, it returns true if the change is worth saving
+func (me *Session) renew(now time.Time) bool {
+	expires := now.Add(config.Config.GetSessionTimeout())
+	if expires.Sub(me.Expires) < sessionRenewalInterval {
+		return false
+	}
+	me.Expires = expires
+	return true
+}
+
+// Topic is a permission on a topic filter. An allow entry grants the pub and/or sub rights flagged,
+// a deny entry (Deny set) takes away the pub and/or sub rights flagged - see CheckTopicAuth for how
+// overlapping entries are resolved
 type Topic struct {
 	TopicString string `json:"topicstring"`
 	Pub         bool   `json:"pub"`
 	Sub         bool   `json:"sub"`
+	Deny        bool   `json:"deny"`
+}
+
+// String writes the entry as the topic, a ":" and its access joined by "+", such as devices/%u/#:pub+sub
+func (me Topic) String() string {
+	var access []string
+	if me.Pub {
+		access = append(access, "pub")
+	}
+	if me.Sub {
+		access = append(access, "sub")
+	}
+	if me.Deny {
+		access = append(access, "deny")
+	}
+	return me.TopicString + ":" + strings.Join(access, "+")
 }
 
 type TopicArray []Topic
@@ -99,41 +321,502 @@ func (me TopicArray) Value() (driver.Value, error) {
 	return nullString.Value()
 }
 
+// ClientIDArray holds the client ids, or client id patterns, a user is allowed to connect with
+type ClientIDArray []string
+
+// Scan implements the sql.Scanner interface
+func (me *ClientIDArray) Scan(value interface{}) error {
+	var i sql.NullString
+	if err := i.Scan(value); err != nil {
+		return err
+	}
+	if i.Valid == false {
+		return nil
+	}
+	return json.Unmarshal([]byte(i.String), &me)
+}
+
+// Value implements the driver.Valuer interface
+func (me ClientIDArray) Value() (driver.Value, error) {
+	var nullString sql.NullString
+	if me != nil {
+		clientIDBytes, err := json.Marshal(me)
+		if err != nil {
+			return nil, err
+		}
+		nullString.Valid = true
+		nullString.String = string(clientIDBytes)
+	}
+	return nullString.Value()
+}
+
+// GroupArray holds the names of the groups a user belongs to
+type GroupArray []string
+
+// Scan implements the sql.Scanner interface
+func (me *GroupArray) Scan(value interface{}) error {
+	var i sql.NullString
+	if err := i.Scan(value); err != nil {
+		return err
+	}
+	if i.Valid == false {
+		return nil
+	}
+	return json.Unmarshal([]byte(i.String), &me)
+}
+
+// Value implements the driver.Valuer interface
+func (me GroupArray) Value() (driver.Value, error) {
+	var nullString sql.NullString
+	if me != nil {
+		groupBytes, err := json.Marshal(me)
+		if err != nil {
+			return nil, err
+		}
+		nullString.Valid = true
+		nullString.String = string(groupBytes)
+	}
+	return nullString.Value()
+}
+
+// InGroup checks whether the user belongs to the named group
+func (me User) InGroup(name string) bool {
+	for _, v := range me.Groups {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeGroupName returns a copy of a list of group names without the named group
+func removeGroupName(groups GroupArray, name string) GroupArray {
+	var remaining GroupArray
+	for _, v := range groups {
+		if v != name {
+			remaining = append(remaining, v)
+		}
+	}
+	return remaining
+}
+
+// indexUsers maps the usernames of a store's users to their position in its Users
+func indexUsers(users []User) map[string]int {
+	index := make(map[string]int, len(users))
+	for k, v := range users {
+		index[v.UserName] = k
+	}
+	return index
+}
+
+// indexSessions maps the token hashes of a store's sessions to their position in its Sessions
+func indexSessions(sessions []Session) map[string]int {
+	index := make(map[string]int, len(sessions))
+	for k, v := range sessions {
+		index[v.TokenHash] = k
+	}
+	return index
+}
+
+// changeListeners are the functions told about changes to users, see OnUserChange
+var changeListeners struct {
+	listeners []func(username string)
+	sync.RWMutex
+}
+
+// OnUserChange registers a function to be called whenever a user is added, edited or deleted, or has their
+// topics, client ids or groups changed. The username is blank when a change can affect every user, as when
+// a group is changed or the store is loaded
+func OnUserChange(listener func(username string)) {
+	changeListeners.Lock()
+	defer changeListeners.Unlock()
+	changeListeners.listeners = append(changeListeners.listeners, listener)
+}
+
+// notifyUserChange tells the registered listeners that a user has changed
+func notifyUserChange(username string) {
+	changeListeners.RLock()
+	defer changeListeners.RUnlock()
+	for _, listener := range changeListeners.listeners {
+		listener(username)
+	}
+}
+
+// GetGroupsForUser returns the groups a user belongs to from the store, ready to pass to CheckTopicAuth
+func GetGroupsForUser(store UserPersistence, user User) []Group {
+	var groups []Group
+	for _, v := range user.Groups {
+		group, getGroupError := store.GetGroup(v)
+		if getGroupError != nil {
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// CheckClientID checks whether the user is allowed to connect with the given client id
+// A user without any client id rules may connect with any client id
+func (me User) CheckClientID(clientID string) bool {
+	if len(me.ClientIDs) == 0 {
+		return true
+	}
+	for _, v := range me.ClientIDs {
+		if clientIDMatch(clientID, v) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIDMatch compares a client id against an allowed client id rule. In the rule a * matches any
+// run of characters (including none) and a ? matches exactly one character, everything else must match exactly
+func clientIDMatch(clientID string, pattern string) bool {
+	id := []rune(clientID)
+	pat := []rune(pattern)
+
+	idPos, patPos := 0, 0
+	// position of the last * seen in the pattern and the client id position it was tried against
+	starPos, starMatch := -1, 0
+	for idPos < len(id) {
+		if patPos < len(pat) && (pat[patPos] == '?' || pat[patPos] == id[idPos]) {
+			idPos++
+			patPos++
+			continue
+		}
+		if patPos < len(pat) && pat[patPos] == '*' {
+			starPos = patPos
+			starMatch = idPos
+			patPos++
+			continue
+		}
+		if starPos >= 0 {
+			// let the last * swallow one more character and try again
+			starMatch++
+			idPos = starMatch
+			patPos = starPos + 1
+			continue
+		}
+		return false
+	}
+	for patPos < len(pat) && pat[patPos] == '*' {
+		patPos++
+	}
+	return patPos == len(pat)
+}
+
 // CheckTopicAuthSub checks to see whether the user has Sub rights on a topic
-func (me User) CheckTopicAuthSub(topic string) (bool, error) {
-	_, sub, err := me.CheckTopicAuth(topic)
+func (me User) CheckTopicAuthSub(topic string, clientID string, groups []Group) (bool, error) {
+	_, sub, err := me.CheckTopicAuth(topic, clientID, groups)
 	return sub, err
 }
 
 // CheckTopicAuthPub checks to see whether the user has Pub rights on a topic
-func (me User) CheckTopicAuthPub(topic string) (bool, error) {
-	pub, _, err := me.CheckTopicAuth(topic)
+func (me User) CheckTopicAuthPub(topic string, clientID string, groups []Group) (bool, error) {
+	pub, _, err := me.CheckTopicAuth(topic, clientID, groups)
 	return pub, err
 }
 
 // CheckTopicAuth returns 2 boolean values, one showing whether the user has pub rights on a topic, the second
-// showing whether the user has sub rights on the topic
-func (me User) CheckTopicAuth(topic string) (pub bool, sub bool, err error) {
-	pub = false
-	sub = false
+// showing whether the user has sub rights on the topic. Superusers have both rights on every topic
+// The client id is used to expand any %c placeholders in the user's permitted topics, %u expands to the username
+// The topics of the groups passed in (see GetGroupsForUser) are evaluated along with the user's own topics
+//
+// Pub and sub are resolved separately. Of the matching entries that flag the access being resolved, the entry
+// with the most specific topic filter wins (see compareTopicSpecificity), and if an allow and a deny entry are
+// equally specific the deny wins. Whether an entry belongs to the user or to a group makes no difference.
+// If no entry flags the access it is not granted. An error is returned if no entry matches the topic at all
+func (me User) CheckTopicAuth(topic string, clientID string, groups []Group) (pub bool, sub bool, err error) {
+	if me.SuperUser {
+		return true, true, nil
+	}
+	pubRule, subRule, err := me.TopicAuthRules(topic, clientID, groups)
+	pub = pubRule != nil && pubRule.Deny == false
+	sub = subRule != nil && subRule.Deny == false
+	return
+}
+
+// TopicAuthRules returns the entries CheckTopicAuth settles the pub and the sub rights on a topic with, either
+// is nil if no matching entry flags that access. An error is returned if no entry matches the topic at all
+func (me User) TopicAuthRules(topic string, clientID string, groups []Group) (pubRule *Topic, subRule *Topic, err error) {
+	var pubMatch, subMatch *topicRuleMatch
 	matched := false
-	for _, v := range me.Topics {
-		if topicMatch(topic, v.TopicString) == true {
-			matched = true
-			if v.Pub == true {
-				pub = true
+	found := func(v Topic) {
+		// the placeholders of a matching entry are known to expand
+		permittedTopic, _ := expandTopicPlaceholders(v.TopicString, me.UserName, clientID)
+		matched = true
+		thisRule := &topicRuleMatch{Topic: v, Filter: permittedTopic}
+		if v.Pub == true {
+			pubMatch = strongerTopicRule(pubMatch, thisRule)
+		}
+		if v.Sub == true {
+			subMatch = strongerTopicRule(subMatch, thisRule)
+		}
+	}
+	checkTopics := func(topics TopicArray, index *topicTrie) {
+		if index.indexes(topics) {
+			index.match(topic, me.UserName, clientID, found)
+			return
+		}
+		for _, v := range topics {
+			permittedTopic, expanded := expandTopicPlaceholders(v.TopicString, me.UserName, clientID)
+			if expanded == false {
+				continue
 			}
-			if v.Sub == true {
-				sub = true
+			if topicMatch(topic, permittedTopic) == true {
+				found(v)
 			}
 		}
 	}
+	checkTopics(me.Topics, me.topicIndex)
+	for _, group := range groups {
+		checkTopics(group.Topics, group.topicIndex)
+	}
 	if !matched {
 		err = errors.New("Topic not found")
 	}
+	if pubMatch != nil {
+		pubRule = &pubMatch.Topic
+	}
+	if subMatch != nil {
+		subRule = &subMatch.Topic
+	}
+	return
+}
+
+// WildcardMatch is a wildcard of a topic filter along with the levels of the topic it matched
+type WildcardMatch struct {
+	Level    int    `json:"level"` // the level of the wildcard in the filter, counted from 1
+	Wildcard string `json:"wildcard"`
+	Matched  string `json:"matched"`
+}
+
+// TopicRuleExplanation is a topic entry as evaluated by ExplainTopicAuth
+type TopicRuleExplanation struct {
+	Topic      Topic           `json:"topic"`
+	Group      string          `json:"group,omitempty"` // the group the entry belongs to, blank for the user's own
+	Filter     string          `json:"filter"`          // the entry with its placeholders expanded
+	Matched    bool            `json:"matched"`
+	Wildcards  []WildcardMatch `json:"wildcards,omitempty"`
+	Reason     string          `json:"reason,omitempty"` // why the entry does not match
+	DecidesPub bool            `json:"decidespub"`
+	DecidesSub bool            `json:"decidessub"`
+}
+
+// TopicAuthExplanation is how CheckTopicAuth reaches its result, as returned by ExplainTopicAuth
+type TopicAuthExplanation struct {
+	Topic     string                 `json:"topic"`
+	SuperUser bool                   `json:"superuser"`
+	Rules     []TopicRuleExplanation `json:"rules"`
+	Pub       bool                   `json:"pub"`
+	Sub       bool                   `json:"sub"`
+	PubReason string                 `json:"pubreason"`
+	SubReason string                 `json:"subreason"`
+}
+
+// ExplainTopicAuth works through CheckTopicAuth step by step. It lists every topic entry of the user and of
+// their groups, whether each matches the topic and through which wildcards, and which entry settled the pub
+// and the sub rights and why. It comes to the same result as CheckTopicAuth but is slower, as it evaluates
+// every entry rather than the few the topic index leads to
+func (me User) ExplainTopicAuth(topic string, clientID string, groups []Group) TopicAuthExplanation {
+	explanation := TopicAuthExplanation{Topic: topic, SuperUser: me.SuperUser, Rules: []TopicRuleExplanation{}}
+	if me.SuperUser {
+		explanation.Pub, explanation.Sub = true, true
+		explanation.PubReason = "Superusers are not subject to topic permissions"
+		explanation.SubReason = explanation.PubReason
+		return explanation
+	}
+	explainTopics := func(topics TopicArray, group string) {
+		for _, v := range topics {
+			rule := TopicRuleExplanation{Topic: v, Group: group}
+			permittedTopic, expanded := expandTopicPlaceholders(v.TopicString, me.UserName, clientID)
+			if expanded == false {
+				rule.Reason = "The placeholders cannot be expanded with this username and client id"
+			} else {
+				rule.Filter = permittedTopic
+				rule.Matched, rule.Wildcards, rule.Reason = explainTopicMatch(topic, permittedTopic)
+			}
+			explanation.Rules = append(explanation.Rules, rule)
+		}
+	}
+	explainTopics(me.Topics, "")
+	for _, group := range groups {
+		explainTopics(group.Topics, group.Name)
+	}
+
+	var decidesPub, decidesSub int
+	explanation.Pub, explanation.PubReason, decidesPub = explainAccess(explanation.Rules, "pub", func(v Topic) bool { return v.Pub })
+	explanation.Sub, explanation.SubReason, decidesSub = explainAccess(explanation.Rules, "sub", func(v Topic) bool { return v.Sub })
+	if decidesPub >= 0 {
+		explanation.Rules[decidesPub].DecidesPub = true
+	}
+	if decidesSub >= 0 {
+		explanation.Rules[decidesSub].DecidesSub = true
+	}
+	return explanation
+}
+
+// explainAccess settles one access from the evaluated entries as CheckTopicAuth does, returning whether it
+// is granted, why, and the position of the entry that settled it or -1 if none did
+func explainAccess(rules []TopicRuleExplanation, access string, flags func(Topic) bool) (bool, string, int) {
+	var winner *topicRuleMatch
+	decides, candidates := -1, 0
+	for i, v := range rules {
+		if v.Matched == false || flags(v.Topic) == false {
+			continue
+		}
+		candidates++
+		thisRule := &topicRuleMatch{Topic: v.Topic, Filter: v.Filter}
+		if stronger := strongerTopicRule(winner, thisRule); stronger == thisRule {
+			winner, decides = thisRule, i
+		}
+	}
+	if winner == nil {
+		return false, "No matching entry has " + access + ", so it is not granted", -1
+	}
+
+	entry := winner.Topic.String()
+	if rules[decides].Group != "" {
+		entry += " of group " + rules[decides].Group
+	}
+	reason := entry + " is the only matching entry with " + access
+	if candidates > 1 {
+		reason = entry + " is the most specific of the " + strconv.Itoa(candidates) + " matching entries with " + access
+		for _, v := range rules {
+			if v.Matched && flags(v.Topic) && v.Topic.Deny == false && winner.Topic.Deny &&
+				compareTopicSpecificity(v.Filter, winner.Filter) == 0 {
+				reason += ", and a deny beats an equally specific allow"
+				break
+			}
+		}
+	}
+	if winner.Topic.Deny {
+		return false, reason + ", so it is denied", decides
+	}
+	return true, reason + ", so it is granted", decides
+}
+
+// topicRuleMatch is a topic entry that matched a topic, along with the filter it expanded to
+type topicRuleMatch struct {
+	Topic  Topic
+	Filter string
+}
+
+// strongerTopicRule returns whichever of two matching entries takes precedence
+func strongerTopicRule(current *topicRuleMatch, candidate *topicRuleMatch) *topicRuleMatch {
+	if current == nil {
+		return candidate
+	}
+	specificity := compareTopicSpecificity(candidate.Filter, current.Filter)
+	if specificity > 0 {
+		return candidate
+	}
+	if specificity == 0 && candidate.Topic.Deny == true && current.Topic.Deny == false {
+		return candidate
+	}
+	return current
+}
+
+// compareTopicSpecificity returns a positive number if topic filter a is more specific than b, a negative
+// number if b is more specific and 0 if they are equally specific. The filter with more literal (non wildcard)
+// levels is more specific, then the one with more levels, then a filter without a # beats one with a #
+// so plant/secrets/# beats plant/#, plant/+/temp beats plant/secrets/# and plant/+ beats plant/#
+func compareTopicSpecificity(a string, b string) int {
+	aLiterals, aLevels, aHash := topicSpecificity(a)
+	bLiterals, bLevels, bHash := topicSpecificity(b)
+	if aLiterals != bLiterals {
+		return aLiterals - bLiterals
+	}
+	if aLevels != bLevels {
+		return aLevels - bLevels
+	}
+	if aHash != bHash {
+		if aHash {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// topicSpecificity counts the literal levels and the total levels of a topic filter, and reports whether it ends in #
+func topicSpecificity(filter string) (literals int, levels int, hash bool) {
+	filter = strings.TrimSuffix(filter, "/")
+	for _, level := range strings.Split(filter, "/") {
+		levels++
+		switch level {
+		case "#":
+			hash = true
+		case "+":
+		default:
+			literals++
+		}
+	}
 	return
 }
 
+// expandTopicPlaceholders replaces %u with the username and %c with the client id in a permitted topic
+// so that one permission such as devices/%u/# can cover a whole fleet of devices.
+// It returns false if the permission cannot apply, that is if the value to substitute is blank or
+// contains a character with a meaning in a topic filter (/, + or #) - otherwise a username such as "#"
+// would be granted far more than its own branch of the topic tree
+func expandTopicPlaceholders(permittedTopic string, username string, clientID string) (string, bool) {
+	if strings.Index(permittedTopic, "%") < 0 {
+		return permittedTopic, true
+	}
+	if strings.Contains(permittedTopic, "%u") && validPlaceholderValue(username) == false {
+		return "", false
+	}
+	if strings.Contains(permittedTopic, "%c") && validPlaceholderValue(clientID) == false {
+		return "", false
+	}
+	replacer := strings.NewReplacer("%u", username, "%c", clientID)
+	return replacer.Replace(permittedTopic), true
+}
+
+// validPlaceholderValue checks a username or client id can safely be substituted into a topic filter
+func validPlaceholderValue(value string) bool {
+	return value != "" && strings.ContainsAny(value, "/+#") == false
+}
+
+// explainTopicMatch compares a topic with a topic filter as topicMatch does, returning whether they match,
+// the wildcards of the filter that matched levels of the topic and, if they do not match, why not
+func explainTopicMatch(topic string, permittedTopic string) (bool, []WildcardMatch, string) {
+	topic = strings.TrimSuffix(topic, "/")
+	permittedTopic = strings.TrimSuffix(permittedTopic, "/")
+	if topic == permittedTopic {
+		return true, nil, ""
+	}
+	if permittedTopic == "#" {
+		return true, []WildcardMatch{{Level: 1, Wildcard: "#", Matched: topic}}, ""
+	}
+
+	topicLevels := strings.Split(topic, "/")
+	filterLevels := strings.Split(permittedTopic, "/")
+	var wildcards []WildcardMatch
+	for i, level := range topicLevels {
+		if i >= len(filterLevels) {
+			return false, nil, "The topic has more levels than the filter"
+		}
+		switch filterLevels[i] {
+		case "":
+			return false, nil, "Level " + strconv.Itoa(i+1) + " of the filter is empty"
+		case "#":
+			wildcards = append(wildcards, WildcardMatch{Level: i + 1, Wildcard: "#", Matched: strings.Join(topicLevels[i:], "/")})
+			return true, wildcards, ""
+		case "+":
+			wildcards = append(wildcards, WildcardMatch{Level: i + 1, Wildcard: "+", Matched: level})
+		case level:
+		default:
+			return false, nil, "Level " + strconv.Itoa(i+1) + " of the topic is " + level + " rather than " + filterLevels[i]
+		}
+	}
+	if len(filterLevels) > len(topicLevels) {
+		return false, nil, "The topic has fewer levels than the filter"
+	}
+	return true, wildcards, ""
+}
+
 // topicMatch compares two topics, and returns a true if they are related (one is part of the other)
 func topicMatch(SetStoreHandler string, permittedTopic string) bool {
 	// For safety we remove any trailing forward slash - as this isn't
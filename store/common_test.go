@@ -0,0 +1,329 @@
+package store
+
+import "testing"
+
+func TestCheckTopicAuthOverlappingRules(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		topics  TopicArray
+		topic   string
+		wantPub bool
+		wantSub bool
+		wantErr bool
+	}{
+		{
+			name:    "no rules",
+			topics:  nil,
+			topic:   "plant/line1",
+			wantErr: true,
+		},
+		{
+			name:    "allow rules are combined",
+			topics:  TopicArray{{TopicString: "plant/#", Pub: true}, {TopicString: "plant/+", Sub: true}},
+			topic:   "plant/line1",
+			wantPub: true,
+			wantSub: true,
+		},
+		{
+			name:    "more specific deny beats a wider allow",
+			topics:  TopicArray{{TopicString: "plant/#", Pub: true, Sub: true}, {TopicString: "plant/secrets/#", Pub: true, Sub: true, Deny: true}},
+			topic:   "plant/secrets/key",
+			wantPub: false,
+			wantSub: false,
+		},
+		{
+			name:    "wider allow still applies outside the deny",
+			topics:  TopicArray{{TopicString: "plant/#", Pub: true, Sub: true}, {TopicString: "plant/secrets/#", Pub: true, Sub: true, Deny: true}},
+			topic:   "plant/line1/temp",
+			wantPub: true,
+			wantSub: true,
+		},
+		{
+			name:    "deny only applies to the access it flags",
+			topics:  TopicArray{{TopicString: "plant/#", Pub: true, Sub: true}, {TopicString: "plant/secrets/#", Pub: true, Deny: true}},
+			topic:   "plant/secrets/key",
+			wantPub: false,
+			wantSub: true,
+		},
+		{
+			name:    "more specific allow beats a wider deny",
+			topics:  TopicArray{{TopicString: "plant/#", Sub: true, Deny: true}, {TopicString: "plant/public/#", Sub: true}},
+			topic:   "plant/public/news",
+			wantSub: true,
+		},
+		{
+			name:    "literal level beats a + level",
+			topics:  TopicArray{{TopicString: "plant/+/temp", Pub: true, Deny: true}, {TopicString: "plant/line1/temp", Pub: true}},
+			topic:   "plant/line1/temp",
+			wantPub: true,
+		},
+		{
+			name:    "+ beats # with the same literals",
+			topics:  TopicArray{{TopicString: "plant/#", Pub: true}, {TopicString: "plant/+", Pub: true, Deny: true}},
+			topic:   "plant/line1",
+			wantPub: false,
+		},
+		{
+			name:    "deny wins a tie",
+			topics:  TopicArray{{TopicString: "plant/+/temp", Pub: true}, {TopicString: "plant/line1/+", Pub: true, Deny: true}},
+			topic:   "plant/line1/temp",
+			wantPub: false,
+		},
+		{
+			name:    "deny wins a tie whatever the order",
+			topics:  TopicArray{{TopicString: "plant/line1/+", Pub: true, Deny: true}, {TopicString: "plant/+/temp", Pub: true}},
+			topic:   "plant/line1/temp",
+			wantPub: false,
+		},
+		{
+			name:    "only a deny matches",
+			topics:  TopicArray{{TopicString: "plant/secrets/#", Pub: true, Sub: true, Deny: true}},
+			topic:   "plant/secrets/key",
+			wantPub: false,
+			wantSub: false,
+		},
+		{
+			name:    "placeholder rules are ranked after expansion",
+			topics:  TopicArray{{TopicString: "devices/#", Sub: true, Deny: true}, {TopicString: "devices/%u/#", Pub: true, Sub: true}},
+			topic:   "devices/sensor42/temp",
+			wantPub: true,
+			wantSub: true,
+		},
+		{
+			name:    "placeholder rules do not match other users",
+			topics:  TopicArray{{TopicString: "devices/#", Sub: true, Deny: true}, {TopicString: "devices/%u/#", Pub: true, Sub: true}},
+			topic:   "devices/sensor43/temp",
+			wantPub: false,
+			wantSub: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{UserName: "sensor42", Topics: tt.topics}
+			pub, sub, err := user.CheckTopicAuth(tt.topic, "client1", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckTopicAuth(%q) error = %v, wantErr %v", tt.topic, err, tt.wantErr)
+			}
+			if pub != tt.wantPub || sub != tt.wantSub {
+				t.Errorf("CheckTopicAuth(%q) = pub %v sub %v, want pub %v sub %v", tt.topic, pub, sub, tt.wantPub, tt.wantSub)
+			}
+		})
+	}
+}
+
+func TestCompareTopicSpecificity(t *testing.T) {
+
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"plant/secrets/#", "plant/#", 1},
+		{"plant/#", "plant/secrets/#", -1},
+		{"plant/+/temp", "plant/secrets/#", 1},
+		{"plant/+", "plant/#", 1},
+		{"plant/line1/+", "plant/+/temp", 0},
+		{"plant/", "plant", 0},
+		{"#", "+", -1},
+	}
+
+	for _, tt := range tests {
+		got := compareTopicSpecificity(tt.a, tt.b)
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("compareTopicSpecificity(%q, %q) = %v, want sign of %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestClientIDMatch(t *testing.T) {
+
+	tests := []struct {
+		clientID string
+		pattern  string
+		want     bool
+	}{
+		{"", "", true},
+		{"sensor1", "", false},
+		{"", "sensor1", false},
+		{"", "*", true},
+		{"", "?", false},
+		{"sensor1", "*", true},
+		{"sensor1", "sensor1", true},
+		{"sensor1", "sensor2", false},
+		{"sensor1", "Sensor1", false},
+		{"sensor1", "sensor", false},
+		{"sensor", "sensor1", false},
+		{"sensor1-a", "sensor1-*", true},
+		{"sensor1-", "sensor1-*", true},
+		{"sensor2-a", "sensor1-*", false},
+		{"gw-sensor1", "*-sensor1", true},
+		{"gw-sensor1x", "*-sensor1", false},
+		{"sensor1", "sensor**", true},
+		{"sensor1", "**sensor1**", true},
+		{"sensor1", "s*?*1", true},
+		{"s1", "s*?*1", false},
+		{"sensor1", "sensor?", true},
+		{"sensor12", "sensor?", false},
+		{"sensor", "sensor?", false},
+		{"capteur-é", "capteur-?", true},
+		{"capteur-日本", "capteur-??", true},
+		{"capteur-日本", "capteur-?", false},
+		{"日本-1", "?本-*", true},
+		{"aXbYbZc", "a*b*c", true},
+		{"aXbYbZ", "a*b*c", false},
+		{"abc", "a*b*c", true},
+		{"aXcYc", "a*b*c", false},
+		{"abababc", "*ab*abc", true},
+		{"ababab", "*ab*abc", false},
+	}
+
+	for _, tt := range tests {
+		if got := clientIDMatch(tt.clientID, tt.pattern); got != tt.want {
+			t.Errorf("clientIDMatch(%q, %q) = %v, want %v", tt.clientID, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestCheckClientID(t *testing.T) {
+
+	anyClient := User{UserName: "Gaz"}
+	for _, clientID := range []string{"", "sensor1", "*"} {
+		if anyClient.CheckClientID(clientID) == false {
+			t.Errorf("user without client id rules refused client id %q", clientID)
+		}
+	}
+
+	bound := User{UserName: "Gaz", ClientIDs: ClientIDArray{"sensor1-*", "gw-??"}}
+	tests := []struct {
+		clientID string
+		want     bool
+	}{
+		{"sensor1-a", true},
+		{"gw-01", true},
+		{"gw-001", false},
+		{"sensor2-a", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := bound.CheckClientID(tt.clientID); got != tt.want {
+			t.Errorf("CheckClientID(%q) = %v, want %v", tt.clientID, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTopicAuthWithGroups(t *testing.T) {
+
+	groups := []Group{
+		{Name: "sensors", Topics: TopicArray{{TopicString: "devices/%u/#", Pub: true, Sub: true}, {TopicString: "alerts/#", Sub: true}}},
+		{Name: "restricted", Topics: TopicArray{{TopicString: "alerts/internal/#", Sub: true, Deny: true}}},
+	}
+	user := User{UserName: "sensor42", Groups: GroupArray{"sensors", "restricted"}, Topics: TopicArray{{TopicString: "config/sensor42", Sub: true}}}
+
+	tests := []struct {
+		topic   string
+		wantPub bool
+		wantSub bool
+		wantErr bool
+	}{
+		{topic: "config/sensor42", wantSub: true},
+		{topic: "devices/sensor42/temp", wantPub: true, wantSub: true},
+		{topic: "devices/sensor43/temp", wantErr: true},
+		{topic: "alerts/fire", wantSub: true},
+		{topic: "alerts/internal/audit", wantSub: false},
+	}
+
+	for _, tt := range tests {
+		pub, sub, err := user.CheckTopicAuth(tt.topic, "client1", groups)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("CheckTopicAuth(%q) error = %v, wantErr %v", tt.topic, err, tt.wantErr)
+		}
+		if pub != tt.wantPub || sub != tt.wantSub {
+			t.Errorf("CheckTopicAuth(%q) = pub %v sub %v, want pub %v sub %v", tt.topic, pub, sub, tt.wantPub, tt.wantSub)
+		}
+	}
+}
+
+func TestTopicAuthRules(t *testing.T) {
+
+	groups := []Group{{Name: "restricted", Topics: TopicArray{{TopicString: "plant/secrets/#", Sub: true, Deny: true}}}}
+	user := User{UserName: "Gaz", Topics: TopicArray{{TopicString: "plant/#", Pub: true, Sub: true}, {TopicString: "plant/+/temp", Sub: true}}}
+
+	pubRule, subRule, err := user.TopicAuthRules("plant/secrets/key", "client1", groups)
+	if err != nil || pubRule == nil || pubRule.String() != "plant/#:pub+sub" || subRule == nil || subRule.String() != "plant/secrets/#:sub+deny" {
+		t.Errorf("TopicAuthRules(plant/secrets/key) = %v %v %v", pubRule, subRule, err)
+	}
+	pubRule, subRule, err = user.TopicAuthRules("plant/line1/temp", "client1", groups)
+	if err != nil || pubRule == nil || pubRule.TopicString != "plant/#" || subRule == nil || subRule.TopicString != "plant/+/temp" {
+		t.Errorf("TopicAuthRules(plant/line1/temp) = %v %v %v", pubRule, subRule, err)
+	}
+	if pubRule, subRule, err = user.TopicAuthRules("office/temp", "client1", groups); err == nil || pubRule != nil || subRule != nil {
+		t.Errorf("TopicAuthRules(office/temp) = %v %v %v", pubRule, subRule, err)
+	}
+}
+
+func TestExplainTopicMatchAgreesWithTopicMatch(t *testing.T) {
+
+	filters := combineLevels([]string{"a", "b", "+", "#", ""}, 3)
+	for _, topic := range combineLevels([]string{"a", "b", "+", "#", ""}, 3) {
+		if topic == "" {
+			continue
+		}
+		for _, filter := range filters {
+			if filter == "" {
+				continue
+			}
+			for _, f := range []string{filter, filter + "/"} {
+				matched, wildcards, reason := explainTopicMatch(topic, f)
+				if matched != topicMatch(topic, f) {
+					t.Fatalf("topic %q filter %q: explained %v, topicMatch %v", topic, f, matched, !matched)
+				}
+				if matched == (reason != "") {
+					t.Errorf("topic %q filter %q: matched %v with reason %q", topic, f, matched, reason)
+				}
+				for _, v := range wildcards {
+					if v.Wildcard != "+" && v.Wildcard != "#" {
+						t.Errorf("topic %q filter %q: unexpected wildcard %+v", topic, f, v)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestExplainTopicAuth(t *testing.T) {
+
+	groups := []Group{{Name: "restricted", Topics: TopicArray{{TopicString: "plant/secrets/#", Sub: true, Deny: true}}}}
+	user := User{UserName: "Gaz", Groups: GroupArray{"restricted"},
+		Topics: TopicArray{{TopicString: "plant/+/%u", Pub: true}, {TopicString: "office/#", Sub: true}, {TopicString: "plant/secrets/#", Sub: true}}}
+
+	explanation := user.ExplainTopicAuth("plant/secrets/Gaz", "client1", groups)
+	pub, sub, _ := user.CheckTopicAuth("plant/secrets/Gaz", "client1", groups)
+	if explanation.Pub != pub || explanation.Sub != sub || len(explanation.Rules) != 4 {
+		t.Fatalf("explanation %+v does not agree with pub %v sub %v", explanation, pub, sub)
+	}
+	rule := explanation.Rules[0]
+	if rule.Matched == false || rule.Filter != "plant/+/Gaz" || len(rule.Wildcards) != 1 || rule.Wildcards[0] != (WildcardMatch{Level: 2, Wildcard: "+", Matched: "secrets"}) ||
+		rule.DecidesPub == false || rule.DecidesSub {
+		t.Errorf("unexpected explanation of the user's entry %+v", rule)
+	}
+	if rule = explanation.Rules[1]; rule.Matched || rule.Reason != "Level 1 of the topic is plant rather than office" {
+		t.Errorf("unexpected explanation of an entry that does not match %+v", rule)
+	}
+	if rule = explanation.Rules[3]; rule.Matched == false || rule.Group != "restricted" || rule.DecidesSub == false ||
+		rule.Wildcards[0] != (WildcardMatch{Level: 3, Wildcard: "#", Matched: "Gaz"}) {
+		t.Errorf("unexpected explanation of the group's entry %+v", rule)
+	}
+	if explanation.SubReason != "plant/secrets/#:sub+deny of group restricted is the most specific of the 2 matching entries with sub, and a deny beats an equally specific allow, so it is denied" {
+		t.Errorf("unexpected sub reason %q", explanation.SubReason)
+	}
+	if explanation.PubReason != "plant/+/%u:pub is the only matching entry with pub, so it is granted" {
+		t.Errorf("unexpected pub reason %q", explanation.PubReason)
+	}
+
+	if explanation = user.ExplainTopicAuth("warehouse/door", "client1", groups); explanation.Pub || explanation.Sub ||
+		explanation.SubReason != "No matching entry has sub, so it is not granted" {
+		t.Errorf("unexpected explanation of a topic no entry matches %+v", explanation)
+	}
+}
@@ -0,0 +1,171 @@
+package store
+
+// This copies the users and groups from one store to another, for example when moving from json files
+// to postgres. The password hashes are copied as they are, so every device keeps its password
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CopyChange is a user or group that differs between the store copied from and the one copied to
+type CopyChange struct {
+	Kind   string // user or group
+	Name   string
+	Action string // add, update, or extra for one that is only in the store copied to and is left alone
+}
+
+// CopyStore copies the groups and then the users, with their password hashes, from one store to another.
+// Users and groups that are the same in both are left alone and those only in the store copied to are
+// kept, so copying again only writes what has changed since. With dryRun nothing is written and the
+// changes that would be made are returned. Sessions are not copied, management users have to log in again.
+// Every user and group added or updated is recorded in the audit trail of the store copied to, with the
+// actor, action, time and source of audit
+func CopyStore(from UserPersistence, to UserPersistence, dryRun bool, audit AuditEntry) ([]CopyChange, error) {
+
+	var changes []CopyChange
+	var entries []AuditEntry
+
+	var groups []Group
+	existingGroups := make(map[string]Group)
+	for _, v := range to.GetGroups() {
+		existingGroups[v.Name] = v
+	}
+	for _, v := range from.GetGroups() {
+		existing, found := existingGroups[v.Name]
+		delete(existingGroups, v.Name)
+		switch {
+		case found == false:
+			changes = append(changes, CopyChange{Kind: "group", Name: v.Name, Action: "add"})
+		case sameTopics(existing.Topics, v.Topics) == false:
+			changes = append(changes, CopyChange{Kind: "group", Name: v.Name, Action: "update"})
+		default:
+			continue
+		}
+		groups = append(groups, v)
+		entries = append(entries, GroupAuditEntry(audit, existing, v))
+	}
+	for k := range existingGroups {
+		changes = append(changes, CopyChange{Kind: "group", Name: k, Action: "extra"})
+	}
+
+	var users []User
+	existingUsers := make(map[string]User)
+	for _, v := range to.GetUsers() {
+		existingUsers[v.UserName] = v
+	}
+	for _, v := range from.GetUsers() {
+		existing, found := existingUsers[v.UserName]
+		delete(existingUsers, v.UserName)
+		switch {
+		case found == false:
+			changes = append(changes, CopyChange{Kind: "user", Name: v.UserName, Action: "add"})
+		case sameUser(existing, v) == false:
+			changes = append(changes, CopyChange{Kind: "user", Name: v.UserName, Action: "update"})
+		default:
+			continue
+		}
+		users = append(users, v)
+		entries = append(entries, UserAuditEntry(audit, existing, v))
+	}
+	for k := range existingUsers {
+		changes = append(changes, CopyChange{Kind: "user", Name: k, Action: "extra"})
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+	if len(groups) > 0 {
+		if err := to.PutGroups(groups); err != nil {
+			return changes, err
+		}
+		addAuditEntries(to, entries[:len(groups)])
+	}
+	if len(users) > 0 {
+		if err := to.PutUsers(users); err != nil {
+			return changes, err
+		}
+		addAuditEntries(to, entries[len(groups):])
+	}
+	return changes, nil
+}
+
+// sameUser checks whether two users have the same password hash, flags, topics, client ids and groups
+func sameUser(a User, b User) bool {
+	return a.UserName == b.UserName && a.Password == b.Password && a.Admin == b.Admin && a.SuperUser == b.SuperUser &&
+		sameTopics(a.Topics, b.Topics) && sameStrings(a.ClientIDs, b.ClientIDs) && sameStrings(a.Groups, b.Groups)
+}
+
+// sameStrings checks whether two lists of strings are the same, in the same order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPutUsers checks the users given to PutUsers, every one needs a username and a password that is
+// already a bcrypt hash
+func checkPutUsers(users []User) error {
+	for _, v := range users {
+		if v.UserName == "" {
+			return errors.New("Username must be non-blank")
+		}
+		if _, err := bcrypt.Cost([]byte(v.Password)); err != nil {
+			return errors.New("Password of " + v.UserName + " is not a bcrypt hash")
+		}
+	}
+	return nil
+}
+
+// checkPutGroups checks the groups given to PutGroups, every one needs a name
+func checkPutGroups(groups []Group) error {
+	for _, v := range groups {
+		if v.Name == "" {
+			return errors.New("Group name must be non-blank")
+		}
+	}
+	return nil
+}
+
+// putUsers adds the users to a store's users in memory or replaces those that are there, keeping the
+// username index up to date. The caller must hold the lock
+func putUsers(existing []User, usernames map[string]int, users []User) []User {
+	for _, v := range users {
+		v.Token = ""
+		v.IndexTopics()
+		if k, found := usernames[v.UserName]; found {
+			existing[k] = v
+			continue
+		}
+		existing = append(existing, v)
+		usernames[v.UserName] = len(existing) - 1
+	}
+	return existing
+}
+
+// putGroups adds the groups to a store's groups in memory or replaces those that are there. The caller
+// must hold the lock
+func putGroups(existing []Group, groups []Group) []Group {
+	for _, v := range groups {
+		v.IndexTopics()
+		found := false
+		for k := range existing {
+			if existing[k].Name == v.Name {
+				existing[k] = v
+				found = true
+				break
+			}
+		}
+		if found == false {
+			existing = append(existing, v)
+		}
+	}
+	return existing
+}
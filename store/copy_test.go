@@ -0,0 +1,122 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCopyStore(t *testing.T) {
+
+	from := newTestJSONCollection(t)
+	if err := from.AddUser(User{UserName: "Gaz", Password: "pw", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.AddUser(User{UserName: "sensor1", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.AddTopicToUser("sensor1", Topic{TopicString: "devices/%u/#", Pub: true, Sub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.AddClientIDToUser("sensor1", "sensor1-*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.AddGroup(Group{Name: "sensors", Topics: TopicArray{{TopicString: "telemetry/%u", Pub: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.AddUserToGroup("sensor1", "sensors"); err != nil {
+		t.Fatal(err)
+	}
+
+	to := openTestBolt(t, filepath.Join(t.TempDir(), "users.bolt"))
+	if err := to.AddUser(User{UserName: "other", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+
+	audit := AuditEntry{Time: time.Now(), Actor: "copy-store command", Action: "copystore"}
+	changes, err := CopyStore(from, to, true, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 || len(to.GetUsers()) != 1 || len(to.GetGroups()) != 0 {
+		t.Errorf("dry run wrote to the store or missed changes: %+v", changes)
+	}
+	if _, total, _ := to.GetAuditEntries(AuditFilter{}); total != 0 {
+		t.Errorf("dry run recorded %d audit entries", total)
+	}
+
+	if _, err := CopyStore(from, to, false, audit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := to.Login("sensor1", "secret", false); err != nil {
+		t.Errorf("password not copied: %v", err)
+	}
+	if _, err := to.Login("other", "pw", false); err != nil {
+		t.Errorf("user only in the store copied to not kept: %v", err)
+	}
+	for _, v := range from.GetUsers() {
+		copied, err := to.GetUserByUsername(v.UserName)
+		if err != nil || sameUser(v, copied) == false {
+			t.Errorf("user %s not copied as it was: %+v", v.UserName, copied)
+		}
+	}
+	user, _ := to.GetUserByUsername("sensor1")
+	if pub, _, _ := user.CheckTopicAuth("telemetry/sensor1", "sensor1-a", GetGroupsForUser(to, user)); pub == false {
+		t.Errorf("group topics not copied")
+	}
+
+	// copying again has nothing left to do but the changes made since
+	if err := from.EditUser(User{UserName: "Gaz", Admin: false}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = CopyStore(from, to, false, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CopyChange{{Kind: "user", Name: "Gaz", Action: "update"}, {Kind: "user", Name: "other", Action: "extra"}}
+	if reflect.DeepEqual(changes, want) == false {
+		t.Errorf("unexpected changes copying again: %+v", changes)
+	}
+	if user, _ := to.GetUserByUsername("Gaz"); user.Admin {
+		t.Errorf("change not copied")
+	}
+
+	// every user and group added or updated is in the audit trail of the store copied to
+	entries, total, err := to.GetAuditEntries(AuditFilter{Actor: "copy-store command"})
+	if err != nil || total != 4 {
+		t.Fatalf("expected 4 audit entries, got %d: %v", total, err)
+	}
+	if entries[0].Target != "Gaz" || len(entries[0].Before) == 0 || len(entries[0].After) == 0 ||
+		strings.Contains(string(entries[0].Before), `"admin":true`) == false || strings.Contains(string(entries[0].After), `"admin":false`) == false {
+		t.Errorf("update not audited with before and after: %+v", entries[0])
+	}
+	if entries, _, _ = to.GetAuditEntries(AuditFilter{Target: "sensors"}); len(entries) != 1 || len(entries[0].Before) != 0 || len(entries[0].After) == 0 {
+		t.Errorf("added group not audited: %+v", entries)
+	}
+}
+
+func TestPutUsersKeepsHashes(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "users.db")
+	collection := openTestSQLite(t, fname)
+	if err := collection.PutUsers([]User{{UserName: "Gaz", Password: "plain text"}}); err == nil {
+		t.Errorf("password that is not a hash put")
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err := collection.PutUsers([]User{{UserName: "Gaz", Password: string(hash)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.PutUsers([]User{{UserName: "Gaz", Password: string(hash), SuperUser: true}}); err != nil {
+		t.Fatal(err)
+	}
+	collection.DB.Close()
+
+	users := openTestSQLite(t, fname).GetUsers()
+	if len(users) != 1 || users[0].Password != string(hash) || users[0].SuperUser == false {
+		t.Errorf("users not put as given: %+v", users)
+	}
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestJSONCollection returns a json store with no users, saving to a temporary directory
+func newTestJSONCollection(t testing.TB) *UserJSONCollection {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	collection := &UserJSONCollection{
+		Fname:         filepath.Join(dir, "users.json"),
+		GroupsFname:   filepath.Join(dir, "groups.json"),
+		SessionsFname: filepath.Join(dir, "sessions.json"),
+		AuditFname:    filepath.Join(dir, "audit.jsonl"),
+	}
+	collection.reindex()
+	return collection
+}
+
+func TestJSONIndexes(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	for _, name := range []string{"Admin", "Gaz", "Chloe"} {
+		if err := collection.AddUser(User{UserName: name, Password: "pw"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw"}); err == nil {
+		t.Errorf("duplicate user added")
+	}
+
+	// deleting a user moves the last user into its place
+	if err := collection.DeleteUser("Admin"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Gaz", "Chloe"} {
+		if user, err := collection.GetUserByUsername(name); err != nil || user.UserName != name {
+			t.Errorf("user %s not found after a delete: %v", name, err)
+		}
+	}
+	if _, err := collection.GetUserByUsername("Admin"); err == nil {
+		t.Errorf("deleted user found")
+	}
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		user, err := collection.Login("Gaz", "pw", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, user.Token)
+	}
+	if err := collection.DeleteSession(tokens[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.GetUserByToken(tokens[0]); err == nil {
+		t.Errorf("deleted session still valid")
+	}
+	for _, token := range tokens[1:] {
+		if user, err := collection.GetUserByToken(token); err != nil || user.UserName != "Gaz" {
+			t.Errorf("session not found after a delete: %v", err)
+		}
+	}
+
+	// a session can be looked up and ended by its id, which is not the token
+	if user, err := collection.GetUserBySessionID(SessionID(tokens[1])); err != nil || user.UserName != "Gaz" {
+		t.Errorf("session not found by its id: %v", err)
+	}
+	if _, err := collection.GetUserBySessionID(tokens[1]); err == nil {
+		t.Errorf("session found with the token as its id")
+	}
+	if err := collection.DeleteSessionByID(SessionID(tokens[1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.GetUserByToken(tokens[1]); err == nil {
+		t.Errorf("session deleted by its id still valid")
+	}
+}
+
+func TestJSONClientIDsNotShared(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	clientIDs := append(make(ClientIDArray, 0, 4), "lights-a")
+	if err := collection.AddUser(User{UserName: "Lights", Password: "pw", ClientIDs: clientIDs}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a copy of the user handed out earlier must not share the client ids being added to
+	held, _ := collection.GetUserByUsername("Lights")
+	if err := collection.AddClientIDToUser("Lights", "lights-b"); err != nil {
+		t.Fatal(err)
+	}
+	_ = append(held.ClientIDs, "lights-c")
+	if user, _ := collection.GetUserByUsername("Lights"); len(user.ClientIDs) != 2 || user.ClientIDs[1] != "lights-b" {
+		t.Errorf("added client id overwritten through a copy of the user: %v", user.ClientIDs)
+	}
+}
+
+// populate fills a json store with n users, each with a session
+func populate(collection *UserJSONCollection, n int) []string {
+	tokens := make([]string, n)
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("device%06d", i)
+		tokens[i] = fmt.Sprintf("token%06d", i)
+		collection.Users = append(collection.Users, User{UserName: name})
+		collection.Sessions = append(collection.Sessions, Session{TokenHash: hashToken(tokens[i]), UserName: name, Expires: expires})
+	}
+	collection.reindex()
+	return tokens
+}
+
+// scanForUser is the linear search the username index replaced, kept to compare against
+func scanForUser(collection *UserJSONCollection, username string) (User, bool) {
+	collection.RLock()
+	defer collection.RUnlock()
+	for _, v := range collection.Users {
+		if v.UserName == username {
+			return v, true
+		}
+	}
+	return User{}, false
+}
+
+func benchmarkGetUserByUsername(b *testing.B, n int, indexed bool) {
+	collection := newTestJSONCollection(b)
+	populate(collection, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("device%06d", i%n)
+		if indexed {
+			if _, err := collection.GetUserByUsername(name); err != nil {
+				b.Fatal(err)
+			}
+		} else if _, found := scanForUser(collection, name); found == false {
+			b.Fatal("user not found")
+		}
+	}
+}
+
+func benchmarkGetUserByToken(b *testing.B, n int) {
+	collection := newTestJSONCollection(b)
+	tokens := populate(collection, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := collection.GetUserByToken(tokens[i%n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUserByUsernameScan10k(b *testing.B)  { benchmarkGetUserByUsername(b, 10000, false) }
+func BenchmarkGetUserByUsername10k(b *testing.B)      { benchmarkGetUserByUsername(b, 10000, true) }
+func BenchmarkGetUserByUsernameScan100k(b *testing.B) { benchmarkGetUserByUsername(b, 100000, false) }
+func BenchmarkGetUserByUsername100k(b *testing.B)     { benchmarkGetUserByUsername(b, 100000, true) }
+func BenchmarkGetUserByToken10k(b *testing.B)         { benchmarkGetUserByToken(b, 10000) }
+func BenchmarkGetUserByToken100k(b *testing.B)        { benchmarkGetUserByToken(b, 100000) }
@@ -1,19 +1,26 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"io"
 	"log"
+	"os"
+	"time"
 
-	"github.com/rs/xid"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// InitJSON returns the store object that uses a json file
-func InitJSON(fname string) *UserJSONCollection {
+// InitJSON returns the store object that uses json files for the users, the groups and the sessions
+func InitJSON(fname string, groupsFname string, sessionsFname string) *UserJSONCollection {
 	log.Println("Storage type is json")
 	UsersJSON.Fname = fname
+	UsersJSON.GroupsFname = groupsFname
+	UsersJSON.SessionsFname = sessionsFname
+	UsersJSON.reindex()
 	return &UsersJSON
 }
 
@@ -25,24 +32,130 @@ func (me *UserJSONCollection) Load() error {
 		fname = "assets/users.json"
 	}
 
-	content, err := ioutil.ReadFile(fname)
+	var jsonUsers []User
+	content, err := readJSONFile(fname, func(content []byte) error {
+		var parseError error
+		jsonUsers, parseError = parseUsers(content)
+		return parseError
+	})
 	if err != nil {
 		log.Println("Error with reading: ", err)
 		return err
 	}
-	var jsonUsers []User
-	userMarshalError := json.Unmarshal(content, &jsonUsers)
-	if userMarshalError != nil {
-		log.Println("Error with unmarshalling: ", userMarshalError.Error())
+
+	jsonGroups, groupsLoadError := me.loadGroups()
+	if groupsLoadError != nil {
+		return groupsLoadError
+	}
+
+	jsonSessions, legacyTokens, sessionsLoadError := me.loadSessions()
+	if sessionsLoadError != nil {
+		return sessionsLoadError
+	}
+
+	// Tokens used to be kept on the user and never expired, they become sessions
+	for k, v := range jsonUsers {
+		if v.Token != "" {
+			jsonSessions = append(jsonSessions, legacySession(v.UserName, v.Token))
+			jsonUsers[k].Token = ""
+			legacyTokens = true
+		}
 	}
 
 	me.Lock()
 	me.Users = jsonUsers
+	me.Groups = jsonGroups
+	me.Sessions = jsonSessions
 	me.Fname = fname
+	me.reindex()
 	me.Unlock()
+	me.savedHash.Store(sha256.Sum256(content))
+	notifyUserChange("")
+
+	if legacyTokens {
+		log.Println("Replaced plain text tokens with hashed sessions")
+		saveSessionsError := me.SaveSessions("")
+		if saveSessionsError != nil {
+			return saveSessionsError
+		}
+		return me.Save("")
+	}
 	return nil
 }
 
+// reindex rebuilds the username and token hash indexes, the caller must hold the lock
+func (me *UserJSONCollection) reindex() {
+	me.usernames = indexUsers(me.Users)
+	me.tokenHashes = indexSessions(me.Sessions)
+}
+
+// loadSessions reads the sessions from their json file, a missing file just means nobody is logged in
+// Sessions saved with a plain text token have it replaced by its hash, in which case it returns true
+// so the caller knows to save them again
+func (me *UserJSONCollection) loadSessions() ([]Session, bool, error) {
+
+	fname := me.SessionsFname
+	if fname == "" {
+		fname = "assets/sessions.json"
+		me.SessionsFname = fname
+	}
+
+	type storedSession struct {
+		Session
+		Token string `json:"token"`
+	}
+	var jsonSessions []Session
+	var storedSessions []storedSession
+	_, err := readJSONFile(fname, func(content []byte) error {
+		storedSessions = nil
+		return json.Unmarshal(content, &storedSessions)
+	})
+	if os.IsNotExist(err) {
+		return jsonSessions, false, nil
+	}
+	if err != nil {
+		log.Println("Error with reading sessions: ", err)
+		return jsonSessions, false, err
+	}
+
+	legacyTokens := false
+	for _, v := range storedSessions {
+		if v.Token != "" {
+			v.Session.TokenHash = hashToken(v.Token)
+			legacyTokens = true
+		}
+		jsonSessions = append(jsonSessions, v.Session)
+	}
+	return jsonSessions, legacyTokens, nil
+}
+
+// loadGroups reads the groups from their json file, a missing file just means there are no groups yet
+func (me *UserJSONCollection) loadGroups() ([]Group, error) {
+
+	fname := me.GroupsFname
+	if fname == "" {
+		fname = "assets/groups.json"
+		me.GroupsFname = fname
+	}
+
+	var jsonGroups []Group
+	_, err := readJSONFile(fname, func(content []byte) error {
+		jsonGroups = nil
+		return json.Unmarshal(content, &jsonGroups)
+	})
+	if os.IsNotExist(err) {
+		return jsonGroups, nil
+	}
+	if err != nil {
+		log.Println("Error with reading groups: ", err)
+		return jsonGroups, err
+	}
+	for k := range jsonGroups {
+		jsonGroups[k].IndexTopics()
+	}
+	return jsonGroups, nil
+}
+
 // Login logs the user in and generates a token for the session if required
 func (me *UserJSONCollection) Login(username string, password string, requesttoken bool) (User, error) {
 
@@ -58,14 +171,18 @@ func (me *UserJSONCollection) Login(username string, password string, requesttok
 	}
 
 	if requesttoken == true {
-		// Create a token for the session
-		token := xid.New().String()
-		userLoggingIn.Token = token
-		tokenUpdateError := me.UpdateUserToken(username, token)
-		if tokenUpdateError != nil {
+		// Create a session
+		session, token, sessionError := newSession(username)
+		if sessionError != nil {
+			var blankUser User
+			return blankUser, sessionError
+		}
+		sessionAddError := me.AddSession(session)
+		if sessionAddError != nil {
 			var blankUser User
-			return blankUser, tokenUpdateError
+			return blankUser, sessionAddError
 		}
+		userLoggingIn.Token = token
 	}
 	return userLoggingIn, nil
 }
@@ -79,23 +196,24 @@ func (me *UserJSONCollection) AddUser(user User) error {
 	}
 	// Add the User to the collection
 	me.Lock()
-
-	for _, v := range me.Users {
-		if v.UserName == user.UserName {
-			me.Unlock()
-			return errors.New("User already exists")
-		}
+	if _, exists := me.usernames[user.UserName]; exists {
+		me.Unlock()
+		return errors.New("User already exists")
 	}
 
 	hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
+		me.Unlock()
 		log.Println("Cannot create password hash")
 		return errors.New("Cannot create password hash")
 	}
 
 	user.Password = string(hashPWD)
+	user.IndexTopics()
 	me.Users = append(me.Users, user)
+	me.usernames[user.UserName] = len(me.Users) - 1
 	me.Unlock()
+	notifyUserChange(user.UserName)
 
 	//Save the collection
 	return me.Save("")
@@ -120,27 +238,19 @@ func (me *UserJSONCollection) EditUser(user User) error {
 	}
 	//Add the User to the collection
 	me.Lock()
-	found := false
-	foundindex := 0
-	for k, v := range me.Users {
-		if v.UserName == user.UserName {
-			found = true
-			foundindex = k
-			break
-		}
-	}
-	me.Unlock()
+	foundindex, found := me.usernames[user.UserName]
 	if !found {
+		me.Unlock()
 		return errors.New("User not found")
 	}
-
-	me.Lock()
 	me.Users[foundindex].Admin = user.Admin
+	me.Users[foundindex].SuperUser = user.SuperUser
 	if user.Password != "" {
 		me.Users[foundindex].Password = user.Password
 	}
 
 	me.Unlock()
+	notifyUserChange(user.UserName)
 	//Save the collection
 	return me.Save("")
 }
@@ -150,60 +260,147 @@ func (me *UserJSONCollection) EditUser(user User) error {
 func (me *UserJSONCollection) UpdateUser(user User) error {
 
 	me.Lock()
-	for k, v := range me.Users {
-		if v.UserName == user.UserName {
-			if v.Password != user.Password {
-				hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-				if err != nil {
-					me.Unlock()
-					log.Println("Cannot create password hash")
-					return errors.New("Cannot create password hash")
-				}
-				user.Password = string(hashPWD)
+	if k, found := me.usernames[user.UserName]; found {
+		v := me.Users[k]
+		if v.Password != user.Password {
+			hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+			if err != nil {
+				me.Unlock()
+				log.Println("Cannot create password hash")
+				return errors.New("Cannot create password hash")
 			}
-			me.Users[k] = user
-			me.Unlock()
-			// fmt.Println("We need to save the update to Postgres too- remembering both user and topics")
-			return me.Save("")
+			user.Password = string(hashPWD)
 		}
+		user.IndexTopics()
+		me.Users[k] = user
+		me.Unlock()
+		notifyUserChange(user.UserName)
+		// fmt.Println("We need to save the update to Postgres too- remembering both user and topics")
+		return me.Save("")
 	}
 	me.Unlock()
 	return errors.New("Could not find user")
 }
 
+// PutUsers adds the users or replaces those that exist, as they are given. The passwords must already
+// be bcrypt hashes and are kept unchanged, as when copying the users from another store
+func (me *UserJSONCollection) PutUsers(users []User) error {
+
+	if err := checkPutUsers(users); err != nil {
+		return err
+	}
+	me.Lock()
+	me.Users = putUsers(me.Users, me.usernames, users)
+	me.Unlock()
+	notifyUserChange("")
+	return me.Save("")
+}
+
 // DeleteUser removes a user from the collection, using the username as a key
 func (me *UserJSONCollection) DeleteUser(username string) error {
 
 	me.Lock()
-	for k, v := range me.Users {
-		if v.UserName == username {
-			me.Users[k] = me.Users[len(me.Users)-1]
-			me.Users = me.Users[:len(me.Users)-1]
-			me.Unlock()
-			me.Save("")
-			return nil
-		}
+	if k, found := me.usernames[username]; found {
+		last := len(me.Users) - 1
+		me.Users[k] = me.Users[last]
+		me.usernames[me.Users[k].UserName] = k
+		delete(me.usernames, username)
+		me.Users = me.Users[:last]
+		me.Unlock()
+		notifyUserChange(username)
+		me.Save("")
+		return me.DeleteUserSessions(username)
 	}
 	me.Unlock()
 	return errors.New("User Not Found")
 }
 
-// GetUserByToken returns a user from the collection using the token as a key
+// GetUserByToken returns the user logged in with a session token, expired sessions are rejected and
+// the expiry of a valid session is moved on
 func (me *UserJSONCollection) GetUserByToken(token string) (User, error) {
+	return me.GetUserBySessionID(hashToken(token))
+}
+
+// GetUserBySessionID returns the user a session belongs to, renewing the session
+func (me *UserJSONCollection) GetUserBySessionID(tokenHash string) (User, error) {
 
 	if len(me.Users) == 0 {
 		me.Load()
 	}
-	me.RLock()
-	defer me.RUnlock()
+	var blankUser User
+	now := time.Now()
 
-	for _, v := range me.Users {
-		if v.Token == token {
-			return v, nil
+	me.Lock()
+	if k, found := me.tokenHashes[tokenHash]; found && tokenHashMatch(me.Sessions[k].TokenHash, tokenHash) {
+		v := me.Sessions[k]
+		if v.Expired(now) {
+			me.Unlock()
+			return blankUser, errors.New("Session expired")
+		}
+		renewed := me.Sessions[k].renew(now)
+		me.Unlock()
+		if renewed {
+			me.SaveSessions("")
 		}
+		return me.GetUserByUsername(v.UserName)
 	}
-	var blankUser User
-	return blankUser, errors.New("User not found")
+	me.Unlock()
+	return blankUser, errors.New("Session not found")
+}
+
+// AddSession stores a new session, any sessions that have expired are cleared out at the same time
+func (me *UserJSONCollection) AddSession(session Session) error {
+
+	now := time.Now()
+	me.Lock()
+	var sessions []Session
+	for _, v := range me.Sessions {
+		if !v.Expired(now) {
+			sessions = append(sessions, v)
+		}
+	}
+	me.Sessions = append(sessions, session)
+	me.tokenHashes = indexSessions(me.Sessions)
+	me.Unlock()
+	return me.SaveSessions("")
+}
+
+// DeleteSession removes a session, logging it out
+func (me *UserJSONCollection) DeleteSession(token string) error {
+	return me.DeleteSessionByID(hashToken(token))
+}
+
+// DeleteSessionByID removes a session by its id
+func (me *UserJSONCollection) DeleteSessionByID(tokenHash string) error {
+
+	me.Lock()
+	if k, found := me.tokenHashes[tokenHash]; found && tokenHashMatch(me.Sessions[k].TokenHash, tokenHash) {
+		last := len(me.Sessions) - 1
+		me.Sessions[k] = me.Sessions[last]
+		me.tokenHashes[me.Sessions[k].TokenHash] = k
+		delete(me.tokenHashes, tokenHash)
+		me.Sessions = me.Sessions[:last]
+		me.Unlock()
+		return me.SaveSessions("")
+	}
+	me.Unlock()
+	return errors.New("Session not found")
+}
+
+// DeleteUserSessions removes every session of a user
+func (me *UserJSONCollection) DeleteUserSessions(username string) error {
+
+	me.Lock()
+	var sessions []Session
+	for _, v := range me.Sessions {
+		if v.UserName != username {
+			sessions = append(sessions, v)
+		}
+	}
+	me.Sessions = sessions
+	me.tokenHashes = indexSessions(me.Sessions)
+	me.Unlock()
+	return me.SaveSessions("")
 }
 
 // GetUserByUsername returns a user from the collection using username as a key
@@ -212,10 +409,8 @@ func (me *UserJSONCollection) GetUserByUsername(username string) (User, error) {
 	me.RLock()
 	defer me.RUnlock()
 
-	for _, v := range me.Users {
-		if v.UserName == username {
-			return v, nil
-		}
+	if k, found := me.usernames[username]; found {
+		return me.Users[k], nil
 	}
 	var blankUser User
 	return blankUser, errors.New("User not found")
@@ -254,20 +449,17 @@ func (me *UserJSONCollection) EditTopicForUser(username string, topic Topic) err
 		return errors.New("Could not find user")
 	}
 
-	found := false
-	me.RLock()
 	for k, v := range targetUser.Topics {
 		if v.TopicString == topic.TopicString {
-			targetUser.Topics[k] = topic
-			found = true
-			break
+			// the topics are copied as the stored user shares them until UpdateUser replaces it
+			topics := make(TopicArray, len(targetUser.Topics))
+			copy(topics, targetUser.Topics)
+			topics[k] = topic
+			targetUser.Topics = topics
+			return me.UpdateUser(targetUser)
 		}
 	}
-	me.RUnlock()
-	if !found {
-		return errors.New("Topic not found")
-	}
-	return me.UpdateUser(targetUser)
+	return errors.New("Topic not found")
 }
 
 // DeleteTopicFromUser removes a topic permission for that user if the topic does not exist it returns an error
@@ -280,30 +472,56 @@ func (me *UserJSONCollection) DeleteTopicFromUser(username string, topicString s
 
 	for k, v := range targetUser.Topics {
 		if v.TopicString == topicString {
-			targetUser.Topics[k] = targetUser.Topics[len(targetUser.Topics)-1]
-			targetUser.Topics = targetUser.Topics[:len(targetUser.Topics)-1]
-
+			topics := make(TopicArray, 0, len(targetUser.Topics)-1)
+			topics = append(topics, targetUser.Topics[:k]...)
+			targetUser.Topics = append(topics, targetUser.Topics[k+1:]...)
 			return me.UpdateUser(targetUser)
 		}
 	}
 	return errors.New("Topic not found")
 }
 
-// UpdateUserToken updates the token for an existing user upon login
-func (me *UserJSONCollection) UpdateUserToken(username string, newtoken string) error {
+// AddClientIDToUser adds an allowed client id (or client id pattern) to an existing user
+func (me *UserJSONCollection) AddClientIDToUser(username string, clientID string) error {
 
-	me.Lock()
-	for k, v := range me.Users {
-		if v.UserName == username {
-			v.Token = newtoken
-			me.Users[k] = v
-			me.Unlock()
-			saveError := me.Save("")
-			return saveError
+	if clientID == "" {
+		return errors.New("Client id cannot be blank")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for _, v := range targetUser.ClientIDs {
+		if v == clientID {
+			return errors.New("Client id already exists")
 		}
 	}
-	me.Unlock()
-	return errors.New("User not found")
+
+	// the client ids are copied as the stored user shares them
+	clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)+1)
+	targetUser.ClientIDs = append(append(clientIDs, targetUser.ClientIDs...), clientID)
+	return me.UpdateUser(targetUser)
+}
+
+// DeleteClientIDFromUser removes an allowed client id from a user, if the client id does not exist it returns an error
+func (me *UserJSONCollection) DeleteClientIDFromUser(username string, clientID string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.ClientIDs {
+		if v == clientID {
+			clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)-1)
+			clientIDs = append(clientIDs, targetUser.ClientIDs[:k]...)
+			targetUser.ClientIDs = append(clientIDs, targetUser.ClientIDs[k+1:]...)
+
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Client id not found")
 }
 
 // Save saves the users collection in a json file
@@ -322,10 +540,358 @@ func (me *UserJSONCollection) Save(fname string) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(fname, b, 0644)
+	err = writeJSONFile(fname, b, 0644, me.Backups)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if fname == me.Fname {
+		me.savedHash.Store(sha256.Sum256(b))
+	}
+	return nil
+}
+
+// GetGroups returns all the groups from the collection
+func (me *UserJSONCollection) GetGroups() []Group {
+	me.RLock()
+	defer me.RUnlock()
+	return me.Groups
+}
+
+// GetGroup returns a group from the collection using its name as a key
+func (me *UserJSONCollection) GetGroup(name string) (Group, error) {
+
+	me.RLock()
+	defer me.RUnlock()
+
+	for _, v := range me.Groups {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	var blankGroup Group
+	return blankGroup, errors.New("Group not found")
+}
+
+// AddGroup adds a new group to the collection
+func (me *UserJSONCollection) AddGroup(group Group) error {
+	if group.Name == "" {
+		return errors.New("Group name must be non-blank")
+	}
+
+	me.Lock()
+	for _, v := range me.Groups {
+		if v.Name == group.Name {
+			me.Unlock()
+			return errors.New("Group already exists")
+		}
+	}
+	group.IndexTopics()
+	me.Groups = append(me.Groups, group)
+	me.Unlock()
+
+	return me.SaveGroups("")
+}
+
+// UpdateGroup accepts a group object and replaces the group with the same name
+func (me *UserJSONCollection) UpdateGroup(group Group) error {
+
+	me.Lock()
+	for k, v := range me.Groups {
+		if v.Name == group.Name {
+			group.IndexTopics()
+			me.Groups[k] = group
+			me.Unlock()
+			notifyUserChange("")
+			return me.SaveGroups("")
+		}
+	}
+	me.Unlock()
+	return errors.New("Could not find group")
+}
+
+// PutGroups adds the groups or replaces those that exist, as they are given
+func (me *UserJSONCollection) PutGroups(groups []Group) error {
+
+	if err := checkPutGroups(groups); err != nil {
+		return err
+	}
+	me.Lock()
+	me.Groups = putGroups(me.Groups, groups)
+	me.Unlock()
+	notifyUserChange("")
+	return me.SaveGroups("")
+}
+
+// DeleteGroup removes a group from the collection and takes every user out of it
+func (me *UserJSONCollection) DeleteGroup(name string) error {
+
+	me.Lock()
+	found := false
+	for k, v := range me.Groups {
+		if v.Name == name {
+			me.Groups[k] = me.Groups[len(me.Groups)-1]
+			me.Groups = me.Groups[:len(me.Groups)-1]
+			found = true
+			break
+		}
+	}
+	if !found {
+		me.Unlock()
+		return errors.New("Group Not Found")
+	}
+	for k, v := range me.Users {
+		if v.InGroup(name) {
+			me.Users[k].Groups = removeGroupName(v.Groups, name)
+		}
+	}
+	me.Unlock()
+	notifyUserChange("")
+
+	saveGroupsError := me.SaveGroups("")
+	if saveGroupsError != nil {
+		return saveGroupsError
+	}
+	return me.Save("")
+}
+
+// AddTopicToGroup adds a new topic to an existing group
+func (me *UserJSONCollection) AddTopicToGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for _, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			return errors.New("Topic already exists")
+		}
+	}
+
+	topics := make(TopicArray, 0, len(targetGroup.Topics)+1)
+	targetGroup.Topics = append(append(topics, targetGroup.Topics...), topic)
+	return me.UpdateGroup(targetGroup)
+}
+
+// EditTopicForGroup edits an existing topic for an existing group in the collection
+func (me *UserJSONCollection) EditTopicForGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			topics := make(TopicArray, len(targetGroup.Topics))
+			copy(topics, targetGroup.Topics)
+			topics[k] = topic
+			targetGroup.Topics = topics
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromGroup removes a topic permission from a group, if the topic does not exist it returns an error
+func (me *UserJSONCollection) DeleteTopicFromGroup(name string, topicString string) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topicString {
+			topics := make(TopicArray, 0, len(targetGroup.Topics)-1)
+			topics = append(topics, targetGroup.Topics[:k]...)
+			targetGroup.Topics = append(topics, targetGroup.Topics[k+1:]...)
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// AddUserToGroup makes an existing user a member of an existing group
+func (me *UserJSONCollection) AddUserToGroup(username string, name string) error {
+
+	_, getGroupError := me.GetGroup(name)
+	if getGroupError != nil {
+		return errors.New("Could not find group")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) {
+		return errors.New("User already in group")
+	}
+
+	groups := make(GroupArray, 0, len(targetUser.Groups)+1)
+	targetUser.Groups = append(append(groups, targetUser.Groups...), name)
+	return me.UpdateUser(targetUser)
+}
+
+// RemoveUserFromGroup takes a user out of a group
+func (me *UserJSONCollection) RemoveUserFromGroup(username string, name string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) == false {
+		return errors.New("User not in group")
+	}
+
+	targetUser.Groups = removeGroupName(targetUser.Groups, name)
+	return me.UpdateUser(targetUser)
+}
+
+// SaveSessions saves the sessions in a json file
+func (me *UserJSONCollection) SaveSessions(fname string) error {
+
+	me.RLock()
+	defer me.RUnlock()
+	if fname == "" {
+		fname = me.SessionsFname
+	}
+
+	b, err := json.MarshalIndent(me.Sessions, " ", " ")
+	if err != nil {
+		log.Println("Could not marshall sessions ", err)
+		return err
+	}
+
+	err = writeJSONFile(fname, b, 0600, me.Backups)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// SaveGroups saves the groups collection in a json file
+func (me *UserJSONCollection) SaveGroups(fname string) error {
+
+	me.RLock()
+	defer me.RUnlock()
+	if fname == "" {
+		fname = me.GroupsFname
+	}
+
+	b, err := json.MarshalIndent(me.Groups, " ", " ")
+	if err != nil {
+		log.Println("Could not marshall groups ", err)
+		return err
+	}
+
+	err = writeJSONFile(fname, b, 0644, me.Backups)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
+
+// auditFname returns the name of the audit trail file
+func (me *UserJSONCollection) auditFname() string {
+	if me.AuditFname == "" {
+		return "assets/audit.jsonl"
+	}
+	return me.AuditFname
+}
+
+// readAudit reads every entry of the audit trail, oldest first. A line that cannot be read, such as one
+// cut short by a crash, is skipped
+func (me *UserJSONCollection) readAudit() ([]AuditEntry, error) {
+
+	var entries []AuditEntry
+	file, openError := os.Open(me.auditFname())
+	if os.IsNotExist(openError) {
+		return entries, nil
+	}
+	if openError != nil {
+		return entries, openError
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, readError := reader.ReadBytes('\n')
+		if readError != nil && readError != io.EOF {
+			return entries, readError
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry AuditEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				log.Println("Skipping an audit entry that cannot be read: ", err)
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+		if readError == io.EOF {
+			return entries, nil
+		}
+	}
+}
+
+// AddAuditEntry appends an entry to the audit trail, it is synced to disk before returning
+func (me *UserJSONCollection) AddAuditEntry(entry AuditEntry) error {
+
+	me.auditLock.Lock()
+	defer me.auditLock.Unlock()
+	if me.auditNext == 0 {
+		entries, readError := me.readAudit()
+		if readError != nil {
+			return readError
+		}
+		me.auditNext = 1
+		if len(entries) > 0 {
+			me.auditNext = entries[len(entries)-1].ID + 1
+		}
+	}
+	entry.ID = me.auditNext
+	entry.Time = entry.Time.UTC()
+	line, marshalError := json.Marshal(entry)
+	if marshalError != nil {
+		return marshalError
+	}
+
+	file, openError := os.OpenFile(me.auditFname(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if openError != nil {
+		log.Println("Error in adding an audit entry: ", openError)
+		return openError
+	}
+	_, writeError := file.Write(append(line, '\n'))
+	if writeError == nil {
+		writeError = file.Sync()
+	}
+	if closeError := file.Close(); writeError == nil {
+		writeError = closeError
+	}
+	if writeError != nil {
+		log.Println("Error in adding an audit entry: ", writeError)
+		return writeError
+	}
+	me.auditNext++
+	return nil
+}
+
+// GetAuditEntries returns the page of audit entries the filter selects, newest first, along with how
+// many entries it selects in all
+func (me *UserJSONCollection) GetAuditEntries(filter AuditFilter) ([]AuditEntry, int, error) {
+
+	me.auditLock.Lock()
+	entries, readError := me.readAudit()
+	me.auditLock.Unlock()
+	if readError != nil {
+		return nil, 0, readError
+	}
+	var selected []AuditEntry
+	for k := len(entries) - 1; k >= 0; k-- {
+		if filter.matches(entries[k]) {
+			selected = append(selected, entries[k])
+		}
+	}
+	return filter.page(selected), len(selected), nil
+}
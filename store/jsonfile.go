@@ -0,0 +1,135 @@
+package store
+
+// This writes the json files so that a crash or a full disk part way through a save cannot leave a
+// truncated file behind. A file is written in full to a temporary file next to it, synced to disk and
+// then renamed over the old one, and the files it replaces are kept as numbered backups (users.json.1
+// being the latest) which Load falls back to if a file turns out to be corrupt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// backupName returns the name of the nth backup of a file
+func backupName(fname string, n int) string {
+	return fname + "." + strconv.Itoa(n)
+}
+
+// writeJSONFile replaces a file with content, keeping up to backups of the files it replaces
+func writeJSONFile(fname string, content []byte, perm os.FileMode, backups int) error {
+
+	tmp, createError := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if createError != nil {
+		return createError
+	}
+	tmpName := tmp.Name()
+	_, writeError := tmp.Write(content)
+	if writeError == nil {
+		writeError = tmp.Sync()
+	}
+	if closeError := tmp.Close(); writeError == nil {
+		writeError = closeError
+	}
+	if writeError == nil {
+		writeError = os.Chmod(tmpName, perm)
+	}
+	if writeError != nil {
+		os.Remove(tmpName)
+		return writeError
+	}
+
+	if backups > 0 {
+		rotateBackups(fname, backups)
+	}
+	if err := os.Rename(tmpName, fname); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	syncDir(filepath.Dir(fname))
+	return nil
+}
+
+// rotateBackups moves the backups of a file up one and makes the file as it is now the latest backup.
+// A file that is not valid json is not backed up, so it cannot push the good backups out. Failures are
+// only logged, the file itself can still be saved
+func rotateBackups(fname string, backups int) {
+
+	current, readError := ioutil.ReadFile(fname)
+	if readError != nil || json.Valid(current) == false {
+		return
+	}
+	for n := backups - 1; n > 0; n-- {
+		err := os.Rename(backupName(fname, n), backupName(fname, n+1))
+		if err != nil && os.IsNotExist(err) == false {
+			log.Println("Error in rotating the backups of", fname, err)
+		}
+	}
+	info, statError := os.Stat(fname)
+	if statError != nil {
+		log.Println("Error in backing up", fname, statError)
+		return
+	}
+	if err := ioutil.WriteFile(backupName(fname, 1), current, info.Mode().Perm()); err != nil {
+		log.Println("Error in backing up", fname, err)
+	}
+}
+
+// syncDir makes a rename in the directory durable. Not every platform can sync a directory, so it is
+// best effort
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// readJSONFile reads a file and hands its content to parse. If the file cannot be read or parse rejects
+// it, the backups are tried from the latest on and the first one parse accepts is used. The corrupt file
+// is kept aside as fname.corrupt and the backup written back in its place. A missing file is returned as
+// it is, as for some files that is expected
+func readJSONFile(fname string, parse func(content []byte) error) ([]byte, error) {
+
+	content, readError := ioutil.ReadFile(fname)
+	if os.IsNotExist(readError) {
+		return nil, readError
+	}
+	if readError == nil {
+		readError = parse(content)
+		if readError == nil {
+			return content, nil
+		}
+	}
+	log.Println("Error with reading", fname, readError)
+
+	for n := 1; ; n++ {
+		backup, err := ioutil.ReadFile(backupName(fname, n))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err == nil {
+			err = parse(backup)
+		}
+		if err != nil {
+			log.Println("Backup", backupName(fname, n), "cannot be used either", err)
+			continue
+		}
+		log.Println("Falling back to", backupName(fname, n), "the corrupt file is kept as", fname+".corrupt")
+		if err := os.Rename(fname, fname+".corrupt"); err != nil && os.IsNotExist(err) == false {
+			log.Println("Error in keeping aside", fname, err)
+		}
+		info, statError := os.Stat(backupName(fname, n))
+		if statError == nil {
+			if err := writeJSONFile(fname, backup, info.Mode().Perm(), 0); err != nil {
+				log.Println("Error in restoring", fname, err)
+			}
+		}
+		return backup, nil
+	}
+	return nil, readError
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONBackups(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	collection.Backups = 2
+	// users are put in memory directly to save hashing a password for each
+	for _, name := range []string{"Gaz", "Chloe", "Admin", "sensor1"} {
+		collection.Users = append(collection.Users, User{UserName: name})
+		if err := collection.Save(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for n, want := range map[int]int{1: 3, 2: 2} {
+		content, err := ioutil.ReadFile(backupName(collection.Fname, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, err := parseUsers(content)
+		if err != nil || len(users) != want {
+			t.Errorf("backup %d has %d users, expected %d: %v", n, len(users), want, err)
+		}
+	}
+	if _, err := os.Stat(backupName(collection.Fname, 3)); os.IsNotExist(err) == false {
+		t.Errorf("more backups kept than configured")
+	}
+	if temps, _ := filepath.Glob(collection.Fname + ".tmp*"); len(temps) != 0 {
+		t.Errorf("temporary files left behind: %v", temps)
+	}
+}
+
+func TestJSONLoadFallsBack(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	collection.Backups = 3
+	collection.Users = []User{{UserName: "Gaz"}}
+	collection.Groups = []Group{{Name: "sensors"}}
+	for i := 0; i < 3; i++ {
+		if err := collection.Save(""); err != nil {
+			t.Fatal(err)
+		}
+		if err := collection.SaveGroups(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a save cut short leaves a truncated file, and the latest backup may be no better
+	if err := ioutil.WriteFile(collection.Fname, []byte(`[{"username": "Ga`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(backupName(collection.Fname, 1), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(collection.GroupsFname, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestJSONCollection(t)
+	reloaded.Fname = collection.Fname
+	reloaded.GroupsFname = collection.GroupsFname
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.GetUserByUsername("Gaz"); err != nil {
+		t.Errorf("users not loaded from the backup: %v", err)
+	}
+	if groups := reloaded.GetGroups(); len(groups) != 1 {
+		t.Errorf("groups not loaded from the backup: %+v", groups)
+	}
+	if _, err := os.Stat(collection.Fname + ".corrupt"); err != nil {
+		t.Errorf("corrupt file not kept: %v", err)
+	}
+	content, _ := ioutil.ReadFile(collection.Fname)
+	if _, err := parseUsers(content); err != nil {
+		t.Errorf("backup not restored: %v", err)
+	}
+
+	// without a good backup the error is returned
+	for _, v := range []string{collection.Fname, backupName(collection.Fname, 2)} {
+		if err := ioutil.WriteFile(v, []byte(`{`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reloaded.Load(); err == nil {
+		t.Errorf("corrupt file loaded without a good backup")
+	}
+}
@@ -0,0 +1,323 @@
+package store
+
+// This brings the postgres schema up to date when hmqauth starts. Every change to the schema is a numbered
+// migration below, applied once in order and recorded in the hmqschema table. Migrations are only ever
+// added to the end of the list, a migration that has been released is never changed
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// postgresMigration is one change to the postgres schema. Prepare, if set, runs in the same transaction
+// before the sql, for the checks and changes that depend on what is in the db
+type postgresMigration struct {
+	version int
+	name    string
+	sql     string
+	prepare func(ctx context.Context, tx pgx.Tx) error
+}
+
+// postgresMigrations are the changes to the postgres schema in the order they are applied. The first
+// ones use IF NOT EXISTS as they describe tables that were created by hand before there were migrations
+var postgresMigrations = []postgresMigration{
+	{
+		version: 1,
+		name:    "create users",
+		sql: `CREATE TABLE IF NOT EXISTS hmqusers (
+			username TEXT PRIMARY KEY,
+			pwd TEXT NOT NULL,
+			token TEXT,
+			admin BOOLEAN NOT NULL DEFAULT FALSE,
+			topics JSON
+		)`,
+	},
+	{
+		version: 2,
+		name:    "add superusers and client ids",
+		sql: `ALTER TABLE hmqusers
+			ADD COLUMN IF NOT EXISTS superuser BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN IF NOT EXISTS clientids JSON`,
+	},
+	{
+		version: 3,
+		name:    "create sessions",
+		sql: `CREATE TABLE IF NOT EXISTS hmqsessions (
+			token TEXT,
+			username TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL,
+			expires TIMESTAMPTZ NOT NULL
+		);
+		ALTER TABLE hmqsessions ADD COLUMN IF NOT EXISTS tokenhash TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS hmqsessions_tokenhash ON hmqsessions (tokenhash);
+		CREATE INDEX IF NOT EXISTS hmqsessions_username ON hmqsessions (username)`,
+	},
+	{
+		version: 4,
+		name:    "create groups",
+		sql: `CREATE TABLE IF NOT EXISTS hmqgroups (
+			name TEXT PRIMARY KEY,
+			topics JSON
+		);
+		ALTER TABLE hmqusers ADD COLUMN IF NOT EXISTS groups JSON`,
+	},
+	{
+		version: 5,
+		name:    "move user topics to their own table",
+		prepare: keyUsernames,
+		sql: `CREATE TABLE hmqtopics (
+			id BIGSERIAL PRIMARY KEY,
+			username TEXT NOT NULL REFERENCES hmqusers (username) ON DELETE CASCADE ON UPDATE CASCADE,
+			topicstring TEXT NOT NULL,
+			pub BOOLEAN NOT NULL DEFAULT FALSE,
+			sub BOOLEAN NOT NULL DEFAULT FALSE,
+			deny BOOLEAN NOT NULL DEFAULT FALSE,
+			UNIQUE (username, topicstring)
+		);
+		INSERT INTO hmqtopics (username, topicstring, pub, sub, deny)
+			SELECT u.username, t.topic->>'topicstring', COALESCE((t.topic->>'pub')::BOOLEAN, FALSE),
+				COALESCE((t.topic->>'sub')::BOOLEAN, FALSE), COALESCE((t.topic->>'deny')::BOOLEAN, FALSE)
+			FROM hmqusers u, json_array_elements(CASE WHEN json_typeof(u.topics::JSON) = 'array' THEN u.topics::JSON ELSE '[]' END)
+				WITH ORDINALITY AS t(topic, n)
+			WHERE t.topic->>'topicstring' IS NOT NULL
+			ORDER BY u.username, t.n
+			ON CONFLICT DO NOTHING;
+		ALTER TABLE hmqusers DROP COLUMN topics`,
+	},
+	{
+		version: 6,
+		name:    "create the audit trail",
+		sql: `CREATE TABLE hmqaudit (
+			id BIGSERIAL PRIMARY KEY,
+			time TIMESTAMPTZ NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			before JSONB,
+			after JSONB,
+			sourceip TEXT NOT NULL
+		);
+		CREATE INDEX hmqaudit_time ON hmqaudit (time);
+		CREATE FUNCTION hmqaudit_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'The audit trail is append-only';
+		END
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER hmqaudit_no_change BEFORE UPDATE OR DELETE ON hmqaudit
+			FOR EACH ROW EXECUTE PROCEDURE hmqaudit_append_only();
+		CREATE TRIGGER hmqaudit_no_truncate BEFORE TRUNCATE ON hmqaudit
+			FOR EACH STATEMENT EXECUTE PROCEDURE hmqaudit_append_only()`,
+	},
+}
+
+// keyUsernames makes the username the primary key of hmqusers where a table created by hand has no unique
+// key on it, as the topics table refers to it. Duplicate or blank usernames are left for the admin to sort out
+func keyUsernames(ctx context.Context, tx pgx.Tx) error {
+
+	// a unique index on the username alone will do, whether it came from a constraint or not
+	keySQL := `SELECT EXISTS (SELECT 1 FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+		WHERE i.indrelid = 'hmqusers'::regclass AND i.indisunique AND i.indimmediate AND i.indpred IS NULL
+		AND i.indnatts = 1 AND a.attname = 'username')`
+	var keyed bool
+	if err := tx.QueryRow(ctx, keySQL).Scan(&keyed); err != nil || keyed {
+		return err
+	}
+
+	var blanks int
+	if err := tx.QueryRow(ctx, "SELECT count(*) FROM hmqusers WHERE username IS NULL OR username = ''").Scan(&blanks); err != nil {
+		return err
+	}
+	if blanks > 0 {
+		return errors.New("The hmqusers table has " + strconv.Itoa(blanks) + " users with no username, remove them so that the username can be made the primary key")
+	}
+	rows, queryError := tx.Query(ctx, "SELECT username FROM hmqusers GROUP BY username HAVING count(*) > 1 ORDER BY username")
+	if queryError != nil {
+		return queryError
+	}
+	var duplicates []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, username)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return errors.New("The hmqusers table has more than one row for the usernames " + strings.Join(duplicates, ", ") +
+			", remove the extra rows so that the username can be made the primary key")
+	}
+
+	// a table with a primary key of its own keeps it and has the username made unique instead
+	var hasPrimaryKey bool
+	primaryKeySQL := "SELECT EXISTS (SELECT 1 FROM pg_index WHERE indrelid = 'hmqusers'::regclass AND indisprimary)"
+	if err := tx.QueryRow(ctx, primaryKeySQL).Scan(&hasPrimaryKey); err != nil {
+		return err
+	}
+	alterSQL := "ALTER TABLE hmqusers ADD PRIMARY KEY (username)"
+	if hasPrimaryKey {
+		alterSQL = "ALTER TABLE hmqusers ADD CONSTRAINT hmqusers_username_key UNIQUE (username)"
+	}
+	if _, err := tx.Exec(ctx, alterSQL); err != nil {
+		return err
+	}
+	log.Println("Made the username the key of hmqusers")
+	return nil
+}
+
+// postgresMigrationLock is the key of the advisory lock held while migrating, so that instances
+// starting together wait for each other rather than apply the same migration twice
+const postgresMigrationLock = 0x686d7161757468
+
+// createSchemaTable creates the table that records the migrations applied
+const createSchemaTable = `CREATE TABLE IF NOT EXISTS hmqschema (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// MigrationStatus is a migration along with when it was applied, Applied is zero if it is pending.
+// Known is false for a migration recorded in the db that this version of hmqauth does not have
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied time.Time
+	Known   bool
+}
+
+// querier runs a query on either the pool or a single connection
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// appliedMigrations returns the migrations recorded in the hmqschema table
+func appliedMigrations(ctx context.Context, db querier) (map[int]MigrationStatus, error) {
+
+	applied := make(map[int]MigrationStatus)
+	rows, queryError := db.Query(ctx, "SELECT version, name, applied FROM hmqschema")
+	if queryError != nil {
+		return applied, queryError
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status MigrationStatus
+		if err := rows.Scan(&status.Version, &status.Name, &status.Applied); err != nil {
+			return applied, err
+		}
+		applied[status.Version] = status
+	}
+	return applied, rows.Err()
+}
+
+// migratePostgres applies the migrations that have not been applied yet, each in its own transaction
+func migratePostgres(db *pgxpool.Pool) error {
+
+	ctx := context.Background()
+	conn, acquireError := db.Acquire(ctx)
+	if acquireError != nil {
+		return acquireError
+	}
+	defer conn.Release()
+
+	// The lock belongs to the connection, so everything is done on the one connection
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", postgresMigrationLock); err != nil {
+		return err
+	}
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", postgresMigrationLock)
+
+	if _, err := conn.Exec(ctx, createSchemaTable); err != nil {
+		return err
+	}
+	applied, appliedError := appliedMigrations(ctx, conn)
+	if appliedError != nil {
+		return appliedError
+	}
+	for _, v := range postgresMigrations {
+		if _, done := applied[v.version]; done {
+			continue
+		}
+		tx, beginError := conn.Begin(ctx)
+		if beginError != nil {
+			return beginError
+		}
+		if v.prepare != nil {
+			if err := v.prepare(ctx, tx); err != nil {
+				tx.Rollback(ctx)
+				log.Println("Error in preparing migration", v.version, v.name, err)
+				return err
+			}
+		}
+		if _, err := tx.Exec(ctx, v.sql); err != nil {
+			tx.Rollback(ctx)
+			log.Println("Error in applying migration", v.version, v.name, err)
+			return err
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO hmqschema (version, name) VALUES ($1, $2)", v.version, v.name); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		log.Println("Applied migration", v.version, v.name)
+	}
+	return nil
+}
+
+// PostgresMigrationStatus lists every migration with when it was applied, without changing the db
+func PostgresMigrationStatus(db *pgxpool.Pool) ([]MigrationStatus, error) {
+
+	ctx := context.Background()
+	applied := make(map[int]MigrationStatus)
+	var schemaExists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('hmqschema') IS NOT NULL").Scan(&schemaExists); err != nil {
+		return nil, err
+	}
+	if schemaExists {
+		var appliedError error
+		applied, appliedError = appliedMigrations(ctx, db)
+		if appliedError != nil {
+			return nil, appliedError
+		}
+	}
+	return migrationStatus(applied), nil
+}
+
+// migrationStatus merges the migrations applied with the ones this version of hmqauth has
+func migrationStatus(applied map[int]MigrationStatus) []MigrationStatus {
+
+	var statuses []MigrationStatus
+	latest := 0
+	for _, v := range postgresMigrations {
+		status := MigrationStatus{Version: v.version, Name: v.name, Known: true}
+		if done, found := applied[v.version]; found {
+			status.Applied = done.Applied
+		}
+		statuses = append(statuses, status)
+		latest = v.version
+	}
+	// migrations applied by a newer version of hmqauth come last
+	var newer []int
+	for k := range applied {
+		if k > latest {
+			newer = append(newer, k)
+		}
+	}
+	sort.Ints(newer)
+	for _, v := range newer {
+		statuses = append(statuses, applied[v])
+	}
+	return statuses
+}
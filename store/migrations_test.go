@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPostgresMigrationsInOrder(t *testing.T) {
+
+	for k, v := range postgresMigrations {
+		if v.version != k+1 {
+			t.Errorf("migration %q has version %d, expected %d", v.name, v.version, k+1)
+		}
+		if v.name == "" || v.sql == "" {
+			t.Errorf("migration %d needs a name and sql", v.version)
+		}
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+
+	applied := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	latest := len(postgresMigrations)
+	statuses := migrationStatus(map[int]MigrationStatus{
+		1:          {Version: 1, Name: "create users", Applied: applied},
+		latest + 2: {Version: latest + 2, Name: "from the future", Applied: applied},
+	})
+
+	if len(statuses) != latest+1 {
+		t.Fatalf("expected %d statuses, got %d", latest+1, len(statuses))
+	}
+	if statuses[0].Applied.Equal(applied) == false || statuses[0].Known == false {
+		t.Errorf("applied migration not reported: %+v", statuses[0])
+	}
+	if statuses[1].Applied.IsZero() == false {
+		t.Errorf("pending migration reported as applied: %+v", statuses[1])
+	}
+	if last := statuses[latest]; last.Version != latest+2 || last.Known {
+		t.Errorf("newer migration not reported as unknown: %+v", last)
+	}
+}
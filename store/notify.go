@@ -0,0 +1,241 @@
+package store
+
+// This keeps several hmqauth instances sharing a postgres db in step. Every change an instance makes is
+// announced with a NOTIFY, and every instance LISTENs and reloads the user or group that changed, so a
+// user added on one instance can log in on all of them straight away
+
+import (
+	"authserver/config"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// postgresChangeChannel is the channel the changes are announced on
+const postgresChangeChannel = "hmqauth_changes"
+
+// The delays between attempts to reconnect the listen connection, doubled after each failure
+const (
+	listenMinBackoff = time.Second
+	listenMaxBackoff = time.Minute
+)
+
+// postgresChange is the payload of a change notification
+type postgresChange struct {
+	// Instance is the instance that made the change, which ignores its own notifications
+	Instance string `json:"instance"`
+	User     string `json:"user,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// newInstanceID returns a random id for this instance
+func newInstanceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// announceUser tells the other instances that a user has changed
+func (me *UserPostgresCollection) announceUser(username string) {
+	me.announce(postgresChange{Instance: me.instance, User: username})
+}
+
+// announceGroup tells the other instances that a group has changed
+func (me *UserPostgresCollection) announceGroup(name string) {
+	me.announce(postgresChange{Instance: me.instance, Group: name})
+}
+
+// announce sends a change notification, a failure is only logged as the change itself has been made
+func (me *UserPostgresCollection) announce(change postgresChange) {
+
+	payload, marshalError := json.Marshal(change)
+	if marshalError != nil {
+		log.Println("Error in announcing a change: ", marshalError)
+		return
+	}
+	_, result := me.DB.Exec(context.Background(), "SELECT pg_notify($1, $2)", postgresChangeChannel, string(payload))
+	if result != nil {
+		log.Println("Error in announcing a change: ", result)
+	}
+}
+
+// listen follows the changes made by the other instances until the app shuts down. The connection is
+// made again if it drops, and as notifications may have been missed meanwhile everything is reloaded
+func (me *UserPostgresCollection) listen(connString string) {
+
+	config.WG.Add(1)
+	defer config.WG.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-config.Done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := listenMinBackoff
+	for reconnecting := false; ; reconnecting = true {
+		listenStart := time.Now()
+		listenError := me.followChanges(ctx, connString, reconnecting)
+		if ctx.Err() != nil {
+			return
+		}
+		// a connection that stayed up a while starts the backoff again
+		if time.Since(listenStart) > listenMaxBackoff {
+			backoff = listenMinBackoff
+		}
+		log.Println("Lost the connection listening for changes, reconnecting in", backoff, listenError)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > listenMaxBackoff {
+			backoff = listenMaxBackoff
+		}
+	}
+}
+
+// followChanges listens on one connection and applies the changes announced, until the connection fails
+func (me *UserPostgresCollection) followChanges(ctx context.Context, connString string, reconnecting bool) error {
+
+	conn, connectError := pgx.Connect(ctx, connString)
+	if connectError != nil {
+		return connectError
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+postgresChangeChannel); err != nil {
+		return err
+	}
+	if reconnecting {
+		log.Println("Listening for changes again, reloading the users")
+		if err := me.Load(); err != nil {
+			return err
+		}
+	}
+	for {
+		notification, waitError := conn.WaitForNotification(ctx)
+		if waitError != nil {
+			return waitError
+		}
+		var change postgresChange
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			log.Println("Ignoring a change notification that cannot be read: ", err)
+			continue
+		}
+		if change.Instance == me.instance {
+			continue
+		}
+		if change.User != "" {
+			if err := me.reloadUser(change.User); err != nil {
+				log.Println("Error in reloading user", change.User, err)
+			}
+		}
+		if change.Group != "" {
+			if err := me.reloadGroup(change.Group); err != nil {
+				log.Println("Error in reloading group", change.Group, err)
+			}
+		}
+	}
+}
+
+// reloadUser reads a user that another instance has changed from the db, or forgets them if they have been deleted
+func (me *UserPostgresCollection) reloadUser(username string) error {
+
+	ctx := context.Background()
+	var user User
+	var dbPassword sql.NullString
+	var dbAdmin sql.NullBool
+	var dbSuperUser sql.NullBool
+	selectSQL := "SELECT username,pwd,admin,superuser,clientids,groups FROM hmqusers WHERE username = $1"
+	scanError := me.DB.QueryRow(ctx, selectSQL, username).Scan(&user.UserName, &dbPassword, &dbAdmin, &dbSuperUser, &user.ClientIDs, &user.Groups)
+	if errors.Is(scanError, pgx.ErrNoRows) {
+		me.Lock()
+		if k, found := me.usernames[username]; found {
+			me.forgetUser(k)
+		}
+		me.Unlock()
+		notifyUserChange(username)
+		return nil
+	}
+	if scanError != nil {
+		return scanError
+	}
+	user.Password = dbPassword.String
+	user.Admin = dbAdmin.Bool
+	user.SuperUser = dbSuperUser.Bool
+
+	TopicRows, TopicRowsError := me.DB.Query(ctx, "SELECT topicstring,pub,sub,deny FROM hmqtopics WHERE username = $1 ORDER BY id", username)
+	if TopicRowsError != nil {
+		return TopicRowsError
+	}
+	for TopicRows.Next() {
+		var topic Topic
+		if err := TopicRows.Scan(&topic.TopicString, &topic.Pub, &topic.Sub, &topic.Deny); err != nil {
+			TopicRows.Close()
+			return err
+		}
+		user.Topics = append(user.Topics, topic)
+	}
+	TopicRows.Close()
+	if err := TopicRows.Err(); err != nil {
+		return err
+	}
+	user.IndexTopics()
+
+	me.Lock()
+	if k, found := me.usernames[username]; found {
+		me.Users[k] = user
+	} else {
+		me.Users = append(me.Users, user)
+		me.usernames[username] = len(me.Users) - 1
+	}
+	me.Unlock()
+	notifyUserChange(username)
+	return nil
+}
+
+// reloadGroup reads a group that another instance has changed from the db, or forgets it if it has been
+// deleted. The members of a deleted group are announced separately
+func (me *UserPostgresCollection) reloadGroup(name string) error {
+
+	var group Group
+	selectSQL := "SELECT name,topics FROM hmqgroups WHERE name = $1"
+	scanError := me.DB.QueryRow(context.Background(), selectSQL, name).Scan(&group.Name, &group.Topics)
+	if scanError != nil && errors.Is(scanError, pgx.ErrNoRows) == false {
+		return scanError
+	}
+	group.IndexTopics()
+
+	me.Lock()
+	found := -1
+	for k, v := range me.Groups {
+		if v.Name == name {
+			found = k
+			break
+		}
+	}
+	switch {
+	case scanError != nil && found >= 0:
+		me.Groups[found] = me.Groups[len(me.Groups)-1]
+		me.Groups = me.Groups[:len(me.Groups)-1]
+	case scanError == nil && found >= 0:
+		me.Groups[found] = group
+	case scanError == nil:
+		me.Groups = append(me.Groups, group)
+	}
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
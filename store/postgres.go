@@ -3,12 +3,14 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
+	"strconv"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/rs/xid"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,15 +23,28 @@ func InitPostgres(connString string) *UserPostgresCollection {
 	log.Println("DB Connected")
 	if UsersPostgres.DBerr != nil {
 		log.Println("Unabled to Create DB Connection", UsersPostgres.DBerr)
+	} else {
+		UsersPostgres.DBerr = migratePostgres(UsersPostgres.DB)
+		if UsersPostgres.DBerr != nil {
+			log.Println("Unable to bring the DB schema up to date", UsersPostgres.DBerr)
+		}
+	}
+	if UsersPostgres.DBerr == nil {
+		UsersPostgres.instance = newInstanceID()
+		go UsersPostgres.listen(connString)
 	}
+	UsersPostgres.usernames = indexUsers(UsersPostgres.Users)
 	return &UsersPostgres
 }
 
 // Load loads the users along with their topics from the db
 func (me *UserPostgresCollection) Load() error {
 
+	if me.DBerr != nil {
+		return me.DBerr
+	}
 	var usersOut []User
-	LoadUserQuery := "SELECT username,pwd,token,admin,topics FROM hmqusers"
+	LoadUserQuery := "SELECT username,pwd,token,admin,superuser,clientids,groups FROM hmqusers"
 	UserRows, UserRowsError := me.DB.Query(context.Background(), LoadUserQuery)
 	if UserRowsError != nil {
 		log.Println(UserRowsError)
@@ -43,23 +58,157 @@ func (me *UserPostgresCollection) Load() error {
 		var dbPassword sql.NullString
 		var dbToken sql.NullString
 		var dbAdmin sql.NullBool
+		var dbSuperUser sql.NullBool
 
-		scanner := UserRows.Scan(&dbUserName, &dbPassword, &dbToken, &dbAdmin, &dbUser.Topics)
+		scanner := UserRows.Scan(&dbUserName, &dbPassword, &dbToken, &dbAdmin, &dbSuperUser, &dbUser.ClientIDs, &dbUser.Groups)
 		if scanner != nil {
 			log.Println("scanner error: ", scanner)
 		}
 		dbUser.UserName = dbUserName.String
 		dbUser.Password = dbPassword.String
-		dbUser.Token = dbToken.String
+		// Tokens used to be kept on the user and never expired, they become sessions
+		if dbToken.String != "" {
+			legacyTokenError := me.moveLegacyToken(dbUserName.String, dbToken.String)
+			if legacyTokenError != nil {
+				return legacyTokenError
+			}
+		}
 		dbUser.Admin = dbAdmin.Bool
+		dbUser.SuperUser = dbSuperUser.Bool
 		usersOut = append(usersOut, dbUser)
 	}
+
+	topicsLoadError := me.loadTopics(usersOut)
+	if topicsLoadError != nil {
+		return topicsLoadError
+	}
+
+	groupsOut, groupsLoadError := me.loadGroups()
+	if groupsLoadError != nil {
+		return groupsLoadError
+	}
+
+	hashTokensError := me.hashLegacySessionTokens()
+	if hashTokensError != nil {
+		return hashTokensError
+	}
+
 	me.Lock()
 	me.Users = usersOut
+	me.Groups = groupsOut
+	me.usernames = indexUsers(me.Users)
 	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// loadTopics loads the topics of the users from the hmqtopics table, in the order they were added
+func (me *UserPostgresCollection) loadTopics(users []User) error {
+
+	usernames := indexUsers(users)
+	LoadTopicQuery := "SELECT username,topicstring,pub,sub,deny FROM hmqtopics ORDER BY id"
+	TopicRows, TopicRowsError := me.DB.Query(context.Background(), LoadTopicQuery)
+	if TopicRowsError != nil {
+		log.Println(TopicRowsError)
+		return TopicRowsError
+	}
+	defer TopicRows.Close()
+
+	for TopicRows.Next() {
+		var username string
+		var topic Topic
+		scanner := TopicRows.Scan(&username, &topic.TopicString, &topic.Pub, &topic.Sub, &topic.Deny)
+		if scanner != nil {
+			log.Println("scanner error: ", scanner)
+			return scanner
+		}
+		if k, found := usernames[username]; found {
+			users[k].Topics = append(users[k].Topics, topic)
+		}
+	}
+	for k := range users {
+		users[k].IndexTopics()
+	}
+	return TopicRows.Err()
+}
+
+// hashLegacySessionTokens replaces any session token stored in plain text with its hash
+func (me *UserPostgresCollection) hashLegacySessionTokens() error {
+
+	selectSQL := "SELECT token FROM hmqsessions WHERE tokenhash IS NULL AND token IS NOT NULL"
+	TokenRows, TokenRowsError := me.DB.Query(context.Background(), selectSQL)
+	if TokenRowsError != nil {
+		log.Println(TokenRowsError)
+		return TokenRowsError
+	}
+	var tokens []string
+	for TokenRows.Next() {
+		var dbToken string
+		scanner := TokenRows.Scan(&dbToken)
+		if scanner != nil {
+			log.Println("scanner error: ", scanner)
+			continue
+		}
+		tokens = append(tokens, dbToken)
+	}
+	TokenRows.Close()
+
+	for _, v := range tokens {
+		updateSQL := "UPDATE hmqsessions SET tokenhash = $1, token = NULL WHERE token = $2"
+		_, result := me.DB.Exec(context.Background(), updateSQL, hashToken(v), v)
+		if result != nil {
+			log.Println("Error in hashing session token: ", result)
+			return result
+		}
+	}
+	if len(tokens) > 0 {
+		log.Println("Replaced plain text session tokens with hashes:", len(tokens))
+	}
 	return nil
 }
 
+// moveLegacyToken turns a plain text token stored on the user into a hashed session and clears it from the user
+func (me *UserPostgresCollection) moveLegacyToken(username string, token string) error {
+
+	sessionAddError := me.AddSession(legacySession(username, token))
+	if sessionAddError != nil {
+		return sessionAddError
+	}
+	clearSQL := "UPDATE hmqusers SET token = NULL WHERE username = $1;"
+	_, result := me.DB.Exec(context.Background(), clearSQL, username)
+	if result != nil {
+		log.Println("Error in clearing token: ", result)
+	}
+	return result
+}
+
+// loadGroups loads the groups along with their topics from the db
+func (me *UserPostgresCollection) loadGroups() ([]Group, error) {
+
+	var groupsOut []Group
+	LoadGroupQuery := "SELECT name,topics FROM hmqgroups"
+	GroupRows, GroupRowsError := me.DB.Query(context.Background(), LoadGroupQuery)
+	if GroupRowsError != nil {
+		log.Println(GroupRowsError)
+		return groupsOut, GroupRowsError
+	}
+	defer GroupRows.Close()
+
+	for GroupRows.Next() {
+		var dbGroup Group
+		var dbName sql.NullString
+
+		scanner := GroupRows.Scan(&dbName, &dbGroup.Topics)
+		if scanner != nil {
+			log.Println("scanner error: ", scanner)
+		}
+		dbGroup.Name = dbName.String
+		dbGroup.IndexTopics()
+		groupsOut = append(groupsOut, dbGroup)
+	}
+	return groupsOut, nil
+}
+
 // Login logs the user in and generates a token for the session if required
 func (me *UserPostgresCollection) Login(username string, password string, requesttoken bool) (User, error) {
 
@@ -76,19 +225,24 @@ func (me *UserPostgresCollection) Login(username string, password string, reques
 	}
 
 	if requesttoken == true {
-		// Create a token for the session
-		token := xid.New().String()
-		userLoggingIn.Token = token
-		tokenUpdateError := me.UpdateUserToken(username, token)
-		if tokenUpdateError != nil {
+		// Create a session
+		session, token, sessionError := newSession(username)
+		if sessionError != nil {
 			var blankUser User
-			return blankUser, tokenUpdateError
+			return blankUser, sessionError
 		}
+		sessionAddError := me.AddSession(session)
+		if sessionAddError != nil {
+			var blankUser User
+			return blankUser, sessionAddError
+		}
+		userLoggingIn.Token = token
 	}
 	return userLoggingIn, nil
 }
 
 // AddUser adds a new user to the collection
+// The db is written first, under the lock, as in the sqlite and bolt stores, so a failed write leaves memory as it was
 func (me *UserPostgresCollection) AddUser(user User) error {
 	// Validate the user
 	// if the username and/or the password are blank then reject
@@ -97,29 +251,79 @@ func (me *UserPostgresCollection) AddUser(user User) error {
 	}
 	//Add the User to the collection
 	me.Lock()
-	for _, v := range me.Users {
-		if v.UserName == user.UserName {
-			me.Unlock()
-			return errors.New("User already exists")
-		}
+	if _, exists := me.usernames[user.UserName]; exists {
+		me.Unlock()
+		return errors.New("User already exists")
 	}
 
 	hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
+		me.Unlock()
 		log.Println("Cannot create password hash")
 		return errors.New("Cannot create password hash")
 	}
-
 	user.Password = string(hashPWD)
-	me.Users = append(me.Users, user)
-	me.Unlock()
 
-	insertSQL := "INSERT INTO hmqusers (username, pwd, admin) VALUES ($1, $2, $3)"
-	_, result := me.DB.Exec(context.Background(), insertSQL, user.UserName, user.Password, user.Admin)
+	result := me.inTransaction(func(tx pgx.Tx) error {
+		insertSQL := "INSERT INTO hmqusers (username, pwd, admin, superuser, clientids, groups) VALUES ($1, $2, $3, $4, $5, $6)"
+		_, err := tx.Exec(context.Background(), insertSQL, user.UserName, user.Password, user.Admin, user.SuperUser, user.ClientIDs, user.Groups)
+		if err != nil {
+			return err
+		}
+		return insertTopics(tx, user.UserName, user.Topics)
+	})
 	if result != nil {
+		me.Unlock()
 		log.Println("Error in adding a user", result)
+		return result
 	}
-	return result
+	user.IndexTopics()
+	me.Users = append(me.Users, user)
+	me.usernames[user.UserName] = len(me.Users) - 1
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	me.announceUser(user.UserName)
+	return nil
+}
+
+// inTransaction runs the statements of a change in a transaction, which is rolled back if any of them fails
+func (me *UserPostgresCollection) inTransaction(statements func(tx pgx.Tx) error) error {
+
+	tx, beginError := me.DB.Begin(context.Background())
+	if beginError != nil {
+		return beginError
+	}
+	if err := statements(tx); err != nil {
+		tx.Rollback(context.Background())
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// insertTopics adds rows to the hmqtopics table for the topics of a user
+func insertTopics(tx pgx.Tx, username string, topics TopicArray) error {
+
+	insertSQL := "INSERT INTO hmqtopics (username, topicstring, pub, sub, deny) VALUES ($1, $2, $3, $4, $5)"
+	for _, v := range topics {
+		_, err := tx.Exec(context.Background(), insertSQL, username, v.TopicString, v.Pub, v.Sub, v.Deny)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameTopics checks whether two lists of topics are the same, in the same order
+func sameTopics(a TopicArray, b TopicArray) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
 }
 
 // EditUser edits an existing user
@@ -139,106 +343,235 @@ func (me *UserPostgresCollection) EditUser(user User) error {
 	if user.Password != "" {
 		user.Password = string(hashPWD)
 	}
-	//Add the User to the collection
+	//Edit the User in the collection
 	me.Lock()
-	found := false
-	foundindex := 0
-	for k, v := range me.Users {
-		if v.UserName == user.UserName {
-			found = true
-			foundindex = k
-			break
-		}
-	}
-	me.Unlock()
-
+	foundindex, found := me.usernames[user.UserName]
 	if !found {
+		me.Unlock()
 		return errors.New("User not found")
 	}
-
-	me.Lock()
-	me.Users[foundindex].Admin = user.Admin
-	if user.Password != "" {
-		me.Users[foundindex].Password = user.Password
+	if user.Password == "" {
+		user.Password = me.Users[foundindex].Password
 	}
-	me.Unlock()
 
-	insertSQL := "UPDATE hmqusers SET pwd=$1, admin=$2 WHERE username = $3"
-	_, result := me.DB.Exec(context.Background(), insertSQL, user.Password, user.Admin, user.UserName)
+	insertSQL := "UPDATE hmqusers SET pwd=$1, admin=$2, superuser=$3 WHERE username = $4"
+	_, result := me.DB.Exec(context.Background(), insertSQL, user.Password, user.Admin, user.SuperUser, user.UserName)
 	if result != nil {
+		me.Unlock()
 		log.Println("Error in editing user: ", result)
+		return result
 	}
-	return result
+	me.Users[foundindex].Admin = user.Admin
+	me.Users[foundindex].SuperUser = user.SuperUser
+	me.Users[foundindex].Password = user.Password
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	me.announceUser(user.UserName)
+	return nil
 }
 
 // UpdateUser accepts a user object and updates the relevant user
 // users cannot change their name - so we can rely upon username as a key
 func (me *UserPostgresCollection) UpdateUser(user User) error {
 
+	// as the db is written first the topics compared with below are always those in the db
 	me.Lock()
-	for k, v := range me.Users {
-		if v.UserName == user.UserName {
-			if v.Password != user.Password {
-				hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-				if err != nil {
-					me.Unlock()
-					log.Println("Cannot create password hash")
-					return errors.New("Cannot create password hash")
-				}
-				user.Password = string(hashPWD)
+	if k, found := me.usernames[user.UserName]; found {
+		v := me.Users[k]
+		if v.Password != user.Password {
+			hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+			if err != nil {
+				me.Unlock()
+				log.Println("Cannot create password hash")
+				return errors.New("Cannot create password hash")
 			}
-			me.Users[k] = user
-			me.Unlock()
+			user.Password = string(hashPWD)
+		}
 
-			insertSQL := "UPDATE hmqusers SET pwd=$1, admin=$2, topics=$3 WHERE username = $4"
-			_, result := me.DB.Exec(context.Background(), insertSQL, user.Password, user.Admin, user.Topics, user.UserName)
-			if result != nil {
-				log.Println("Error in updating user: ", result)
+		result := me.inTransaction(func(tx pgx.Tx) error {
+			updateSQL := "UPDATE hmqusers SET pwd=$1, admin=$2, superuser=$3, clientids=$4, groups=$5 WHERE username = $6"
+			_, err := tx.Exec(context.Background(), updateSQL, user.Password, user.Admin, user.SuperUser, user.ClientIDs, user.Groups, user.UserName)
+			if err != nil || sameTopics(v.Topics, user.Topics) {
+				return err
+			}
+			// the topics are only rewritten when they have changed, single topics are changed by the topic methods
+			_, err = tx.Exec(context.Background(), "DELETE FROM hmqtopics WHERE username = $1", user.UserName)
+			if err != nil {
+				return err
 			}
+			return insertTopics(tx, user.UserName, user.Topics)
+		})
+		if result != nil {
+			me.Unlock()
+			log.Println("Error in updating user: ", result)
 			return result
 		}
+		user.IndexTopics()
+		me.Users[k] = user
+		me.Unlock()
+		notifyUserChange(user.UserName)
+		me.announceUser(user.UserName)
+		return nil
 	}
 	me.Unlock()
 	return errors.New("Could not find user")
 }
 
+// PutUsers adds the users or replaces those that exist, as they are given and in a single transaction.
+// The passwords must already be bcrypt hashes and are kept unchanged, as when copying the users from another store
+func (me *UserPostgresCollection) PutUsers(users []User) error {
+
+	if err := checkPutUsers(users); err != nil {
+		return err
+	}
+	me.Lock()
+	result := me.inTransaction(func(tx pgx.Tx) error {
+		// ON CONFLICT needs a unique key on the username, which a hand made hmqusers table is given by migration 5
+		upsertSQL := `INSERT INTO hmqusers (username, pwd, admin, superuser, clientids, groups) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (username) DO UPDATE SET pwd=EXCLUDED.pwd, admin=EXCLUDED.admin, superuser=EXCLUDED.superuser,
+			clientids=EXCLUDED.clientids, groups=EXCLUDED.groups`
+		for _, v := range users {
+			if _, err := tx.Exec(context.Background(), upsertSQL, v.UserName, v.Password, v.Admin, v.SuperUser, v.ClientIDs, v.Groups); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(context.Background(), "DELETE FROM hmqtopics WHERE username = $1", v.UserName); err != nil {
+				return err
+			}
+			if err := insertTopics(tx, v.UserName, v.Topics); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in putting users: ", result)
+		return result
+	}
+	me.Users = putUsers(me.Users, me.usernames, users)
+	me.Unlock()
+	notifyUserChange("")
+	for _, v := range users {
+		me.announceUser(v.UserName)
+	}
+	return nil
+}
+
 // DeleteUser removes a user from the collection, using the username as a key
 func (me *UserPostgresCollection) DeleteUser(username string) error {
 
 	me.Lock()
-	for k, v := range me.Users {
-		if v.UserName == username {
-			me.Users[k] = me.Users[len(me.Users)-1]
-			me.Users = me.Users[:len(me.Users)-1]
-			me.Unlock()
-			insertSQL := "DELETE FROM hmqusers WHERE username=$1;"
-			_, result := me.DB.Exec(context.Background(), insertSQL, username)
-			if result != nil {
-				log.Println("Error in deleting user: ", result)
-			}
+	if k, found := me.usernames[username]; found {
+		me.forgetUser(k)
+		me.Unlock()
+		notifyUserChange(username)
+		insertSQL := "DELETE FROM hmqusers WHERE username=$1;"
+		_, result := me.DB.Exec(context.Background(), insertSQL, username)
+		if result != nil {
+			log.Println("Error in deleting user: ", result)
 			return result
 		}
+		me.announceUser(username)
+		return me.DeleteUserSessions(username)
 	}
 	me.Unlock()
 	return errors.New("User Not Found")
 }
 
-// GetUserByToken returns a user from the collection using the token as a key
+// forgetUser removes a user from memory, moving the last user into their place. The caller must hold the lock
+func (me *UserPostgresCollection) forgetUser(k int) {
+	username := me.Users[k].UserName
+	last := len(me.Users) - 1
+	me.Users[k] = me.Users[last]
+	me.usernames[me.Users[k].UserName] = k
+	delete(me.usernames, username)
+	me.Users = me.Users[:last]
+}
+
+// GetUserByToken returns the user logged in with a session token, expired sessions are rejected and
+// the expiry of a valid session is moved on
+// Sessions are read from the db rather than cached so that every instance sees the same sessions
 func (me *UserPostgresCollection) GetUserByToken(token string) (User, error) {
+	return me.GetUserBySessionID(hashToken(token))
+}
+
+// GetUserBySessionID returns the user a session belongs to, renewing the session
+func (me *UserPostgresCollection) GetUserBySessionID(tokenHash string) (User, error) {
 
 	if len(me.Users) == 0 {
 		me.Load()
 	}
-	me.RLock()
-	defer me.RUnlock()
+	var blankUser User
+	var session Session
 
-	for _, v := range me.Users {
-		if v.Token == token {
-			return v, nil
+	// Looking the session up by the keyed hash gives nothing away about the token through timing,
+	// the hash found is still compared in constant time as a belt and braces check
+	selectSQL := "SELECT tokenhash, username, created, expires FROM hmqsessions WHERE tokenhash = $1"
+	scanError := me.DB.QueryRow(context.Background(), selectSQL, tokenHash).Scan(&session.TokenHash, &session.UserName, &session.Created, &session.Expires)
+	if scanError != nil || tokenHashMatch(session.TokenHash, tokenHash) == false {
+		return blankUser, errors.New("Session not found")
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		return blankUser, errors.New("Session expired")
+	}
+	if session.renew(now) {
+		updateSQL := "UPDATE hmqsessions SET expires = $1 WHERE tokenhash = $2"
+		_, result := me.DB.Exec(context.Background(), updateSQL, session.Expires, tokenHash)
+		if result != nil {
+			log.Println("Error in renewing session: ", result)
 		}
 	}
-	var blankUser User
-	return blankUser, errors.New("User not found")
+	return me.GetUserByUsername(session.UserName)
+}
+
+// AddSession stores a new session, any sessions that have expired are cleared out at the same time
+func (me *UserPostgresCollection) AddSession(session Session) error {
+
+	pruneSQL := "DELETE FROM hmqsessions WHERE expires < $1"
+	_, pruneResult := me.DB.Exec(context.Background(), pruneSQL, time.Now())
+	if pruneResult != nil {
+		log.Println("Error in clearing expired sessions: ", pruneResult)
+	}
+
+	insertSQL := "INSERT INTO hmqsessions (tokenhash, username, created, expires) VALUES ($1, $2, $3, $4)"
+	_, result := me.DB.Exec(context.Background(), insertSQL, session.TokenHash, session.UserName, session.Created, session.Expires)
+	if result != nil {
+		log.Println("Error in adding a session: ", result)
+	}
+	return result
+}
+
+// DeleteSession removes a session, logging it out
+func (me *UserPostgresCollection) DeleteSession(token string) error {
+	return me.DeleteSessionByID(hashToken(token))
+}
+
+// DeleteSessionByID removes a session by its id
+func (me *UserPostgresCollection) DeleteSessionByID(tokenHash string) error {
+
+	deleteSQL := "DELETE FROM hmqsessions WHERE tokenhash = $1"
+	tag, result := me.DB.Exec(context.Background(), deleteSQL, tokenHash)
+	if result != nil {
+		log.Println("Error in deleting session: ", result)
+		return result
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("Session not found")
+	}
+	return nil
+}
+
+// DeleteUserSessions removes every session of a user
+func (me *UserPostgresCollection) DeleteUserSessions(username string) error {
+
+	deleteSQL := "DELETE FROM hmqsessions WHERE username = $1"
+	_, result := me.DB.Exec(context.Background(), deleteSQL, username)
+	if result != nil {
+		log.Println("Error in deleting sessions: ", result)
+	}
+	return result
 }
 
 // GetUserByUsername returns a user from the collection using username as a key
@@ -246,10 +579,8 @@ func (me *UserPostgresCollection) GetUserByUsername(username string) (User, erro
 
 	me.RLock()
 	defer me.RUnlock()
-	for _, v := range me.Users {
-		if v.UserName == username {
-			return v, nil
-		}
+	if k, found := me.usernames[username]; found {
+		return me.Users[k], nil
 	}
 	var blankUser User
 	return blankUser, errors.New("User not found")
@@ -265,83 +596,431 @@ func (me *UserPostgresCollection) GetUsers() []User {
 // AddTopicToUser adds a new topic to an existing user
 func (me *UserPostgresCollection) AddTopicToUser(username string, topic Topic) error {
 
-	targetUser, getTargetUserError := me.GetUserByUsername(username)
-	if getTargetUserError != nil {
+	me.Lock()
+	k, found := me.usernames[username]
+	if !found {
+		me.Unlock()
 		return errors.New("Could not find user")
 	}
-
-	for _, v := range targetUser.Topics {
+	for _, v := range me.Users[k].Topics {
 		if v.TopicString == topic.TopicString {
+			me.Unlock()
 			return errors.New("Topic already exists")
 		}
 	}
 
-	targetUser.Topics = append(targetUser.Topics, topic)
-	return me.UpdateUser(targetUser)
+	insertSQL := "INSERT INTO hmqtopics (username, topicstring, pub, sub, deny) VALUES ($1, $2, $3, $4, $5)"
+	_, result := me.DB.Exec(context.Background(), insertSQL, username, topic.TopicString, topic.Pub, topic.Sub, topic.Deny)
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in adding a topic: ", result)
+		return result
+	}
+	// the topics are copied as the user handed out by GetUserByUsername shares them
+	topics := make(TopicArray, 0, len(me.Users[k].Topics)+1)
+	me.Users[k].Topics = append(append(topics, me.Users[k].Topics...), topic)
+	me.Users[k].IndexTopics()
+	me.Unlock()
+	notifyUserChange(username)
+	me.announceUser(username)
+	return nil
 }
 
 // EditTopicForUser edits and existing topic for an existing user in the collection
 func (me *UserPostgresCollection) EditTopicForUser(username string, topic Topic) error {
 
-	targetUser, getTargetUserError := me.GetUserByUsername(username)
-	if getTargetUserError != nil {
+	me.Lock()
+	k, found := me.usernames[username]
+	if !found {
+		me.Unlock()
 		return errors.New("Could not find user")
 	}
-
-	found := false
-	me.RLock()
-	for k, v := range targetUser.Topics {
+	for t, v := range me.Users[k].Topics {
 		if v.TopicString == topic.TopicString {
-			targetUser.Topics[k] = topic
-			found = true
-			break
+			updateSQL := "UPDATE hmqtopics SET pub=$1, sub=$2, deny=$3 WHERE username = $4 AND topicstring = $5"
+			_, result := me.DB.Exec(context.Background(), updateSQL, topic.Pub, topic.Sub, topic.Deny, username, topic.TopicString)
+			if result != nil {
+				me.Unlock()
+				log.Println("Error in editing a topic: ", result)
+				return result
+			}
+			topics := make(TopicArray, len(me.Users[k].Topics))
+			copy(topics, me.Users[k].Topics)
+			topics[t] = topic
+			me.Users[k].Topics = topics
+			me.Users[k].IndexTopics()
+			me.Unlock()
+			notifyUserChange(username)
+			me.announceUser(username)
+			return nil
 		}
 	}
-	me.RUnlock()
+	me.Unlock()
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromUser removes a topic permission for that user if the topic does not exist it returns an error
+func (me *UserPostgresCollection) DeleteTopicFromUser(username string, topicString string) error {
+
+	me.Lock()
+	k, found := me.usernames[username]
 	if !found {
-		return errors.New("Topic not found")
+		me.Unlock()
+		return errors.New("Could not find user")
 	}
+	for t, v := range me.Users[k].Topics {
+		if v.TopicString == topicString {
+			deleteSQL := "DELETE FROM hmqtopics WHERE username = $1 AND topicstring = $2"
+			_, result := me.DB.Exec(context.Background(), deleteSQL, username, topicString)
+			if result != nil {
+				me.Unlock()
+				log.Println("Error in deleting a topic: ", result)
+				return result
+			}
+			topics := make(TopicArray, 0, len(me.Users[k].Topics)-1)
+			topics = append(topics, me.Users[k].Topics[:t]...)
+			me.Users[k].Topics = append(topics, me.Users[k].Topics[t+1:]...)
+			me.Users[k].IndexTopics()
+			me.Unlock()
+			notifyUserChange(username)
+			me.announceUser(username)
+			return nil
+		}
+	}
+	me.Unlock()
+	return errors.New("Topic not found")
+}
+
+// AddClientIDToUser adds an allowed client id (or client id pattern) to an existing user
+func (me *UserPostgresCollection) AddClientIDToUser(username string, clientID string) error {
+
+	if clientID == "" {
+		return errors.New("Client id cannot be blank")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for _, v := range targetUser.ClientIDs {
+		if v == clientID {
+			return errors.New("Client id already exists")
+		}
+	}
+
+	// the client ids are copied as the stored user shares them
+	clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)+1)
+	targetUser.ClientIDs = append(append(clientIDs, targetUser.ClientIDs...), clientID)
 	return me.UpdateUser(targetUser)
 }
 
-// DeleteTopicFromUser removes a topic permission for that user if the topic does not exist it returns an error
-func (me *UserPostgresCollection) DeleteTopicFromUser(username string, topicString string) error {
+// DeleteClientIDFromUser removes an allowed client id from a user, if the client id does not exist it returns an error
+func (me *UserPostgresCollection) DeleteClientIDFromUser(username string, clientID string) error {
 
 	targetUser, getTargetUserError := me.GetUserByUsername(username)
 	if getTargetUserError != nil {
 		return errors.New("Could not find user")
 	}
 
-	for k, v := range targetUser.Topics {
-		if v.TopicString == topicString {
-			targetUser.Topics[k] = targetUser.Topics[len(targetUser.Topics)-1]
-			targetUser.Topics = targetUser.Topics[:len(targetUser.Topics)-1]
+	for k, v := range targetUser.ClientIDs {
+		if v == clientID {
+			clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)-1)
+			clientIDs = append(clientIDs, targetUser.ClientIDs[:k]...)
+			targetUser.ClientIDs = append(clientIDs, targetUser.ClientIDs[k+1:]...)
 
 			return me.UpdateUser(targetUser)
 		}
 	}
-	return errors.New("Topic not found")
+	return errors.New("Client id not found")
+}
+
+// GetGroups returns all the groups from the collection
+func (me *UserPostgresCollection) GetGroups() []Group {
+	me.RLock()
+	defer me.RUnlock()
+	return me.Groups
+}
+
+// GetGroup returns a group from the collection using its name as a key
+func (me *UserPostgresCollection) GetGroup(name string) (Group, error) {
+
+	me.RLock()
+	defer me.RUnlock()
+
+	for _, v := range me.Groups {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	var blankGroup Group
+	return blankGroup, errors.New("Group not found")
 }
 
-// UpdateUserToken updates the token for an existing user upon login
-func (me *UserPostgresCollection) UpdateUserToken(username string, newtoken string) error {
+// AddGroup adds a new group to the collection
+func (me *UserPostgresCollection) AddGroup(group Group) error {
+	if group.Name == "" {
+		return errors.New("Group name must be non-blank")
+	}
 
 	me.Lock()
-	for k, v := range me.Users {
-		if v.UserName == username {
-			fmt.Println("v.Token: ", v.Token)
-			v.Token = newtoken
-			me.Users[k] = v
+	for _, v := range me.Groups {
+		if v.Name == group.Name {
 			me.Unlock()
-			fmt.Println("newtoken: ", newtoken)
-			insertSQL := "UPDATE hmqusers SET token = $1 WHERE username = $2;"
-			_, result := me.DB.Exec(context.Background(), insertSQL, newtoken, username)
+			return errors.New("Group already exists")
+		}
+	}
+
+	insertSQL := "INSERT INTO hmqgroups (name, topics) VALUES ($1, $2)"
+	_, result := me.DB.Exec(context.Background(), insertSQL, group.Name, group.Topics)
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in adding a group", result)
+		return result
+	}
+	group.IndexTopics()
+	me.Groups = append(me.Groups, group)
+	me.Unlock()
+	me.announceGroup(group.Name)
+	return nil
+}
+
+// UpdateGroup accepts a group object and replaces the group with the same name
+func (me *UserPostgresCollection) UpdateGroup(group Group) error {
+
+	me.Lock()
+	for k, v := range me.Groups {
+		if v.Name == group.Name {
+			insertSQL := "UPDATE hmqgroups SET topics=$1 WHERE name = $2"
+			_, result := me.DB.Exec(context.Background(), insertSQL, group.Topics, group.Name)
 			if result != nil {
-				log.Println("Error in updating token: ", result)
+				me.Unlock()
+				log.Println("Error in updating group: ", result)
+				return result
 			}
-			return result
+			group.IndexTopics()
+			me.Groups[k] = group
+			me.Unlock()
+			notifyUserChange("")
+			me.announceGroup(group.Name)
+			return nil
 		}
 	}
 	me.Unlock()
-	return errors.New("User not found")
+	return errors.New("Could not find group")
+}
+
+// PutGroups adds the groups or replaces those that exist, as they are given and in a single transaction
+func (me *UserPostgresCollection) PutGroups(groups []Group) error {
+
+	if err := checkPutGroups(groups); err != nil {
+		return err
+	}
+	me.Lock()
+	result := me.inTransaction(func(tx pgx.Tx) error {
+		upsertSQL := "INSERT INTO hmqgroups (name, topics) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET topics=EXCLUDED.topics"
+		for _, v := range groups {
+			if _, err := tx.Exec(context.Background(), upsertSQL, v.Name, v.Topics); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in putting groups: ", result)
+		return result
+	}
+	me.Groups = putGroups(me.Groups, groups)
+	me.Unlock()
+	notifyUserChange("")
+	for _, v := range groups {
+		me.announceGroup(v.Name)
+	}
+	return nil
+}
+
+// DeleteGroup removes a group from the collection and takes every user out of it
+func (me *UserPostgresCollection) DeleteGroup(name string) error {
+
+	me.Lock()
+	found := false
+	for k, v := range me.Groups {
+		if v.Name == name {
+			me.Groups[k] = me.Groups[len(me.Groups)-1]
+			me.Groups = me.Groups[:len(me.Groups)-1]
+			found = true
+			break
+		}
+	}
+	if !found {
+		me.Unlock()
+		return errors.New("Group Not Found")
+	}
+	var members []User
+	for k, v := range me.Users {
+		if v.InGroup(name) {
+			me.Users[k].Groups = removeGroupName(v.Groups, name)
+			members = append(members, me.Users[k])
+		}
+	}
+	me.Unlock()
+	notifyUserChange("")
+
+	for _, v := range members {
+		updateSQL := "UPDATE hmqusers SET groups=$1 WHERE username = $2"
+		_, result := me.DB.Exec(context.Background(), updateSQL, v.Groups, v.UserName)
+		if result != nil {
+			log.Println("Error in removing user from group: ", result)
+			return result
+		}
+	}
+	deleteSQL := "DELETE FROM hmqgroups WHERE name=$1;"
+	_, result := me.DB.Exec(context.Background(), deleteSQL, name)
+	if result != nil {
+		log.Println("Error in deleting group: ", result)
+		return result
+	}
+	me.announceGroup(name)
+	for _, v := range members {
+		me.announceUser(v.UserName)
+	}
+	return nil
+}
+
+// AddTopicToGroup adds a new topic to an existing group
+func (me *UserPostgresCollection) AddTopicToGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for _, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			return errors.New("Topic already exists")
+		}
+	}
+
+	topics := make(TopicArray, 0, len(targetGroup.Topics)+1)
+	targetGroup.Topics = append(append(topics, targetGroup.Topics...), topic)
+	return me.UpdateGroup(targetGroup)
+}
+
+// EditTopicForGroup edits an existing topic for an existing group in the collection
+func (me *UserPostgresCollection) EditTopicForGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			topics := make(TopicArray, len(targetGroup.Topics))
+			copy(topics, targetGroup.Topics)
+			topics[k] = topic
+			targetGroup.Topics = topics
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromGroup removes a topic permission from a group, if the topic does not exist it returns an error
+func (me *UserPostgresCollection) DeleteTopicFromGroup(name string, topicString string) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topicString {
+			topics := make(TopicArray, 0, len(targetGroup.Topics)-1)
+			topics = append(topics, targetGroup.Topics[:k]...)
+			targetGroup.Topics = append(topics, targetGroup.Topics[k+1:]...)
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// AddUserToGroup makes an existing user a member of an existing group
+func (me *UserPostgresCollection) AddUserToGroup(username string, name string) error {
+
+	_, getGroupError := me.GetGroup(name)
+	if getGroupError != nil {
+		return errors.New("Could not find group")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) {
+		return errors.New("User already in group")
+	}
+
+	groups := make(GroupArray, 0, len(targetUser.Groups)+1)
+	targetUser.Groups = append(append(groups, targetUser.Groups...), name)
+	return me.UpdateUser(targetUser)
+}
+
+// RemoveUserFromGroup takes a user out of a group
+func (me *UserPostgresCollection) RemoveUserFromGroup(username string, name string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) == false {
+		return errors.New("User not in group")
+	}
+
+	targetUser.Groups = removeGroupName(targetUser.Groups, name)
+	return me.UpdateUser(targetUser)
+}
+
+// AddAuditEntry appends an entry to the audit trail, the table refuses updates and deletes
+func (me *UserPostgresCollection) AddAuditEntry(entry AuditEntry) error {
+
+	insertSQL := "INSERT INTO hmqaudit (time, actor, action, target, before, after, sourceip) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, result := me.DB.Exec(context.Background(), insertSQL, entry.Time.UTC(), entry.Actor, entry.Action, entry.Target, nullJSON(entry.Before), nullJSON(entry.After), entry.SourceIP)
+	if result != nil {
+		log.Println("Error in adding an audit entry: ", result)
+	}
+	return result
+}
+
+// GetAuditEntries returns the page of audit entries the filter selects, newest first, along with how
+// many entries it selects in all
+func (me *UserPostgresCollection) GetAuditEntries(filter AuditFilter) ([]AuditEntry, int, error) {
+
+	ctx := context.Background()
+	where, args := filter.where(func(n int) string { return "$" + strconv.Itoa(n) })
+	var total int
+	if err := me.DB.QueryRow(ctx, "SELECT count(*) FROM hmqaudit"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	selectSQL := "SELECT id, time, actor, action, target, before::text, after::text, sourceip FROM hmqaudit" + where + " ORDER BY id DESC" + filter.limit("ALL")
+	rows, queryError := me.DB.Query(ctx, selectSQL, args...)
+	if queryError != nil {
+		return nil, 0, queryError
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Actor, &entry.Action, &entry.Target, &before, &after, &entry.SourceIP); err != nil {
+			return nil, 0, err
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
 }
@@ -0,0 +1,841 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sqliteSchema creates the tables of the sqlite store, it is run every time the database is opened
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS hmqusers (
+	username TEXT PRIMARY KEY,
+	pwd TEXT NOT NULL,
+	admin BOOLEAN NOT NULL DEFAULT 0,
+	superuser BOOLEAN NOT NULL DEFAULT 0,
+	topics TEXT,
+	clientids TEXT,
+	"groups" TEXT
+);
+CREATE TABLE IF NOT EXISTS hmqgroups (
+	name TEXT PRIMARY KEY,
+	topics TEXT
+);
+CREATE TABLE IF NOT EXISTS hmqsessions (
+	tokenhash TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	expires TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS hmqsessions_username ON hmqsessions (username);
+CREATE TABLE IF NOT EXISTS hmqaudit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT NOT NULL,
+	before TEXT,
+	after TEXT,
+	sourceip TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS hmqaudit_time ON hmqaudit (time);
+CREATE TRIGGER IF NOT EXISTS hmqaudit_no_update BEFORE UPDATE ON hmqaudit
+	BEGIN SELECT RAISE(ABORT, 'The audit trail is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS hmqaudit_no_delete BEFORE DELETE ON hmqaudit
+	BEGIN SELECT RAISE(ABORT, 'The audit trail is append-only'); END;
+`
+
+// InitSQLite returns the store object that uses a sqlite database file
+func InitSQLite(fname string) *UserSQLiteCollection {
+
+	log.Println("Storage type is sqlite")
+	UsersSQLite.open(fname)
+	return &UsersSQLite
+}
+
+// open opens the database file, creating it and its tables if needed
+func (me *UserSQLiteCollection) open(fname string) {
+
+	// The busy timeout makes a writer wait for another rather than fail straight away
+	me.DB, me.DBerr = sql.Open("sqlite3", "file:"+fname+"?_busy_timeout=5000&_journal_mode=WAL")
+	if me.DBerr == nil {
+		_, me.DBerr = me.DB.Exec(sqliteSchema)
+	}
+	if me.DBerr != nil {
+		log.Println("Unable to open the sqlite db", me.DBerr)
+	}
+	me.usernames = indexUsers(me.Users)
+}
+
+// Load loads the users along with their topics from the db
+func (me *UserSQLiteCollection) Load() error {
+
+	if me.DBerr != nil {
+		return me.DBerr
+	}
+	var usersOut []User
+	LoadUserQuery := `SELECT username,pwd,admin,superuser,topics,clientids,"groups" FROM hmqusers`
+	UserRows, UserRowsError := me.DB.Query(LoadUserQuery)
+	if UserRowsError != nil {
+		log.Println(UserRowsError)
+		return UserRowsError
+	}
+	defer UserRows.Close()
+
+	for UserRows.Next() {
+		var dbUser User
+		scanner := UserRows.Scan(&dbUser.UserName, &dbUser.Password, &dbUser.Admin, &dbUser.SuperUser, &dbUser.Topics, &dbUser.ClientIDs, &dbUser.Groups)
+		if scanner != nil {
+			log.Println("scanner error: ", scanner)
+			return scanner
+		}
+		dbUser.IndexTopics()
+		usersOut = append(usersOut, dbUser)
+	}
+	if rowsError := UserRows.Err(); rowsError != nil {
+		log.Println(rowsError)
+		return rowsError
+	}
+
+	groupsOut, groupsLoadError := me.loadGroups()
+	if groupsLoadError != nil {
+		return groupsLoadError
+	}
+
+	me.Lock()
+	me.Users = usersOut
+	me.Groups = groupsOut
+	me.usernames = indexUsers(me.Users)
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// loadGroups loads the groups along with their topics from the db
+func (me *UserSQLiteCollection) loadGroups() ([]Group, error) {
+
+	var groupsOut []Group
+	LoadGroupQuery := "SELECT name,topics FROM hmqgroups"
+	GroupRows, GroupRowsError := me.DB.Query(LoadGroupQuery)
+	if GroupRowsError != nil {
+		log.Println(GroupRowsError)
+		return groupsOut, GroupRowsError
+	}
+	defer GroupRows.Close()
+
+	for GroupRows.Next() {
+		var dbGroup Group
+		scanner := GroupRows.Scan(&dbGroup.Name, &dbGroup.Topics)
+		if scanner != nil {
+			log.Println("scanner error: ", scanner)
+			return groupsOut, scanner
+		}
+		dbGroup.IndexTopics()
+		groupsOut = append(groupsOut, dbGroup)
+	}
+	return groupsOut, GroupRows.Err()
+}
+
+// Login logs the user in and generates a token for the session if required
+func (me *UserSQLiteCollection) Login(username string, password string, requesttoken bool) (User, error) {
+
+	userLoggingIn, getUserError := me.GetUserByUsername(username)
+	if getUserError != nil {
+		return userLoggingIn, errors.New("User not found")
+	}
+
+	PasswordValid := bcrypt.CompareHashAndPassword([]byte(userLoggingIn.Password), []byte(password))
+	if PasswordValid != nil {
+		var blankUser User
+		return blankUser, errors.New("Passwords don't match")
+	}
+
+	if requesttoken == true {
+		// Create a session
+		session, token, sessionError := newSession(username)
+		if sessionError != nil {
+			var blankUser User
+			return blankUser, sessionError
+		}
+		sessionAddError := me.AddSession(session)
+		if sessionAddError != nil {
+			var blankUser User
+			return blankUser, sessionAddError
+		}
+		userLoggingIn.Token = token
+	}
+	return userLoggingIn, nil
+}
+
+// AddUser adds a new user to the collection
+// Unlike the json store the db is written first, under the lock, so the users in memory never get ahead of it
+func (me *UserSQLiteCollection) AddUser(user User) error {
+	// Validate the user
+	// if the username and/or the password are blank then reject
+	if user.UserName == "" || user.Password == "" {
+		return errors.New("Username and password must both be non-blank")
+	}
+	me.Lock()
+	if _, exists := me.usernames[user.UserName]; exists {
+		me.Unlock()
+		return errors.New("User already exists")
+	}
+
+	hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		me.Unlock()
+		log.Println("Cannot create password hash")
+		return errors.New("Cannot create password hash")
+	}
+	user.Password = string(hashPWD)
+
+	insertSQL := `INSERT INTO hmqusers (username, pwd, admin, superuser, topics, clientids, "groups") VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, result := me.DB.Exec(insertSQL, user.UserName, user.Password, user.Admin, user.SuperUser, user.Topics, user.ClientIDs, user.Groups)
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in adding a user", result)
+		return result
+	}
+	user.IndexTopics()
+	me.Users = append(me.Users, user)
+	me.usernames[user.UserName] = len(me.Users) - 1
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	return nil
+}
+
+// EditUser edits an existing user, the password is only changed if a new one is given
+func (me *UserSQLiteCollection) EditUser(user User) error {
+	// Validate the user
+	// if the username is blank then reject
+	if user.UserName == "" {
+		return errors.New("Username and password must both be non-blank")
+	}
+
+	if user.Password != "" {
+		hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Println("Cannot create password hash")
+			return errors.New("Cannot create password hash")
+		}
+		user.Password = string(hashPWD)
+	}
+
+	me.Lock()
+	foundindex, found := me.usernames[user.UserName]
+	if !found {
+		me.Unlock()
+		return errors.New("User not found")
+	}
+	if user.Password == "" {
+		user.Password = me.Users[foundindex].Password
+	}
+	updateSQL := "UPDATE hmqusers SET pwd=?, admin=?, superuser=? WHERE username = ?"
+	_, result := me.DB.Exec(updateSQL, user.Password, user.Admin, user.SuperUser, user.UserName)
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in editing user: ", result)
+		return result
+	}
+	me.Users[foundindex].Admin = user.Admin
+	me.Users[foundindex].SuperUser = user.SuperUser
+	me.Users[foundindex].Password = user.Password
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	return nil
+}
+
+// UpdateUser accepts a user object and updates the relevant user
+// users cannot change their name - so we can rely upon username as a key
+func (me *UserSQLiteCollection) UpdateUser(user User) error {
+
+	me.Lock()
+	k, found := me.usernames[user.UserName]
+	if !found {
+		me.Unlock()
+		return errors.New("Could not find user")
+	}
+	if me.Users[k].Password != user.Password {
+		hashPWD, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			me.Unlock()
+			log.Println("Cannot create password hash")
+			return errors.New("Cannot create password hash")
+		}
+		user.Password = string(hashPWD)
+	}
+
+	updateSQL := `UPDATE hmqusers SET pwd=?, admin=?, superuser=?, topics=?, clientids=?, "groups"=? WHERE username = ?`
+	_, result := me.DB.Exec(updateSQL, user.Password, user.Admin, user.SuperUser, user.Topics, user.ClientIDs, user.Groups, user.UserName)
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in updating user: ", result)
+		return result
+	}
+	user.IndexTopics()
+	me.Users[k] = user
+	me.Unlock()
+	notifyUserChange(user.UserName)
+	return nil
+}
+
+// PutUsers adds the users or replaces those that exist, as they are given and in a single transaction.
+// The passwords must already be bcrypt hashes and are kept unchanged, as when copying the users from another store
+func (me *UserSQLiteCollection) PutUsers(users []User) error {
+
+	if err := checkPutUsers(users); err != nil {
+		return err
+	}
+	me.Lock()
+	result := me.inTransaction(func(tx *sql.Tx) error {
+		upsertSQL := `INSERT INTO hmqusers (username, pwd, admin, superuser, topics, clientids, "groups") VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (username) DO UPDATE SET pwd=excluded.pwd, admin=excluded.admin, superuser=excluded.superuser,
+			topics=excluded.topics, clientids=excluded.clientids, "groups"=excluded."groups"`
+		for _, v := range users {
+			if _, err := tx.Exec(upsertSQL, v.UserName, v.Password, v.Admin, v.SuperUser, v.Topics, v.ClientIDs, v.Groups); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in putting users: ", result)
+		return result
+	}
+	me.Users = putUsers(me.Users, me.usernames, users)
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// DeleteUser removes a user from the collection along with their sessions, using the username as a key
+func (me *UserSQLiteCollection) DeleteUser(username string) error {
+
+	me.Lock()
+	k, found := me.usernames[username]
+	if !found {
+		me.Unlock()
+		return errors.New("User Not Found")
+	}
+
+	result := me.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM hmqusers WHERE username = ?", username); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM hmqsessions WHERE username = ?", username)
+		return err
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in deleting user: ", result)
+		return result
+	}
+	last := len(me.Users) - 1
+	me.Users[k] = me.Users[last]
+	me.usernames[me.Users[k].UserName] = k
+	delete(me.usernames, username)
+	me.Users = me.Users[:last]
+	me.Unlock()
+	notifyUserChange(username)
+	return nil
+}
+
+// inTransaction runs the statements of a change in a transaction, which is rolled back if any of them fails
+func (me *UserSQLiteCollection) inTransaction(statements func(tx *sql.Tx) error) error {
+
+	tx, beginError := me.DB.Begin()
+	if beginError != nil {
+		return beginError
+	}
+	if err := statements(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUserByToken returns the user logged in with a session token, expired sessions are rejected and
+// the expiry of a valid session is moved on
+func (me *UserSQLiteCollection) GetUserByToken(token string) (User, error) {
+	return me.GetUserBySessionID(hashToken(token))
+}
+
+// GetUserBySessionID returns the user a session belongs to, renewing the session
+func (me *UserSQLiteCollection) GetUserBySessionID(tokenHash string) (User, error) {
+
+	var blankUser User
+	var session Session
+
+	// Looking the session up by the keyed hash gives nothing away about the token through timing,
+	// the hash found is still compared in constant time as a belt and braces check
+	selectSQL := "SELECT tokenhash, username, created, expires FROM hmqsessions WHERE tokenhash = ?"
+	scanError := me.DB.QueryRow(selectSQL, tokenHash).Scan(&session.TokenHash, &session.UserName, &session.Created, &session.Expires)
+	if scanError != nil || tokenHashMatch(session.TokenHash, tokenHash) == false {
+		return blankUser, errors.New("Session not found")
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		return blankUser, errors.New("Session expired")
+	}
+	if session.renew(now) {
+		updateSQL := "UPDATE hmqsessions SET expires = ? WHERE tokenhash = ?"
+		_, result := me.DB.Exec(updateSQL, session.Expires.UTC(), tokenHash)
+		if result != nil {
+			log.Println("Error in renewing session: ", result)
+		}
+	}
+	return me.GetUserByUsername(session.UserName)
+}
+
+// AddSession stores a new session, any sessions that have expired are cleared out at the same time
+func (me *UserSQLiteCollection) AddSession(session Session) error {
+
+	// times are kept in UTC as sqlite compares them as text
+	_, pruneResult := me.DB.Exec("DELETE FROM hmqsessions WHERE expires < ?", time.Now().UTC())
+	if pruneResult != nil {
+		log.Println("Error in clearing expired sessions: ", pruneResult)
+	}
+
+	insertSQL := "INSERT INTO hmqsessions (tokenhash, username, created, expires) VALUES (?, ?, ?, ?)"
+	_, result := me.DB.Exec(insertSQL, session.TokenHash, session.UserName, session.Created.UTC(), session.Expires.UTC())
+	if result != nil {
+		log.Println("Error in adding a session: ", result)
+	}
+	return result
+}
+
+// DeleteSession removes a session, logging it out
+func (me *UserSQLiteCollection) DeleteSession(token string) error {
+	return me.DeleteSessionByID(hashToken(token))
+}
+
+// DeleteSessionByID removes a session by its id
+func (me *UserSQLiteCollection) DeleteSessionByID(tokenHash string) error {
+
+	deleted, result := me.DB.Exec("DELETE FROM hmqsessions WHERE tokenhash = ?", tokenHash)
+	if result != nil {
+		log.Println("Error in deleting session: ", result)
+		return result
+	}
+	if rows, _ := deleted.RowsAffected(); rows == 0 {
+		return errors.New("Session not found")
+	}
+	return nil
+}
+
+// DeleteUserSessions removes every session of a user
+func (me *UserSQLiteCollection) DeleteUserSessions(username string) error {
+
+	_, result := me.DB.Exec("DELETE FROM hmqsessions WHERE username = ?", username)
+	if result != nil {
+		log.Println("Error in deleting sessions: ", result)
+	}
+	return result
+}
+
+// GetUserByUsername returns a user from the collection using username as a key
+func (me *UserSQLiteCollection) GetUserByUsername(username string) (User, error) {
+
+	me.RLock()
+	defer me.RUnlock()
+	if k, found := me.usernames[username]; found {
+		return me.Users[k], nil
+	}
+	var blankUser User
+	return blankUser, errors.New("User not found")
+}
+
+// GetUsers returns all the users from the collection
+func (me *UserSQLiteCollection) GetUsers() []User {
+	me.RLock()
+	defer me.RUnlock()
+	return me.Users
+}
+
+// AddTopicToUser adds a new topic to an existing user
+func (me *UserSQLiteCollection) AddTopicToUser(username string, topic Topic) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for _, v := range targetUser.Topics {
+		if v.TopicString == topic.TopicString {
+			return errors.New("Topic already exists")
+		}
+	}
+
+	topics := make(TopicArray, 0, len(targetUser.Topics)+1)
+	targetUser.Topics = append(append(topics, targetUser.Topics...), topic)
+	return me.UpdateUser(targetUser)
+}
+
+// EditTopicForUser edits and existing topic for an existing user in the collection
+func (me *UserSQLiteCollection) EditTopicForUser(username string, topic Topic) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.Topics {
+		if v.TopicString == topic.TopicString {
+			// the topics are copied as the stored user shares them until UpdateUser replaces it
+			topics := make(TopicArray, len(targetUser.Topics))
+			copy(topics, targetUser.Topics)
+			topics[k] = topic
+			targetUser.Topics = topics
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromUser removes a topic permission for that user if the topic does not exist it returns an error
+func (me *UserSQLiteCollection) DeleteTopicFromUser(username string, topicString string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.Topics {
+		if v.TopicString == topicString {
+			topics := make(TopicArray, 0, len(targetUser.Topics)-1)
+			topics = append(topics, targetUser.Topics[:k]...)
+			targetUser.Topics = append(topics, targetUser.Topics[k+1:]...)
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// AddClientIDToUser adds an allowed client id (or client id pattern) to an existing user
+func (me *UserSQLiteCollection) AddClientIDToUser(username string, clientID string) error {
+
+	if clientID == "" {
+		return errors.New("Client id cannot be blank")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for _, v := range targetUser.ClientIDs {
+		if v == clientID {
+			return errors.New("Client id already exists")
+		}
+	}
+
+	clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)+1)
+	targetUser.ClientIDs = append(append(clientIDs, targetUser.ClientIDs...), clientID)
+	return me.UpdateUser(targetUser)
+}
+
+// DeleteClientIDFromUser removes an allowed client id from a user, if the client id does not exist it returns an error
+func (me *UserSQLiteCollection) DeleteClientIDFromUser(username string, clientID string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+
+	for k, v := range targetUser.ClientIDs {
+		if v == clientID {
+			clientIDs := make(ClientIDArray, 0, len(targetUser.ClientIDs)-1)
+			clientIDs = append(clientIDs, targetUser.ClientIDs[:k]...)
+			targetUser.ClientIDs = append(clientIDs, targetUser.ClientIDs[k+1:]...)
+
+			return me.UpdateUser(targetUser)
+		}
+	}
+	return errors.New("Client id not found")
+}
+
+// GetGroups returns all the groups from the collection
+func (me *UserSQLiteCollection) GetGroups() []Group {
+	me.RLock()
+	defer me.RUnlock()
+	return me.Groups
+}
+
+// GetGroup returns a group from the collection using its name as a key
+func (me *UserSQLiteCollection) GetGroup(name string) (Group, error) {
+
+	me.RLock()
+	defer me.RUnlock()
+
+	for _, v := range me.Groups {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	var blankGroup Group
+	return blankGroup, errors.New("Group not found")
+}
+
+// AddGroup adds a new group to the collection
+func (me *UserSQLiteCollection) AddGroup(group Group) error {
+	if group.Name == "" {
+		return errors.New("Group name must be non-blank")
+	}
+
+	me.Lock()
+	defer me.Unlock()
+	for _, v := range me.Groups {
+		if v.Name == group.Name {
+			return errors.New("Group already exists")
+		}
+	}
+
+	_, result := me.DB.Exec("INSERT INTO hmqgroups (name, topics) VALUES (?, ?)", group.Name, group.Topics)
+	if result != nil {
+		log.Println("Error in adding a group", result)
+		return result
+	}
+	group.IndexTopics()
+	me.Groups = append(me.Groups, group)
+	return nil
+}
+
+// UpdateGroup accepts a group object and replaces the group with the same name
+func (me *UserSQLiteCollection) UpdateGroup(group Group) error {
+
+	me.Lock()
+	for k, v := range me.Groups {
+		if v.Name == group.Name {
+			_, result := me.DB.Exec("UPDATE hmqgroups SET topics=? WHERE name = ?", group.Topics, group.Name)
+			if result != nil {
+				me.Unlock()
+				log.Println("Error in updating group: ", result)
+				return result
+			}
+			group.IndexTopics()
+			me.Groups[k] = group
+			me.Unlock()
+			notifyUserChange("")
+			return nil
+		}
+	}
+	me.Unlock()
+	return errors.New("Could not find group")
+}
+
+// PutGroups adds the groups or replaces those that exist, as they are given and in a single transaction
+func (me *UserSQLiteCollection) PutGroups(groups []Group) error {
+
+	if err := checkPutGroups(groups); err != nil {
+		return err
+	}
+	me.Lock()
+	result := me.inTransaction(func(tx *sql.Tx) error {
+		upsertSQL := "INSERT INTO hmqgroups (name, topics) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET topics=excluded.topics"
+		for _, v := range groups {
+			if _, err := tx.Exec(upsertSQL, v.Name, v.Topics); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in putting groups: ", result)
+		return result
+	}
+	me.Groups = putGroups(me.Groups, groups)
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// DeleteGroup removes a group from the collection and takes every user out of it, in a single transaction
+func (me *UserSQLiteCollection) DeleteGroup(name string) error {
+
+	me.Lock()
+	found := -1
+	for k, v := range me.Groups {
+		if v.Name == name {
+			found = k
+			break
+		}
+	}
+	if found < 0 {
+		me.Unlock()
+		return errors.New("Group Not Found")
+	}
+	var members []int
+	for k, v := range me.Users {
+		if v.InGroup(name) {
+			members = append(members, k)
+		}
+	}
+
+	result := me.inTransaction(func(tx *sql.Tx) error {
+		for _, k := range members {
+			updateSQL := `UPDATE hmqusers SET "groups"=? WHERE username = ?`
+			if _, err := tx.Exec(updateSQL, removeGroupName(me.Users[k].Groups, name), me.Users[k].UserName); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("DELETE FROM hmqgroups WHERE name = ?", name)
+		return err
+	})
+	if result != nil {
+		me.Unlock()
+		log.Println("Error in deleting group: ", result)
+		return result
+	}
+	for _, k := range members {
+		me.Users[k].Groups = removeGroupName(me.Users[k].Groups, name)
+	}
+	me.Groups[found] = me.Groups[len(me.Groups)-1]
+	me.Groups = me.Groups[:len(me.Groups)-1]
+	me.Unlock()
+	notifyUserChange("")
+	return nil
+}
+
+// AddTopicToGroup adds a new topic to an existing group
+func (me *UserSQLiteCollection) AddTopicToGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for _, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			return errors.New("Topic already exists")
+		}
+	}
+
+	topics := make(TopicArray, 0, len(targetGroup.Topics)+1)
+	targetGroup.Topics = append(append(topics, targetGroup.Topics...), topic)
+	return me.UpdateGroup(targetGroup)
+}
+
+// EditTopicForGroup edits an existing topic for an existing group in the collection
+func (me *UserSQLiteCollection) EditTopicForGroup(name string, topic Topic) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topic.TopicString {
+			topics := make(TopicArray, len(targetGroup.Topics))
+			copy(topics, targetGroup.Topics)
+			topics[k] = topic
+			targetGroup.Topics = topics
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// DeleteTopicFromGroup removes a topic permission from a group, if the topic does not exist it returns an error
+func (me *UserSQLiteCollection) DeleteTopicFromGroup(name string, topicString string) error {
+
+	targetGroup, getTargetGroupError := me.GetGroup(name)
+	if getTargetGroupError != nil {
+		return errors.New("Could not find group")
+	}
+
+	for k, v := range targetGroup.Topics {
+		if v.TopicString == topicString {
+			topics := make(TopicArray, 0, len(targetGroup.Topics)-1)
+			topics = append(topics, targetGroup.Topics[:k]...)
+			targetGroup.Topics = append(topics, targetGroup.Topics[k+1:]...)
+			return me.UpdateGroup(targetGroup)
+		}
+	}
+	return errors.New("Topic not found")
+}
+
+// AddUserToGroup makes an existing user a member of an existing group
+func (me *UserSQLiteCollection) AddUserToGroup(username string, name string) error {
+
+	_, getGroupError := me.GetGroup(name)
+	if getGroupError != nil {
+		return errors.New("Could not find group")
+	}
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) {
+		return errors.New("User already in group")
+	}
+
+	groups := make(GroupArray, 0, len(targetUser.Groups)+1)
+	targetUser.Groups = append(append(groups, targetUser.Groups...), name)
+	return me.UpdateUser(targetUser)
+}
+
+// RemoveUserFromGroup takes a user out of a group
+func (me *UserSQLiteCollection) RemoveUserFromGroup(username string, name string) error {
+
+	targetUser, getTargetUserError := me.GetUserByUsername(username)
+	if getTargetUserError != nil {
+		return errors.New("Could not find user")
+	}
+	if targetUser.InGroup(name) == false {
+		return errors.New("User not in group")
+	}
+
+	targetUser.Groups = removeGroupName(targetUser.Groups, name)
+	return me.UpdateUser(targetUser)
+}
+
+// AddAuditEntry appends an entry to the audit trail, the table refuses updates and deletes
+func (me *UserSQLiteCollection) AddAuditEntry(entry AuditEntry) error {
+
+	insertSQL := "INSERT INTO hmqaudit (time, actor, action, target, before, after, sourceip) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, result := me.DB.Exec(insertSQL, entry.Time.UTC(), entry.Actor, entry.Action, entry.Target, nullJSON(entry.Before), nullJSON(entry.After), entry.SourceIP)
+	if result != nil {
+		log.Println("Error in adding an audit entry: ", result)
+	}
+	return result
+}
+
+// GetAuditEntries returns the page of audit entries the filter selects, newest first, along with how
+// many entries it selects in all
+func (me *UserSQLiteCollection) GetAuditEntries(filter AuditFilter) ([]AuditEntry, int, error) {
+
+	where, args := filter.where(func(n int) string { return "?" })
+	var total int
+	if err := me.DB.QueryRow("SELECT count(*) FROM hmqaudit"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	selectSQL := "SELECT id, time, actor, action, target, before, after, sourceip FROM hmqaudit" + where + " ORDER BY id DESC" + filter.limit("-1")
+	rows, queryError := me.DB.Query(selectSQL, args...)
+	if queryError != nil {
+		return nil, 0, queryError
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Actor, &entry.Action, &entry.Target, &before, &after, &entry.SourceIP); err != nil {
+			return nil, 0, err
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
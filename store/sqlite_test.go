@@ -0,0 +1,177 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestSQLite opens a sqlite store in a temporary directory
+func openTestSQLite(t *testing.T, fname string) *UserSQLiteCollection {
+	collection := &UserSQLiteCollection{}
+	collection.open(fname)
+	if collection.DBerr != nil {
+		t.Fatal(collection.DBerr)
+	}
+	t.Cleanup(func() { collection.DB.Close() })
+	if err := collection.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return collection
+}
+
+func TestSQLiteUsers(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "users.db")
+	collection := openTestSQLite(t, fname)
+
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw"}); err == nil {
+		t.Errorf("duplicate user added")
+	}
+	if err := collection.AddUser(User{UserName: "sensor1", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddTopicToUser("sensor1", Topic{TopicString: "devices/%u/#", Pub: true, Sub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddTopicToUser("sensor1", Topic{TopicString: "devices/%u/#"}); err == nil {
+		t.Errorf("duplicate topic added")
+	}
+	if err := collection.AddTopicToUser("sensor1", Topic{TopicString: "alerts/#", Sub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.EditTopicForUser("sensor1", Topic{TopicString: "alerts/#", Pub: true, Sub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.DeleteTopicFromUser("sensor1", "devices/%u/#"); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddClientIDToUser("sensor1", "sensor1-*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.EditUser(User{UserName: "sensor1", SuperUser: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.Login("sensor1", "pw", false); err != nil {
+		t.Errorf("password lost when editing without one: %v", err)
+	}
+
+	// everything has to survive the database being opened again
+	reopened := openTestSQLite(t, fname)
+	for _, v := range []*UserSQLiteCollection{collection, reopened} {
+		user, err := v.GetUserByUsername("sensor1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.SuperUser == false || reflect.DeepEqual(user.ClientIDs, ClientIDArray{"sensor1-*"}) == false {
+			t.Errorf("user not saved: %+v", user)
+		}
+		if reflect.DeepEqual(user.Topics, TopicArray{{TopicString: "alerts/#", Pub: true, Sub: true}}) == false {
+			t.Errorf("topics not saved: %+v", user.Topics)
+		}
+		if pub, _, _ := user.CheckTopicAuth("alerts/fire", "sensor1-a", nil); pub == false {
+			t.Errorf("topic check failed after loading")
+		}
+		if admin, _ := v.GetUserByUsername("Gaz"); admin.Admin == false {
+			t.Errorf("admin flag not saved")
+		}
+	}
+
+	if err := reopened.DeleteUser("Gaz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.DeleteUser("Gaz"); err == nil {
+		t.Errorf("deleted user deleted again")
+	}
+	if users := reopened.GetUsers(); len(users) != 1 || users[0].UserName != "sensor1" {
+		t.Errorf("unexpected users after a delete: %+v", users)
+	}
+}
+
+func TestSQLiteSessions(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "users.db")
+	collection := openTestSQLite(t, fname)
+	if err := collection.AddUser(User{UserName: "Gaz", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := collection.Login("Gaz", "pw", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := collection.Login("Gaz", "pw", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.Login("Gaz", "wrong", true); err == nil {
+		t.Errorf("login with the wrong password")
+	}
+	if user, err := openTestSQLite(t, fname).GetUserByToken(first.Token); err != nil || user.UserName != "Gaz" {
+		t.Errorf("session not found after reopening: %v", err)
+	}
+
+	if err := collection.DeleteSession(first.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.DeleteSession(first.Token); err == nil {
+		t.Errorf("session deleted twice")
+	}
+	if _, err := collection.GetUserByToken(first.Token); err == nil {
+		t.Errorf("logged out session still valid")
+	}
+	if _, err := collection.GetUserByToken(second.Token); err != nil {
+		t.Errorf("other session logged out: %v", err)
+	}
+
+	// deleting the user ends their sessions
+	if err := collection.DeleteUser("Gaz"); err != nil {
+		t.Fatal(err)
+	}
+	var sessions int
+	collection.DB.QueryRow("SELECT COUNT(*) FROM hmqsessions").Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("sessions left after deleting the user: %d", sessions)
+	}
+}
+
+func TestSQLiteGroups(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "users.db")
+	collection := openTestSQLite(t, fname)
+	if err := collection.AddUser(User{UserName: "sensor1", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddGroup(Group{Name: "sensors"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddGroup(Group{Name: "sensors"}); err == nil {
+		t.Errorf("duplicate group added")
+	}
+	if err := collection.AddTopicToGroup("sensors", Topic{TopicString: "telemetry/%u", Pub: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.AddUserToGroup("sensor1", "sensors"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestSQLite(t, fname)
+	user, _ := reopened.GetUserByUsername("sensor1")
+	if pub, _, _ := user.CheckTopicAuth("telemetry/sensor1", "", GetGroupsForUser(reopened, user)); pub == false {
+		t.Errorf("group topic not saved")
+	}
+
+	if err := reopened.DeleteGroup("sensors"); err != nil {
+		t.Fatal(err)
+	}
+	reopened = openTestSQLite(t, fname)
+	if _, err := reopened.GetGroup("sensors"); err == nil {
+		t.Errorf("deleted group still there")
+	}
+	if user, _ := reopened.GetUserByUsername("sensor1"); user.InGroup("sensors") {
+		t.Errorf("user still in the deleted group")
+	}
+}
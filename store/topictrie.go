@@ -0,0 +1,157 @@
+package store
+
+import "strings"
+
+// topicTrie indexes a set of topic permissions by the levels of their topic filters, so the permissions
+// matching a topic are found by walking the levels of the topic once rather than by calling topicMatch
+// on every permission. It gives the same matches as topicMatch
+type topicTrie struct {
+	root *topicTrieNode
+	// the odd filters the levels cannot represent, such as ones with an empty level, are matched the slow way
+	unindexed TopicArray
+	// the permissions the trie was built from, see indexes
+	source TopicArray
+}
+
+// topicTrieNode is one level of the trie
+type topicTrieNode struct {
+	literals map[string]*topicTrieNode
+	// levels with a %u or %c placeholder, compared once the placeholders are expanded
+	placeholders map[string]*topicTrieNode
+	plus         *topicTrieNode
+	// permissions whose filter ends at this node
+	topics TopicArray
+	// permissions whose filter has a # at the next level, which matches any one or more levels
+	hashTopics TopicArray
+}
+
+// newTopicTrie builds the trie for a set of permissions
+func newTopicTrie(topics TopicArray) *topicTrie {
+	trie := &topicTrie{root: &topicTrieNode{}, source: topics}
+	for _, v := range topics {
+		trie.add(v)
+	}
+	return trie
+}
+
+// add puts a permission into the trie
+func (me *topicTrie) add(topic Topic) {
+	filter := topic.TopicString
+	if filter == "" {
+		return
+	}
+	levels := strings.Split(strings.TrimSuffix(filter, "/"), "/")
+
+	// topicMatch stops at the first #, whatever follows it. An empty level before it means the filter
+	// only matches a topic equal to it, and a placeholder after it still has to be valid for the filter
+	// to apply - neither is worth a place in the trie
+	for k, level := range levels {
+		if level == "" {
+			me.unindexed = append(me.unindexed, topic)
+			return
+		}
+		if level == "#" {
+			rest := strings.Join(levels[k:], "/")
+			if strings.Contains(rest, "%u") || strings.Contains(rest, "%c") {
+				me.unindexed = append(me.unindexed, topic)
+				return
+			}
+			levels = levels[:k+1]
+			break
+		}
+	}
+
+	node := me.root
+	for _, level := range levels {
+		switch {
+		case level == "#":
+			node.hashTopics = append(node.hashTopics, topic)
+			return
+		case level == "+":
+			if node.plus == nil {
+				node.plus = &topicTrieNode{}
+			}
+			node = node.plus
+		case strings.Contains(level, "%u") || strings.Contains(level, "%c"):
+			node = node.child(&node.placeholders, level)
+		default:
+			node = node.child(&node.literals, level)
+		}
+	}
+	node.topics = append(node.topics, topic)
+}
+
+// child returns the child of a node for a level, adding it if needed
+func (me *topicTrieNode) child(children *map[string]*topicTrieNode, level string) *topicTrieNode {
+	if *children == nil {
+		*children = make(map[string]*topicTrieNode)
+	}
+	next, found := (*children)[level]
+	if found == false {
+		next = &topicTrieNode{}
+		(*children)[level] = next
+	}
+	return next
+}
+
+// indexes checks whether the trie was built from exactly this set of permissions
+func (me *topicTrie) indexes(topics TopicArray) bool {
+	if me == nil || len(me.source) != len(topics) {
+		return false
+	}
+	return len(topics) == 0 || &me.source[0] == &topics[0]
+}
+
+// match calls found for every permission whose filter matches the topic, once the placeholders in the
+// filter are expanded for the username and client id
+func (me *topicTrie) match(topic string, username string, clientID string, found func(Topic)) {
+	if topic == "" {
+		return
+	}
+	for _, v := range me.unindexed {
+		permittedTopic, expanded := expandTopicPlaceholders(v.TopicString, username, clientID)
+		if expanded && topicMatch(topic, permittedTopic) {
+			found(v)
+		}
+	}
+	topic = strings.TrimSuffix(topic, "/")
+
+	var replacer *strings.Replacer
+	expand := func(level string) (string, bool) {
+		if strings.Contains(level, "%u") && validPlaceholderValue(username) == false {
+			return "", false
+		}
+		if strings.Contains(level, "%c") && validPlaceholderValue(clientID) == false {
+			return "", false
+		}
+		if replacer == nil {
+			replacer = strings.NewReplacer("%u", username, "%c", clientID)
+		}
+		return replacer.Replace(level), true
+	}
+	me.root.match(strings.Split(topic, "/"), expand, found)
+}
+
+// match walks the remaining levels of a topic down from a node
+func (me *topicTrieNode) match(levels []string, expand func(string) (string, bool), found func(Topic)) {
+	if len(levels) == 0 {
+		for _, v := range me.topics {
+			found(v)
+		}
+		return
+	}
+	for _, v := range me.hashTopics {
+		found(v)
+	}
+	if next, ok := me.literals[levels[0]]; ok {
+		next.match(levels[1:], expand, found)
+	}
+	if me.plus != nil {
+		me.plus.match(levels[1:], expand, found)
+	}
+	for level, next := range me.placeholders {
+		if expanded, ok := expand(level); ok && expanded == levels[0] {
+			next.match(levels[1:], expand, found)
+		}
+	}
+}
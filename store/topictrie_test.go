@@ -0,0 +1,109 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// combineLevels returns every topic of one to maxLevels levels made of the given levels
+func combineLevels(levels []string, maxLevels int) []string {
+	var out []string
+	current := []string{""}
+	for n := 0; n < maxLevels; n++ {
+		var next []string
+		for _, prefix := range current {
+			for _, level := range levels {
+				if n == 0 {
+					next = append(next, level)
+				} else {
+					next = append(next, prefix+"/"+level)
+				}
+			}
+		}
+		out = append(out, next...)
+		current = next
+	}
+	return out
+}
+
+func TestTopicTrieMatchesTopicMatch(t *testing.T) {
+
+	var topics TopicArray
+	for _, filter := range combineLevels([]string{"a", "b", "+", "#", "%u", "dev-%c", ""}, 3) {
+		if filter == "" {
+			continue
+		}
+		topics = append(topics, Topic{TopicString: filter}, Topic{TopicString: filter + "/"})
+	}
+	trie := newTopicTrie(topics)
+
+	for _, topic := range combineLevels([]string{"a", "b", "bob", "dev-c1", "+", "#", ""}, 3) {
+		if topic == "" {
+			continue
+		}
+		for _, ids := range [][2]string{{"bob", "c1"}, {"bob", ""}, {"", "c1"}, {"a/b", "c1"}} {
+			var want, got []string
+			for _, v := range topics {
+				permittedTopic, expanded := expandTopicPlaceholders(v.TopicString, ids[0], ids[1])
+				if expanded && topicMatch(topic, permittedTopic) {
+					want = append(want, v.TopicString)
+				}
+			}
+			trie.match(topic, ids[0], ids[1], func(v Topic) { got = append(got, v.TopicString) })
+			sort.Strings(want)
+			sort.Strings(got)
+			if reflect.DeepEqual(want, got) == false {
+				t.Fatalf("topic %q user %q client %q: topicMatch found %v, the trie found %v", topic, ids[0], ids[1], want, got)
+			}
+		}
+	}
+}
+
+func TestCheckTopicAuthIndexed(t *testing.T) {
+
+	user := User{UserName: "bob", Topics: TopicArray{{TopicString: "plant/#", Pub: true, Sub: true}, {TopicString: "plant/secrets/#", Pub: true, Deny: true}}}
+	user.IndexTopics()
+	pub, sub, err := user.CheckTopicAuth("plant/secrets/key", "", nil)
+	if err != nil || pub || sub == false {
+		t.Errorf("got %v %v %v", pub, sub, err)
+	}
+
+	// a copy of the user with other topics does not use the stale index
+	user.Topics = append(TopicArray{}, user.Topics[0])
+	pub, _, _ = user.CheckTopicAuth("plant/secrets/key", "", nil)
+	if pub == false {
+		t.Errorf("stale topic index used")
+	}
+}
+
+// benchmarkUser returns a user with n topics, like a gateway with a permission for every device behind it
+func benchmarkUser(n int) User {
+	user := User{UserName: "gateway"}
+	for i := 0; i < n; i++ {
+		user.Topics = append(user.Topics, Topic{TopicString: fmt.Sprintf("site/%d/device/%d/+", i%50, i), Pub: true, Sub: true})
+	}
+	user.Topics = append(user.Topics, Topic{TopicString: "site/+/status/#", Sub: true}, Topic{TopicString: "gateway/%u/#", Pub: true})
+	return user
+}
+
+func benchmarkCheckTopicAuth(b *testing.B, n int, indexed bool) {
+	user := benchmarkUser(n)
+	if indexed {
+		user.IndexTopics()
+	}
+	topic := strings.Replace(user.Topics[n/2].TopicString, "+", "temp", 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if pub, _, _ := user.CheckTopicAuth(topic, "client1", nil); pub == false {
+			b.Fatal("topic not granted")
+		}
+	}
+}
+
+func BenchmarkCheckTopicAuthLoop100(b *testing.B)  { benchmarkCheckTopicAuth(b, 100, false) }
+func BenchmarkCheckTopicAuthTrie100(b *testing.B)  { benchmarkCheckTopicAuth(b, 100, true) }
+func BenchmarkCheckTopicAuthLoop5000(b *testing.B) { benchmarkCheckTopicAuth(b, 5000, false) }
+func BenchmarkCheckTopicAuthTrie5000(b *testing.B) { benchmarkCheckTopicAuth(b, 5000, true) }
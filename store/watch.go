@@ -0,0 +1,136 @@
+package store
+
+// This reloads the users of the json store when their file is changed by something other than hmqauth,
+// such as a provisioning job, or when the process gets a SIGHUP
+
+import (
+	"authserver/config"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long the users file has to stay unchanged before it is read, so that a file
+// written in several steps is only read once it is complete
+const watchSettle = 250 * time.Millisecond
+
+// parseUsers reads and checks the content of a users file, the users are only used if it is valid
+func parseUsers(content []byte) ([]User, error) {
+
+	var jsonUsers []User
+	if err := json.Unmarshal(content, &jsonUsers); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for k, v := range jsonUsers {
+		if v.UserName == "" {
+			return nil, errors.New("User " + strconv.Itoa(k+1) + " has no username")
+		}
+		if seen[v.UserName] {
+			return nil, errors.New("User " + v.UserName + " appears more than once")
+		}
+		seen[v.UserName] = true
+		jsonUsers[k].IndexTopics()
+	}
+	return jsonUsers, nil
+}
+
+// ReloadUsers reads the users file again and swaps the users in if it is valid. If the file cannot be
+// read or is not valid the users loaded before are kept. Groups and sessions are left as they are
+func (me *UserJSONCollection) ReloadUsers() error {
+
+	me.RLock()
+	fname := me.Fname
+	me.RUnlock()
+
+	content, readError := ioutil.ReadFile(fname)
+	if readError != nil {
+		log.Println("Keeping the users loaded before, cannot read", fname, readError)
+		return readError
+	}
+	// hmqauth's own saves change the file too, there is nothing to reload if it holds what was saved
+	if saved, ok := me.savedHash.Load().([sha256.Size]byte); ok && saved == sha256.Sum256(content) {
+		return nil
+	}
+	jsonUsers, parseError := parseUsers(content)
+	if parseError != nil {
+		log.Println("Keeping the users loaded before, cannot use", fname, parseError)
+		return parseError
+	}
+	for k := range jsonUsers {
+		jsonUsers[k].Token = ""
+	}
+
+	me.Lock()
+	me.Users = jsonUsers
+	me.reindex()
+	me.Unlock()
+	me.savedHash.Store(sha256.Sum256(content))
+	notifyUserChange("")
+	log.Println("Reloaded", len(jsonUsers), "users from", fname)
+	return nil
+}
+
+// WatchFile reloads the users whenever their file changes or the process gets a SIGHUP, until the app
+// shuts down. The directory is watched rather than the file so that a file replaced by a rename is seen
+func (me *UserJSONCollection) WatchFile() {
+
+	me.RLock()
+	fname := filepath.Clean(me.Fname)
+	me.RUnlock()
+
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, watchError := fsnotify.NewWatcher()
+	if watchError == nil {
+		watchError = watcher.Add(filepath.Dir(fname))
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+	if watchError != nil {
+		log.Println("Cannot watch", fname, "for changes, the users are only reloaded on a SIGHUP:", watchError)
+		events = nil
+		errs = nil
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	config.WG.Add(1)
+	go func() {
+		defer config.WG.Done()
+		defer signal.Stop(hup)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-config.Done:
+				return
+			case <-hup:
+				log.Println("SIGHUP, reloading the users")
+				me.ReloadUsers()
+			case event := <-events:
+				if filepath.Clean(event.Name) == fname && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					settle = time.After(watchSettle)
+				}
+			case err := <-errs:
+				log.Println("Error watching", fname, err)
+			case <-settle:
+				settle = nil
+				me.ReloadUsers()
+			}
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseUsers(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: `[{"username": "Gaz", "password": "x"}, {"username": "Chloe", "password": "y"}]`},
+		{name: "empty", content: `[]`},
+		{name: "not json", content: `[{"username": "Gaz",`, wantErr: true},
+		{name: "blank username", content: `[{"username": "", "password": "x"}]`, wantErr: true},
+		{name: "duplicate username", content: `[{"username": "Gaz"}, {"username": "Gaz"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseUsers([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseUsers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReloadUsers(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	write := func(content string) {
+		if err := ioutil.WriteFile(collection.Fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"username": "Gaz", "password": "x"}]`)
+	if err := collection.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file that does not parse leaves the users as they were, at startup as well as on a reload
+	write(`[{"username": "Gaz", "password": "x"},`)
+	if err := collection.ReloadUsers(); err == nil {
+		t.Errorf("broken file reloaded")
+	}
+	if err := collection.Load(); err == nil {
+		t.Errorf("broken file loaded")
+	}
+	if _, err := collection.GetUserByUsername("Gaz"); err != nil {
+		t.Errorf("users lost after a broken file: %v", err)
+	}
+
+	write(`[{"username": "Chloe", "password": "y", "topics": [{"topicstring": "a/#", "pub": true}]}]`)
+	if err := collection.ReloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.GetUserByUsername("Gaz"); err == nil {
+		t.Errorf("removed user still there after a reload")
+	}
+	user, err := collection.GetUserByUsername("Chloe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, _, _ := user.CheckTopicAuth("a/b", "", nil); pub == false {
+		t.Errorf("topics of a reloaded user not checked")
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+
+	collection := newTestJSONCollection(t)
+	if err := ioutil.WriteFile(collection.Fname, []byte(`[]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.Load(); err != nil {
+		t.Fatal(err)
+	}
+	collection.WatchFile()
+
+	if err := ioutil.WriteFile(collection.Fname, []byte(`[{"username": "Gaz", "password": "x"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := collection.GetUserByUsername("Gaz"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("user not reloaded after the file changed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}